@@ -160,17 +160,22 @@ func main() {
 	peers := mustRaftPeers()
 	publicPeers := parsePeerMap(os.Getenv("LSMDB_PUBLIC_PEERS"))
 
+	// ✅ ВАЖНО: дефолтный конфиг стора берём из pkg/config, а не pkg/store
+	dbCfg := pkgcfg.Default()
+	dbCfg.DB.Persistence.RootPath = cfg.Storage.DataDir
+	dbCfg.DB.Persistence.SSTable.BlockSize = int(cfg.Storage.BlockSizeBytes)
+	dbCfg.DB.Persistence.BloomFilter.BitsPerKey = int(cfg.Storage.BloomBitsPerKey)
+
 	// --- WAL + store ---
-	journal, err := wal.New(cfg.Storage.WALDir)
+	journal, err := wal.New(
+		cfg.Storage.WALDir,
+		wal.WithGroupCommit(dbCfg.DB.WAL.MaxBatchSize, dbCfg.DB.WAL.MaxBatchDelay),
+	)
 	if err != nil {
 		fmt.Printf("Failed to init WAL: %v\n", err)
 		os.Exit(1)
 	}
 
-	// ✅ ВАЖНО: дефолтный конфиг стора берём из pkg/config, а не pkg/store
-	dbCfg := pkgcfg.Default()
-	dbCfg.DB.Persistence.RootPath = cfg.Storage.DataDir
-
 	db, err := store.New(&dbCfg, journal)
 	if err != nil {
 		fmt.Printf("Failed to init store: %v\n", err)
@@ -275,6 +280,12 @@ func main() {
 
 	_ = srv.Stop()
 	_ = raftNode.Stop()
+	if err := db.Close(); err != nil {
+		fmt.Printf("Failed to close store: %v\n", err)
+	}
+	if err := journal.Close(); err != nil {
+		fmt.Printf("Failed to close WAL: %v\n", err)
+	}
 	fmt.Println("LSMDB stopped")
 	time.Sleep(200 * time.Millisecond)
 }
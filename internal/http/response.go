@@ -17,7 +17,10 @@ const (
 type Response struct {
 	Status Status `json:"status,omitempty"`
 	Value  string `json:"value,omitempty"`
-	Error  string `json:"error,omitempty"`
+	Type   string `json:"type,omitempty"`
+	// Version is the version of the value write, used by conditional deletes
+	Version uint64 `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
 }
 
 func NewOKResponse() Response {
@@ -32,6 +35,10 @@ func NewValueResponse(value string) Response {
 	return Response{Status: StatusSuccess, Value: value}
 }
 
+func NewTypedValueResponse(valueType, value string) Response {
+	return Response{Status: StatusSuccess, Value: value, Type: valueType}
+}
+
 func NewErrorResponse(err string) Response {
 	return Response{Status: StatusError, Error: err}
 }
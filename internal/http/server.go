@@ -3,6 +3,7 @@ package http
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"lsmdb/pkg/raftadapter"
@@ -10,6 +11,7 @@ import (
 	"lsmdb/pkg/cluster"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -24,6 +26,9 @@ const (
 
 type iStoreAPI interface {
 	GetString(key string) (string, bool, error)
+	// GetWithVersion returns a typed value accepted by store.FormatValue
+	// and the version of its write
+	GetWithVersion(key string) (any, uint64, bool, error)
 }
 
 type iRaftNode interface {
@@ -102,6 +107,9 @@ func (s *Server) createRouter() http.Handler {
 	r.Get("/metrics", s.handleMetrics)
 	r.Put("/api/string", s.handlePut)
 	r.Get("/api/string", s.handleGet)
+	r.Put("/api/value", s.handlePutValue)
+	r.Get("/api/value", s.handleGetValue)
+	r.Post("/api/increment", s.handleIncrement)
 	r.Delete("/api", s.handleDelete)
 	r.Post("/api/internal/raft", s.handleRaft)
 
@@ -200,7 +208,11 @@ func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cmd := raftadapter.NewCmd(store.InsertOp, []byte(key), []byte(value))
+	cmd, err := withTTL(raftadapter.NewCmd(store.InsertOp, []byte(key), []byte(value)), r)
+	if err != nil {
+		s.writeJSON(w, http.StatusBadRequest, NewErrorResponse(err.Error()))
+		return
+	}
 	if err := s.node.Execute(r.Context(), cmd); err != nil {
 		s.writeJSON(w, http.StatusInternalServerError, NewErrorResponse(err.Error()))
 		return
@@ -250,6 +262,171 @@ func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 }
 
 
+// withTTL applies the optional "ttl" form parameter, a duration like "30s"
+func withTTL(cmd raftadapter.Cmd, r *http.Request) (raftadapter.Cmd, error) {
+	raw := r.FormValue("ttl")
+	if raw == "" {
+		return cmd, nil
+	}
+
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl <= 0 {
+		return cmd, fmt.Errorf("invalid ttl %q", raw)
+	}
+	return cmd.WithTTL(ttl), nil
+}
+
+// withPutCondition applies the optional "if_absent" and "if_value" form parameters,
+// if_value holds the expected current value in the text form of the command type
+func withPutCondition(cmd raftadapter.Cmd, r *http.Request) (raftadapter.Cmd, error) {
+	ifAbsent := r.FormValue("if_absent") == "true"
+	_, ifValue := r.Form["if_value"]
+
+	switch {
+	case ifAbsent && ifValue:
+		return cmd, fmt.Errorf("if_absent and if_value are exclusive")
+	case ifAbsent:
+		return cmd.IfAbsent(), nil
+	case ifValue:
+		return cmd.IfEqual(r.FormValue("if_value")), nil
+	default:
+		return cmd, nil
+	}
+}
+
+// executeErrorStatus maps failed conditions to 409 for an existing key
+// and 412 for a mismatching value or version
+func executeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, store.ErrKeyExists):
+		return http.StatusConflict
+	case errors.Is(err, store.ErrConditionFailed):
+		return http.StatusPreconditionFailed
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handlePutValue stores a value of the type given by the "type" parameter,
+// the value is passed in the text form understood by store.ParseValue
+func (s *Server) handlePutValue(w http.ResponseWriter, r *http.Request) {
+	if redirected, err := s.redirectLeader(w, r); redirected || err != nil {
+		if err != nil {
+			slog.Error("Failed to redirect to leader", "error", err)
+		}
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		s.writeJSON(w, http.StatusBadRequest, NewErrorResponse("Failed to parse form"))
+		return
+	}
+
+	key := r.FormValue("key")
+	value := r.FormValue("value")
+	valueType := r.FormValue("type")
+
+	if key == "" || value == "" {
+		s.writeJSON(w, http.StatusBadRequest, NewErrorResponse("Missing key or value"))
+		return
+	}
+	if _, err := store.ParseValue(valueType, value); err != nil {
+		s.writeJSON(w, http.StatusBadRequest, NewErrorResponse(err.Error()))
+		return
+	}
+
+	cmd, err := withTTL(raftadapter.NewTypedCmd([]byte(key), valueType, value), r)
+	if err == nil {
+		cmd, err = withPutCondition(cmd, r)
+	}
+	if err != nil {
+		s.writeJSON(w, http.StatusBadRequest, NewErrorResponse(err.Error()))
+		return
+	}
+	if err := s.node.Execute(r.Context(), cmd); err != nil {
+		s.writeJSON(w, executeErrorStatus(err), NewErrorResponse(err.Error()))
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, NewSuccessResponse())
+}
+
+// handleIncrement adds "delta", 1 by default, to the int64 counter stored under the key,
+// the replicas add it with the merge operator so concurrent increments never race
+func (s *Server) handleIncrement(w http.ResponseWriter, r *http.Request) {
+	if redirected, err := s.redirectLeader(w, r); redirected || err != nil {
+		if err != nil {
+			slog.Error("Failed to redirect to leader", "error", err)
+		}
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		s.writeJSON(w, http.StatusBadRequest, NewErrorResponse("Failed to parse form"))
+		return
+	}
+
+	key := r.FormValue("key")
+	delta := r.FormValue("delta")
+	if key == "" {
+		s.writeJSON(w, http.StatusBadRequest, NewErrorResponse("Missing key"))
+		return
+	}
+	if delta == "" {
+		delta = "1"
+	}
+	if _, err := store.ParseValue("int64", delta); err != nil {
+		s.writeJSON(w, http.StatusBadRequest, NewErrorResponse(err.Error()))
+		return
+	}
+
+	cmd := raftadapter.NewMergeCmd([]byte(key), "int64", delta)
+	if err := s.node.Execute(r.Context(), cmd); err != nil {
+		s.writeJSON(w, executeErrorStatus(err), NewErrorResponse(err.Error()))
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, NewSuccessResponse())
+}
+
+// handleGetValue returns a value of any type together with its type name,
+// typed reads are served only by replicas of the key
+func (s *Server) handleGetValue(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		s.writeJSON(w, http.StatusBadRequest, NewErrorResponse("Missing key"))
+		return
+	}
+
+	if s.store == nil {
+		s.writeJSON(w, http.StatusInternalServerError, NewErrorResponse("store is not configured"))
+		return
+	}
+	if s.router != nil && !s.router.IsLocalReplica(key) {
+		s.writeJSON(w, http.StatusMisdirectedRequest, NewErrorResponse("Key is not stored on this node"))
+		return
+	}
+
+	value, version, found, err := s.store.GetWithVersion(key)
+	if err != nil {
+		s.writeJSON(w, http.StatusInternalServerError, NewErrorResponse(err.Error()))
+		return
+	}
+	if !found {
+		s.writeJSON(w, http.StatusNotFound, NewErrorResponse("Key not found"))
+		return
+	}
+
+	valueType, text, err := store.FormatValue(value)
+	if err != nil {
+		s.writeJSON(w, http.StatusInternalServerError, NewErrorResponse(err.Error()))
+		return
+	}
+	resp := NewTypedValueResponse(valueType, text)
+	resp.Version = version
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	if redirected, err := s.redirectLeader(w, r); redirected || err != nil {
 		if err != nil {
@@ -265,8 +442,16 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	cmd := raftadapter.NewCmd(store.DeleteOp, []byte(key), nil)
+	if raw := r.URL.Query().Get("if_version"); raw != "" {
+		version, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			s.writeJSON(w, http.StatusBadRequest, NewErrorResponse(fmt.Sprintf("invalid if_version %q", raw)))
+			return
+		}
+		cmd = cmd.IfVersion(version)
+	}
 	if err := s.node.Execute(r.Context(), cmd); err != nil {
-		s.writeJSON(w, http.StatusInternalServerError, NewErrorResponse(err.Error()))
+		s.writeJSON(w, executeErrorStatus(err), NewErrorResponse(err.Error()))
 		return
 	}
 
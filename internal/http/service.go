@@ -118,23 +118,14 @@ func (s *KVService) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResp
 
 // Batch processes multiple operations atomically
 func (s *KVService) Batch(ctx context.Context, req *BatchRequest) (*BatchResponse, error) {
-	// Process operations in order
+	// Collect operations in order, nothing is applied unless all of them are valid
+	batch := store.NewWriteBatch()
 	for _, op := range req.Operations {
 		switch op.Type {
 		case "put":
-			if err := s.store.PutString(op.Key, op.Value); err != nil {
-				return &BatchResponse{
-					Success: false,
-					Error:   fmt.Sprintf("failed to put %s: %v", op.Key, err),
-				}, nil
-			}
+			batch.PutString(op.Key, op.Value)
 		case "delete":
-			if err := s.store.Delete(op.Key); err != nil {
-				return &BatchResponse{
-					Success: false,
-					Error:   fmt.Sprintf("failed to delete %s: %v", op.Key, err),
-				}, nil
-			}
+			batch.Delete(op.Key)
 		default:
 			return &BatchResponse{
 				Success: false,
@@ -143,6 +134,13 @@ func (s *KVService) Batch(ctx context.Context, req *BatchRequest) (*BatchRespons
 		}
 	}
 
+	if err := s.store.Write(batch); err != nil {
+		return &BatchResponse{
+			Success: false,
+			Error:   fmt.Sprintf("failed to write batch: %v", err),
+		}, nil
+	}
+
 	return &BatchResponse{
 		Success: true,
 	}, nil
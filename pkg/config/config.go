@@ -41,33 +41,92 @@ type ServerConfig struct {
 
 type DB struct {
 	Memtable    MemtableConfig    `yaml:"memtable" validate:"required"`
+	WAL         WALConfig         `yaml:"wal"`
+	WriteStall  WriteStallConfig  `yaml:"write_stall"`
+	ValueLog    ValueLogConfig    `yaml:"value_log"`
 	Persistence PersistenceConfig `yaml:"persistence" validate:"required"`
 }
 
+type WALConfig struct {
+	// MaxBatchSize limits the number of entries committed with a single fsync
+	MaxBatchSize int `yaml:"max_batch_size" validate:"min=0"`
+	// MaxBatchDelay is how long the writer waits for more entries before fsync
+	MaxBatchDelay time.Duration `yaml:"max_batch_delay" validate:"min=0"`
+}
+
 type MemtableConfig struct {
 	FlushThresholdBytes int `yaml:"flush_threshold" validate:"required,min=1"`
 	FlushChanBuffSize   int `yaml:"flush_chan_buff_size" validate:"required,min=1"`
 	MaxImmTables        int `yaml:"max_imm_tables" validate:"min=0"`
 }
 
+// WriteStallConfig sets when writers are slowed down and stopped
+// to let flushes and compactions catch up, zero disables a threshold
+type WriteStallConfig struct {
+	// SlowdownImmTables is the number of immutable memtables waiting for flush
+	// that slows writers down, they stop at Memtable.MaxImmTables
+	SlowdownImmTables int `yaml:"slowdown_imm_tables" validate:"min=0"`
+	// SlowdownL0Tables is the number of L0 tables that slows writers down
+	SlowdownL0Tables int `yaml:"slowdown_l0_tables" validate:"min=0"`
+	// StopL0Tables is the number of L0 tables that stops writers
+	StopL0Tables int `yaml:"stop_l0_tables" validate:"min=0"`
+	// SlowdownDelay is the pause of every write while slowed down
+	SlowdownDelay time.Duration `yaml:"slowdown_delay" validate:"min=0"`
+}
+
+// ValueLogConfig sets which values are kept out of SSTables in the value log
+// and how the space of overwritten values is reclaimed
+type ValueLogConfig struct {
+	// ValueThreshold is the smallest value size moved to the value log on write,
+	// zero keeps every value in the tree. Larger values are not limited by the
+	// memtable flush threshold, so it is set below it.
+	ValueThreshold int `yaml:"value_threshold" validate:"min=0"`
+	// MaxSegmentSize is the size of a value log file after which a new one is started
+	MaxSegmentSize int64 `yaml:"max_segment_size" validate:"min=0"`
+	// GCInterval is the period of value log garbage collection, zero disables it
+	GCInterval time.Duration `yaml:"gc_interval" validate:"min=0"`
+	// GCDiscardRatio is the share of overwritten data making a file worth collecting
+	GCDiscardRatio float64 `yaml:"gc_discard_ratio" validate:"gte=0,lte=1"`
+}
+
 type PersistenceConfig struct {
 	RootPath    string            `yaml:"path" validate:"required,dir"`
 	SSTable     SSTableConfig     `yaml:"sstable" validate:"required"`
 	Cache       CacheConfig       `yaml:"cache" validate:"required"`
 	BloomFilter BloomFilterConfig `yaml:"bloom_filter" validate:"required"`
+	// MaxOpenTables limits open SSTable files, zero keeps every table open
+	MaxOpenTables int `yaml:"max_open_tables" validate:"min=0"`
 }
 
 type SSTableConfig struct {
 	SizeMultiplier   int `yaml:"size_multiplier" validate:"required,min=1"`
 	CompactThreshold int `yaml:"compact_threshold" validate:"required,min=1"`
+	TargetTableSize  int `yaml:"target_table_size" validate:"min=0"`
+	BlockSize        int `yaml:"block_size" validate:"min=0"`
 }
 
+// CacheConfig sizes the block cache shared by all tables
 type CacheConfig struct {
-	Capacity int `yaml:"capacity" validate:"required,min=1"`
+	// CapacityBytes is the total size of cached blocks
+	CapacityBytes int64 `yaml:"capacity_bytes" validate:"required,min=1"`
+	// Shards is the number of independently locked parts of the cache
+	Shards int `yaml:"shards" validate:"min=0"`
 }
 
 type BloomFilterConfig struct {
-	FPRate float64 `yaml:"fp_rate" validate:"required,gt=0,lt=1"`
+	// BitsPerKey sets the filter density, zero derives it from FPRate
+	BitsPerKey int     `yaml:"bits_per_key" validate:"min=0"`
+	FPRate     float64 `yaml:"fp_rate" validate:"required,gt=0,lt=1"`
+	// Prefix builds a second filter over key prefixes used by prefix scans
+	Prefix PrefixExtractorConfig `yaml:"prefix"`
+}
+
+// PrefixExtractorConfig selects how key prefixes are extracted, Length takes precedence
+type PrefixExtractorConfig struct {
+	// Length extracts the first Length bytes of a key
+	Length int `yaml:"length" validate:"min=0"`
+	// Delimiter extracts a key up to and including the first delimiter
+	Delimiter string `yaml:"delimiter"`
 }
 
 type LoggerConfig struct {
@@ -91,18 +150,38 @@ func Default() Config {
 				FlushChanBuffSize:   3,
 				MaxImmTables:        3,
 			},
+			WAL: WALConfig{
+				MaxBatchSize:  128,
+				MaxBatchDelay: 0,
+			},
+			WriteStall: WriteStallConfig{
+				SlowdownImmTables: 2,
+				SlowdownL0Tables:  8,
+				StopL0Tables:      12,
+				SlowdownDelay:     time.Millisecond,
+			},
+			ValueLog: ValueLogConfig{
+				ValueThreshold: 512,
+				MaxSegmentSize: 64 * 1024 * 1024,
+				GCInterval:     time.Minute,
+				GCDiscardRatio: 0.5,
+			},
 			Persistence: PersistenceConfig{
 				RootPath: "./data",
 				SSTable: SSTableConfig{
 					SizeMultiplier:   10,
 					CompactThreshold: 4,
+					TargetTableSize:  2 * 1024 * 1024,
+					BlockSize:        4096,
 				},
 				Cache: CacheConfig{
-					Capacity: 100,
+					CapacityBytes: 8 * 1024 * 1024,
+					Shards:        16,
 				},
 				BloomFilter: BloomFilterConfig{
 					FPRate: 0.01,
 				},
+				MaxOpenTables: 512,
 			},
 		},
 	}
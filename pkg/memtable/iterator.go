@@ -0,0 +1,92 @@
+package memtable
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Iterator iterates over a point-in-time copy of a single ordered map
+type Iterator struct {
+	items []Item
+	pos   int
+}
+
+func newIterator(set *concurrentSet) *Iterator {
+	items := (&sortedSet{set}).Sorted()
+	return &Iterator{
+		items: items,
+		pos:   len(items),
+	}
+}
+
+// Iterators returns iterators over the active table and all
+// immutable tables ordered from newest to oldest
+func (mt *Memtable) Iterators() []*Iterator {
+	iters := []*Iterator{newIterator(mt.underlying.Load())}
+
+	immutable := mt.imm.Load()
+	if immutable == nil {
+		return iters
+	}
+	for i := len(*immutable) - 1; i >= 0; i-- {
+		iters = append(iters, newIterator((*immutable)[i]))
+	}
+
+	return iters
+}
+
+// First moves to the first item
+func (it *Iterator) First() {
+	it.pos = 0
+}
+
+// Seek moves to the first item with key greater than or equal to key
+func (it *Iterator) Seek(key []byte) {
+	it.pos = sort.Search(len(it.items), func(i int) bool {
+		return bytes.Compare(it.items[i].Key, key) >= 0
+	})
+}
+
+// Next moves to the next item
+func (it *Iterator) Next() {
+	if it.pos < len(it.items) {
+		it.pos++
+	}
+}
+
+// Valid checks if the iterator is positioned on an item
+func (it *Iterator) Valid() bool {
+	return it.pos < len(it.items)
+}
+
+// Key returns the current key
+func (it *Iterator) Key() []byte {
+	return it.items[it.pos].Key
+}
+
+// Value returns the current value
+func (it *Iterator) Value() []byte {
+	return it.items[it.pos].Value
+}
+
+// SeqN returns the sequence number of the current item
+func (it *Iterator) SeqN() uint64 {
+	return it.items[it.pos].SeqN
+}
+
+// Meta returns the current metadata
+func (it *Iterator) Meta() uint64 {
+	return it.items[it.pos].Meta
+}
+
+// Error always returns nil since the data is already in memory
+func (it *Iterator) Error() error {
+	return nil
+}
+
+// Close releases the copied items
+func (it *Iterator) Close() error {
+	it.items = nil
+	it.pos = 0
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"lsmdb/pkg/config"
+	"math"
 	"sync"
 	"sync/atomic"
 
@@ -12,9 +13,15 @@ import (
 
 var (
 	ErrTooLargeEntry = errors.New("entry is too large")
+	ErrClosed        = errors.New("memtable is closed")
 )
 
-type concurrentSet = skipmap.FuncMap[[]byte, Item]
+// noLog is the journal segment of a table without entries
+const noLog = math.MaxUint64
+
+// concurrentSet maps a key to all its versions, so readers
+// pinned at an older sequence number still find their data
+type concurrentSet = skipmap.FuncMap[[]byte, *versions]
 
 type Memtable struct {
 	cfg  *config.MemtableConfig
@@ -23,33 +30,65 @@ type Memtable struct {
 
 	underlying atomic.Pointer[concurrentSet]
 	// old immutable tables
-	// the only data origin when rotation is applied
+	// the only data origin when rotation is applied,
+	// a table is kept until the flusher releases it
 	imm atomic.Pointer[[]*concurrentSet]
+	// maxImm is the number of immutable tables stopping rotations
+	maxImm int
+
+	// insertMu is held for reading by inserts and for writing by seal,
+	// so a table handed over to the flusher gets no more entries
+	insertMu sync.RWMutex
+	// activeLog is the oldest journal segment holding entries of the active table
+	activeLog atomic.Uint64
+	// immLogs holds the oldest journal segment of every immutable table, guarded by mu
+	immLogs map[*concurrentSet]uint64
 
 	flushChan chan SortedSet
 	mu        sync.Mutex
 	cond      *sync.Cond
+	closed    bool
+
+	// onRotate is called under mu when the active table becomes immutable
+	onRotate func()
 }
 
 func New(cfg config.MemtableConfig) *Memtable {
+	maxImm := max(cfg.MaxImmTables, 1)
 	mt := Memtable{
-		cfg:       &cfg,
-		flushChan: make(chan SortedSet, cfg.FlushChanBuffSize),
+		cfg:     &cfg,
+		maxImm:  maxImm,
+		immLogs: make(map[*concurrentSet]uint64),
+		// every immutable table fits the channel, so rotation never blocks on it
+		flushChan: make(chan SortedSet, max(cfg.FlushChanBuffSize, maxImm)),
 	}
 	mt.underlying.Store(
-		skipmap.NewFunc[[]byte, Item](func(a, b []byte) bool {
+		skipmap.NewFunc[[]byte, *versions](func(a, b []byte) bool {
 			return bytes.Compare(a, b) < 0
 		}),
 	)
+	mt.activeLog.Store(noLog)
 	mt.cond = sync.NewCond(&mt.mu)
 
 	return &mt
 }
 
+// OnRotate registers a hook called on every rotation of the active table
+func (mt *Memtable) OnRotate(fn func()) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.onRotate = fn
+}
+
+// Get returns the newest version of the key
 func (mt *Memtable) Get(k []byte) (Item, bool) {
+	return mt.GetAt(k, math.MaxUint64)
+}
+
+// GetAt returns the newest version of the key with sequence number not greater than seqN
+func (mt *Memtable) GetAt(k []byte, seqN uint64) (Item, bool) {
 	active := mt.underlying.Load()
-	it, ok := active.Load(k)
-	if ok {
+	if it, ok := load(active, k, seqN); ok {
 		return it, true
 	}
 
@@ -58,9 +97,9 @@ func (mt *Memtable) Get(k []byte) (Item, bool) {
 		return Item{}, false
 	}
 
-	for _, ordMap := range *immutable {
-		it, ok = ordMap.Load(k)
-		if ok {
+	// newer immutable tables are at the end
+	for i := len(*immutable) - 1; i >= 0; i-- {
+		if it, ok := load((*immutable)[i], k, seqN); ok {
 			return it, true
 		}
 	}
@@ -68,21 +107,42 @@ func (mt *Memtable) Get(k []byte) (Item, bool) {
 	return Item{}, false
 }
 
-func (mt *Memtable) Upsert(k, value []byte, seqN, meta uint64) error {
+func load(set *concurrentSet, k []byte, seqN uint64) (Item, bool) {
+	vers, ok := set.Load(k)
+	if !ok {
+		return Item{}, false
+	}
+	return vers.at(seqN)
+}
+
+// entrySize returns the number of bytes an entry takes from the table threshold
+func entrySize(k, value []byte) uint64 {
 	const (
 		mdSize   = 8
 		seqNSize = 8
 	)
+	return uint64(len(k)) + uint64(len(value)) + seqNSize + mdSize
+}
+
+// CheckSize returns ErrTooLargeEntry for an entry Upsert would reject for its size
+func (mt *Memtable) CheckSize(k, value []byte) error {
+	if entrySize(k, value) > uint64(mt.cfg.FlushThresholdBytes) {
+		return ErrTooLargeEntry
+	}
+	return nil
+}
+
+// Upsert inserts a version of the key written to the journal segment logNum or a later one
+func (mt *Memtable) Upsert(k, value []byte, seqN, meta, logNum uint64) error {
+	if err := mt.CheckSize(k, value); err != nil {
+		return err
+	}
 
 	var (
-		entSize   = uint64(len(k)) + uint64(len(value)) + seqNSize + mdSize
+		entSize   = entrySize(k, value)
 		threshold = uint64(mt.cfg.FlushThresholdBytes)
 	)
 
-	if entSize > threshold {
-		return ErrTooLargeEntry
-	}
-
 	for {
 		currentSize := mt.size.Load()
 		newSize := currentSize + entSize
@@ -96,21 +156,38 @@ func (mt *Memtable) Upsert(k, value []byte, seqN, meta uint64) error {
 
 		ver := mt.ver.Load()
 		mt.mu.Lock()
-		acquired := mt.ver.CompareAndSwap(ver, ver+1)
-		if acquired {
-			mt.rotate(entSize)
-			mt.cond.Broadcast()
-			mt.mu.Unlock()
-			break
-		} else {
+		// writers stall while immutable tables wait for flush
+		for mt.ver.Load() == ver && !mt.closed && mt.ImmCount() >= mt.maxImm {
 			mt.cond.Wait()
+		}
+		if mt.closed {
 			mt.mu.Unlock()
+			return ErrClosed
 		}
-
+		if mt.ver.Load() != ver {
+			// another writer rotated the table, retry with the new one
+			mt.mu.Unlock()
+			continue
+		}
+		mt.ver.Add(1)
+		mt.rotate(entSize)
+		mt.cond.Broadcast()
+		mt.mu.Unlock()
+		break
 	}
 
+	mt.insertMu.RLock()
+	defer mt.insertMu.RUnlock()
+
+	for {
+		current := mt.activeLog.Load()
+		if current <= logNum || mt.activeLog.CompareAndSwap(current, logNum) {
+			break
+		}
+	}
 	active := mt.underlying.Load()
-	active.Store(k, Item{
+	vers, _ := active.LoadOrStore(k, &versions{})
+	vers.add(Item{
 		Key:   k,
 		Value: value,
 		SeqN:  seqN,
@@ -120,9 +197,36 @@ func (mt *Memtable) Upsert(k, value []byte, seqN, meta uint64) error {
 	return nil
 }
 
+// LogNum returns the oldest journal segment holding entries of tables
+// not released yet, noLog if every table is empty
+func (mt *Memtable) LogNum() uint64 {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	logNum := mt.activeLog.Load()
+	for _, immLog := range mt.immLogs {
+		logNum = min(logNum, immLog)
+	}
+	return logNum
+}
+
 func (mt *Memtable) rotate(initSize uint64) {
-	current := mt.underlying.Load()
+	current := mt.seal()
 	mt.flushChan <- &sortedSet{current}
+	mt.size.Store(initSize)
+}
+
+// seal makes the active table immutable and starts a new one, it must be called under mu
+func (mt *Memtable) seal() *concurrentSet {
+	if mt.onRotate != nil {
+		mt.onRotate()
+	}
+
+	mt.insertMu.Lock()
+	defer mt.insertMu.Unlock()
+
+	current := mt.underlying.Load()
+	mt.immLogs[current] = mt.activeLog.Swap(noLog)
 
 	oldSlicePtr := mt.imm.Load()
 	var newSlice []*concurrentSet
@@ -130,24 +234,77 @@ func (mt *Memtable) rotate(initSize uint64) {
 		newSlice = append([]*concurrentSet{}, *oldSlicePtr...)
 	}
 	newSlice = append(newSlice, current)
-	if len(newSlice) > mt.cfg.MaxImmTables {
-		// drop the oldest immutable table
-		newSlice = newSlice[1:]
-	}
 	mt.imm.Store(&newSlice)
 
 	mt.underlying.Store(
-		skipmap.NewFunc[[]byte, Item](func(a, b []byte) bool {
+		skipmap.NewFunc[[]byte, *versions](func(a, b []byte) bool {
 			return bytes.Compare(a, b) < 0
 		}),
 	)
-	mt.size.Store(initSize)
+	mt.size.Store(0)
+	return current
+}
+
+// Release drops the immutable table once the flusher has persisted it
+// and wakes up writers stalled on rotation
+func (mt *Memtable) Release(ss SortedSet) {
+	set, ok := ss.(*sortedSet)
+	if !ok {
+		return
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	oldSlicePtr := mt.imm.Load()
+	if oldSlicePtr == nil {
+		return
+	}
+	delete(mt.immLogs, set.concurrentSet)
+	newSlice := make([]*concurrentSet, 0, len(*oldSlicePtr))
+	for _, table := range *oldSlicePtr {
+		if table != set.concurrentSet {
+			newSlice = append(newSlice, table)
+		}
+	}
+	mt.imm.Store(&newSlice)
+	mt.cond.Broadcast()
+}
+
+// ImmCount returns the number of immutable tables waiting for flush
+func (mt *Memtable) ImmCount() int {
+	immutable := mt.imm.Load()
+	if immutable == nil {
+		return 0
+	}
+	return len(*immutable)
 }
 
 func (mt *Memtable) FlushChan() <-chan SortedSet {
 	return mt.flushChan
 }
 
-func (mt *Memtable) Close() {
+// Close seals the active table and stops rotations. It returns every
+// table not released yet, oldest first, so they can be flushed on shutdown.
+func (mt *Memtable) Close() []SortedSet {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if mt.closed {
+		return nil
+	}
+	if mt.underlying.Load().Len() > 0 {
+		mt.seal()
+	}
+	mt.closed = true
+	mt.cond.Broadcast()
 	close(mt.flushChan)
+
+	var tables []SortedSet
+	if immutable := mt.imm.Load(); immutable != nil {
+		for _, table := range *immutable {
+			tables = append(tables, &sortedSet{table})
+		}
+	}
+	return tables
 }
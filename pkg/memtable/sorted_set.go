@@ -8,10 +8,11 @@ type SortedSet interface {
 	Sorted() []Item
 }
 
+// Sorted returns every version ordered by key, newer versions of a key first
 func (s *sortedSet) Sorted() []Item {
 	result := make([]Item, 0, s.Len())
-	s.Range(func(key []byte, value Item) bool {
-		result = append(result, value)
+	s.Range(func(key []byte, vers *versions) bool {
+		result = append(result, vers.all()...)
 		return true
 	})
 
@@ -0,0 +1,51 @@
+package memtable
+
+import (
+	"sort"
+	"sync"
+)
+
+// versions holds every version of a key ordered from newest to oldest
+type versions struct {
+	mu    sync.RWMutex
+	items []Item
+}
+
+// add inserts the item keeping versions ordered by sequence number
+func (v *versions) add(item Item) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	i := sort.Search(len(v.items), func(i int) bool {
+		return v.items[i].SeqN <= item.SeqN
+	})
+	if i < len(v.items) && v.items[i].SeqN == item.SeqN {
+		v.items[i] = item
+		return
+	}
+
+	v.items = append(v.items, Item{})
+	copy(v.items[i+1:], v.items[i:])
+	v.items[i] = item
+}
+
+// at returns the newest version with sequence number not greater than seqN
+func (v *versions) at(seqN uint64) (Item, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	i := sort.Search(len(v.items), func(i int) bool {
+		return v.items[i].SeqN <= seqN
+	})
+	if i == len(v.items) {
+		return Item{}, false
+	}
+	return v.items[i], true
+}
+
+// all returns a copy of every version
+func (v *versions) all() []Item {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return append([]Item{}, v.items...)
+}
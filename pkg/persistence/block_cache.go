@@ -1,134 +1,152 @@
 package persistence
 
 import (
+	"container/list"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
-// BlockCacheImpl implements a simple LRU block cache
-type BlockCacheImpl struct {
-	mu       sync.RWMutex
-	capacity int
-	items    map[string]*cacheItem
-	head     *cacheItem
-	tail     *cacheItem
-}
+// defaultCacheShards is used when CacheConfig.Shards is not set
+const defaultCacheShards = 16
 
-type cacheItem struct {
-	key      string
-	value    []byte
-	lastUsed time.Time
-	prev     *cacheItem
-	next     *cacheItem
+// BlockKey identifies a data block by the table and its offset in the file
+type BlockKey struct {
+	TableID uint64
+	Offset  int64
 }
 
-// NewBlockCache creates a new block cache
-func NewBlockCache(capacity int) BlockCache {
-	return &BlockCacheImpl{
-		capacity: capacity,
-		items:    make(map[string]*cacheItem),
-	}
+// hash spreads keys of neighbouring blocks over shards
+func (k BlockKey) hash() uint64 {
+	h := k.TableID*0x9e3779b97f4a7c15 ^ uint64(k.Offset)
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h
 }
 
-// Get retrieves a value from the cache
-func (bc *BlockCacheImpl) Get(key string) ([]byte, bool) {
-	bc.mu.Lock()
-	defer bc.mu.Unlock()
-
-	item, found := bc.items[key]
-	if !found {
-		return nil, false
-	}
-
-	// Update last used time and move to head
-	item.lastUsed = time.Now()
-	bc.moveToHead(item)
-
-	return item.value, true
+// CacheStats holds block cache counters
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Size is the number of bytes held by cached blocks
+	Size     int64
+	Capacity int64
 }
 
-// Set stores a value in the cache
-func (bc *BlockCacheImpl) Set(key string, value []byte) {
-	bc.mu.Lock()
-	defer bc.mu.Unlock()
-
-	// Check if item already exists
-	if item, found := bc.items[key]; found {
-		item.value = value
-		item.lastUsed = time.Now()
-		bc.moveToHead(item)
-		return
-	}
-
-	// Create new item
-	item := &cacheItem{
-		key:      key,
-		value:    value,
-		lastUsed: time.Now(),
-	}
+// BlockCacheImpl is an LRU cache of raw data blocks bounded in bytes.
+// Keys are spread over shards with separate locks, every shard evicts
+// its least recently used blocks once it holds over its part of capacity.
+type BlockCacheImpl struct {
+	shards   []cacheShard
+	capacity int64
 
-	// Add to head
-	bc.addToHead(item)
-	bc.items[key] = item
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
 
-	// Evict if over capacity
-	if len(bc.items) > bc.capacity {
-		bc.evictLRU()
-	}
+type cacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	items    map[BlockKey]*list.Element
+	// lru holds *cacheItem, the most recently used at the front
+	lru *list.List
 }
 
-// moveToHead moves an item to the head of the list
-func (bc *BlockCacheImpl) moveToHead(item *cacheItem) {
-	if item == bc.head {
-		return
-	}
+type cacheItem struct {
+	key   BlockKey
+	value []byte
+}
 
-	// Remove from current position
-	if item.prev != nil {
-		item.prev.next = item.next
+// NewBlockCache creates a block cache holding up to capacity bytes in the given number of shards
+func NewBlockCache(capacity int64, shards int) BlockCache {
+	if shards <= 0 {
+		shards = defaultCacheShards
 	}
-	if item.next != nil {
-		item.next.prev = item.prev
+	bc := &BlockCacheImpl{
+		shards:   make([]cacheShard, shards),
+		capacity: capacity,
 	}
-	if item == bc.tail {
-		bc.tail = item.prev
+	for i := range bc.shards {
+		bc.shards[i] = cacheShard{
+			capacity: (capacity + int64(shards) - 1) / int64(shards),
+			items:    make(map[BlockKey]*list.Element),
+			lru:      list.New(),
+		}
 	}
-
-	// Add to head
-	bc.addToHead(item)
+	return bc
 }
 
-// addToHead adds an item to the head of the list
-func (bc *BlockCacheImpl) addToHead(item *cacheItem) {
-	item.prev = nil
-	item.next = bc.head
+func (bc *BlockCacheImpl) shard(key BlockKey) *cacheShard {
+	return &bc.shards[key.hash()%uint64(len(bc.shards))]
+}
 
-	if bc.head != nil {
-		bc.head.prev = item
+// Get retrieves a block from the cache
+func (bc *BlockCacheImpl) Get(key BlockKey) ([]byte, bool) {
+	s := bc.shard(key)
+	s.mu.Lock()
+	var value []byte
+	elem, found := s.items[key]
+	if found {
+		s.lru.MoveToFront(elem)
+		// Set replaces the value of the item under the lock
+		value = elem.Value.(*cacheItem).value
 	}
+	s.mu.Unlock()
 
-	bc.head = item
-
-	if bc.tail == nil {
-		bc.tail = item
+	if !found {
+		bc.misses.Add(1)
+		return nil, false
 	}
+	bc.hits.Add(1)
+	return value, true
 }
 
-// evictLRU removes the least recently used item
-func (bc *BlockCacheImpl) evictLRU() {
-	if bc.tail == nil {
+// Set stores a block in the cache, blocks larger than a shard are not cached
+func (bc *BlockCacheImpl) Set(key BlockKey, value []byte) {
+	s := bc.shard(key)
+	charge := int64(len(value))
+	if charge > s.capacity {
 		return
 	}
 
-	// Remove from map
-	delete(bc.items, bc.tail.key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Remove from list
-	if bc.tail.prev != nil {
-		bc.tail.prev.next = nil
+	if elem, found := s.items[key]; found {
+		item := elem.Value.(*cacheItem)
+		s.size += charge - int64(len(item.value))
+		item.value = value
+		s.lru.MoveToFront(elem)
 	} else {
-		bc.head = nil
+		s.items[key] = s.lru.PushFront(&cacheItem{key: key, value: value})
+		s.size += charge
 	}
 
-	bc.tail = bc.tail.prev
+	for s.size > s.capacity {
+		oldest := s.lru.Back()
+		item := s.lru.Remove(oldest).(*cacheItem)
+		delete(s.items, item.key)
+		s.size -= int64(len(item.value))
+		bc.evictions.Add(1)
+	}
+}
+
+// Stats returns the cache counters
+func (bc *BlockCacheImpl) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:      bc.hits.Load(),
+		Misses:    bc.misses.Load(),
+		Evictions: bc.evictions.Load(),
+		Capacity:  bc.capacity,
+	}
+	for i := range bc.shards {
+		s := &bc.shards[i]
+		s.mu.Lock()
+		stats.Size += s.size
+		s.mu.Unlock()
+	}
+	return stats
 }
@@ -0,0 +1,78 @@
+package persistence
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestBlockCache_EvictsByBytes(t *testing.T) {
+	cache := NewBlockCache(300, 1)
+	block := bytes.Repeat([]byte{1}, 100)
+
+	for offset := int64(0); offset < 4; offset++ {
+		cache.Set(BlockKey{TableID: 1, Offset: offset}, block)
+	}
+	// the first block is the least recently used one
+	if _, ok := cache.Get(BlockKey{TableID: 1, Offset: 0}); ok {
+		t.Fatal("expected the oldest block to be evicted")
+	}
+	if _, ok := cache.Get(BlockKey{TableID: 1, Offset: 3}); !ok {
+		t.Fatal("expected the newest block to be cached")
+	}
+	// a block of another table with the same offset is a different key
+	if _, ok := cache.Get(BlockKey{TableID: 2, Offset: 3}); ok {
+		t.Fatal("blocks of different tables must not collide")
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Evictions != 1 || stats.Size != 300 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestBlockCache_KeepsRecentlyUsed(t *testing.T) {
+	cache := NewBlockCache(200, 1)
+	block := bytes.Repeat([]byte{1}, 100)
+
+	cache.Set(BlockKey{TableID: 1}, block)
+	cache.Set(BlockKey{TableID: 2}, block)
+	cache.Get(BlockKey{TableID: 1})
+	cache.Set(BlockKey{TableID: 3}, block)
+
+	if _, ok := cache.Get(BlockKey{TableID: 1}); !ok {
+		t.Fatal("recently read block must survive eviction")
+	}
+	if _, ok := cache.Get(BlockKey{TableID: 2}); ok {
+		t.Fatal("expected the least recently used block to be evicted")
+	}
+
+	// a block larger than the shard is never cached
+	cache.Set(BlockKey{TableID: 4}, bytes.Repeat([]byte{1}, 300))
+	if stats := cache.Stats(); stats.Size != 200 {
+		t.Fatalf("oversized block changed the cache, size %d", stats.Size)
+	}
+}
+
+func TestBlockCache_ConcurrentSetOfSameBlock(t *testing.T) {
+	cache := NewBlockCache(1<<20, 1)
+	key := BlockKey{TableID: 1}
+	cache.Set(key, bytes.Repeat([]byte{1}, 100))
+
+	// readers missing the same block at once store it again while others read it
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if value, ok := cache.Get(key); !ok || len(value) != 100 {
+					t.Error("cached block is lost")
+					return
+				}
+				cache.Set(key, bytes.Repeat([]byte{1}, 100))
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -1,86 +1,163 @@
 package persistence
 
 import (
-	"hash"
-	"hash/fnv"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"lsmdb/pkg/config"
+)
+
+const (
+	// bloomBlockWords is the number of 64-bit words in a block, a block fills one cache line
+	bloomBlockWords = 8
+	bloomBlockBits  = bloomBlockWords * 64
+	// defaultBloomBitsPerKey is used when neither bits per key nor the false positive rate is set
+	defaultBloomBitsPerKey = 10
+	maxBloomHashCount      = 30
 )
 
-// BloomFilterImpl implements a simple bloom filter
+// BloomFilterImpl is a blocked bloom filter. Every key sets all of its bits
+// in one 512-bit block, so a lookup touches a single cache line. Bit positions
+// are derived from one 64-bit hash of the key, rehashed for every bit.
+// It keeps no hashing state, so lookups are safe for concurrent use.
 type BloomFilterImpl struct {
-	bits     []bool
-	size     uint32
-	hashFunc []hash.Hash32
+	words     []uint64
+	numBlocks uint32
+	hashCount int
 }
 
-// NewBloomFilter creates a new bloom filter
-func NewBloomFilter(expectedItems uint32, falsePositiveRate float64) BloomFilter {
-	// Calculate optimal size and hash functions
-	size := calculateOptimalSize(expectedItems, falsePositiveRate)
-	hashCount := calculateHashCount(expectedItems, size)
-
-	hashFuncs := make([]hash.Hash32, hashCount)
-	for i := range hashFuncs {
-		hashFuncs[i] = fnv.New32a()
+// NewBloomFilter creates a filter for the expected number of keys using bitsPerKey bits per key
+func NewBloomFilter(expectedItems uint32, bitsPerKey int) BloomFilter {
+	if bitsPerKey <= 0 {
+		bitsPerKey = defaultBloomBitsPerKey
 	}
+	totalBits := uint64(expectedItems) * uint64(bitsPerKey)
+	numBlocks := (totalBits + bloomBlockBits - 1) / bloomBlockBits
+	if numBlocks == 0 {
+		numBlocks = 1
+	}
+
+	return newBloomFilter(make([]uint64, numBlocks*bloomBlockWords), bloomHashCount(bitsPerKey))
+}
 
+func newBloomFilter(words []uint64, hashCount int) *BloomFilterImpl {
 	return &BloomFilterImpl{
-		bits:     make([]bool, size),
-		size:     size,
-		hashFunc: hashFuncs,
+		words:     words,
+		numBlocks: uint32(len(words) / bloomBlockWords),
+		hashCount: hashCount,
 	}
 }
 
-// Add adds a key to the bloom filter
-func (bf *BloomFilterImpl) Add(key []byte) {
-	for i, h := range bf.hashFunc {
-		h.Reset()
-		h.Write(key)
-		h.Write([]byte{byte(i)}) // Add salt for different hash functions
-		index := h.Sum32() % bf.size
-		bf.bits[index] = true
+// BloomBitsPerKey returns the filter density of the config, bits per key
+// take precedence over the false positive rate they are otherwise derived from
+func BloomBitsPerKey(cfg config.BloomFilterConfig) int {
+	if cfg.BitsPerKey > 0 {
+		return cfg.BitsPerKey
+	}
+	if cfg.FPRate <= 0 || cfg.FPRate >= 1 {
+		return defaultBloomBitsPerKey
 	}
+	// m/n = -ln(p) / ln(2)^2, a block is filled unevenly, so one more bit keeps the rate
+	return int(math.Ceil(-math.Log(cfg.FPRate)/(math.Ln2*math.Ln2))) + 1
 }
 
-// MayContain checks if a key might be in the bloom filter
-func (bf *BloomFilterImpl) MayContain(key []byte) bool {
-	for i, h := range bf.hashFunc {
-		h.Reset()
-		h.Write(key)
-		h.Write([]byte{byte(i)}) // Add salt for different hash functions
-		index := h.Sum32() % bf.size
-		if !bf.bits[index] {
+// bloomHashCount returns the number of bits set per key, k = m/n * ln(2)
+func bloomHashCount(bitsPerKey int) int {
+	k := int(math.Round(float64(bitsPerKey) * math.Ln2))
+	return max(1, min(k, maxBloomHashCount))
+}
+
+// bloomHash is a 64-bit hash of the key, murmur-style mixing of 8-byte words
+func bloomHash(key []byte) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	h := uint64(len(key)) * m
+	for len(key) >= 8 {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> 47
+		k *= m
+		h ^= k
+		h *= m
+		key = key[8:]
+	}
+	if len(key) > 0 {
+		var tail uint64
+		for i := len(key) - 1; i >= 0; i-- {
+			tail = tail<<8 | uint64(key[i])
+		}
+		h ^= tail
+		h *= m
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// probe calls fn with the word index and the mask of every bit of the key
+func (bf *BloomFilterImpl) probe(key []byte, fn func(word int, mask uint64) bool) bool {
+	h := bloomHash(key)
+	// the high half picks the block, the low half the bits inside it
+	block := int((h >> 32) * uint64(bf.numBlocks) >> 32)
+	base := block * bloomBlockWords
+	h1, h2 := uint32(h), bits.RotateLeft32(uint32(h), 15)|1
+	for i := 0; i < bf.hashCount; i++ {
+		bit := (h1 >> 23) % bloomBlockBits
+		if !fn(base+int(bit/64), 1<<(bit%64)) {
 			return false
 		}
+		h1 = h1*0x9e3779b9 + h2
 	}
 	return true
 }
 
-// calculateOptimalSize calculates the optimal size for the bloom filter
-func calculateOptimalSize(expectedItems uint32, falsePositiveRate float64) uint32 {
-	// m = -(n * ln(p)) / (ln(2)^2)
-	// where m = size, n = expected items, p = false positive rate
-	ln2 := 0.6931471805599453
-	lnP := -1.0
-	if falsePositiveRate > 0 {
-		lnP = -1.0 * (float64(expectedItems) * -1.0 * lnP) / (ln2 * ln2)
-	}
-	if lnP < 1 {
-		lnP = 1
+// Encode serializes the filter as hashCount(4) | numBlocks(4) | words
+func (bf *BloomFilterImpl) Encode() []byte {
+	buf := make([]byte, 8+len(bf.words)*8)
+	binary.LittleEndian.PutUint32(buf, uint32(bf.hashCount))
+	binary.LittleEndian.PutUint32(buf[4:], bf.numBlocks)
+	for i, word := range bf.words {
+		binary.LittleEndian.PutUint64(buf[8+i*8:], word)
 	}
-	return uint32(lnP)
+	return buf
 }
 
-// calculateHashCount calculates the optimal number of hash functions
-func calculateHashCount(expectedItems uint32, size uint32) int {
-	// k = (m/n) * ln(2)
-	// where k = hash count, m = size, n = expected items
-	ln2 := 0.6931471805599453
-	k := int((float64(size) / float64(expectedItems)) * ln2)
-	if k < 1 {
-		k = 1
+// DecodeBloomFilter restores a filter serialized by Encode
+func DecodeBloomFilter(data []byte) (BloomFilter, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("bloom filter header is truncated: %w", ErrCorruptedData)
 	}
-	if k > 10 {
-		k = 10
+
+	hashCount := binary.LittleEndian.Uint32(data)
+	numBlocks := binary.LittleEndian.Uint32(data[4:])
+	packed := data[8:]
+	if hashCount == 0 || hashCount > maxBloomHashCount || numBlocks == 0 ||
+		uint64(len(packed)) != uint64(numBlocks)*bloomBlockWords*8 {
+		return nil, fmt.Errorf("bloom filter size mismatch: %w", ErrCorruptedData)
+	}
+
+	words := make([]uint64, numBlocks*bloomBlockWords)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(packed[i*8:])
 	}
-	return k
+	return newBloomFilter(words, int(hashCount)), nil
+}
+
+// Add adds a key to the bloom filter
+func (bf *BloomFilterImpl) Add(key []byte) {
+	bf.probe(key, func(word int, mask uint64) bool {
+		bf.words[word] |= mask
+		return true
+	})
+}
+
+// MayContain checks if a key might be in the bloom filter
+func (bf *BloomFilterImpl) MayContain(key []byte) bool {
+	return bf.probe(key, func(word int, mask uint64) bool {
+		return bf.words[word]&mask != 0
+	})
 }
@@ -0,0 +1,61 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"lsmdb/pkg/config"
+)
+
+func TestBloomFilter_FalsePositiveRate(t *testing.T) {
+	const n = 100000
+
+	for _, cfg := range []config.BloomFilterConfig{
+		{FPRate: 0.01},
+		{FPRate: 0.001},
+		{BitsPerKey: 10, FPRate: 0.01},
+	} {
+		t.Run(fmt.Sprintf("bits=%d,fp=%v", cfg.BitsPerKey, cfg.FPRate), func(t *testing.T) {
+			bloom := NewBloomFilter(n, BloomBitsPerKey(cfg))
+			for i := 0; i < n; i++ {
+				bloom.Add([]byte(fmt.Sprintf("key%08d", i)))
+			}
+			for i := 0; i < n; i++ {
+				if !bloom.MayContain([]byte(fmt.Sprintf("key%08d", i))) {
+					t.Fatalf("false negative for key%08d", i)
+				}
+			}
+
+			falsePositives := 0
+			for i := 0; i < n; i++ {
+				if bloom.MayContain([]byte(fmt.Sprintf("absent%08d", i))) {
+					falsePositives++
+				}
+			}
+			rate := float64(falsePositives) / n
+			t.Logf("bits per key %d, false positive rate %.5f", BloomBitsPerKey(cfg), rate)
+			if rate > cfg.FPRate {
+				t.Fatalf("false positive rate %.5f is over the target %v", rate, cfg.FPRate)
+			}
+		})
+	}
+}
+
+func TestBloomFilter_DecodeRejectsCorruption(t *testing.T) {
+	bloom := NewBloomFilter(100, 10)
+	bloom.Add([]byte("key"))
+	data := bloom.Encode()
+
+	decoded, err := DecodeBloomFilter(data)
+	if err != nil {
+		t.Fatalf("DecodeBloomFilter: %v", err)
+	}
+	if !decoded.MayContain([]byte("key")) {
+		t.Fatal("decoded filter lost the key")
+	}
+
+	if _, err := DecodeBloomFilter(data[:len(data)-1]); !errors.Is(err, ErrCorruptedData) {
+		t.Fatalf("expected ErrCorruptedData for a truncated filter, got %v", err)
+	}
+}
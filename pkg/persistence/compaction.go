@@ -0,0 +1,355 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"sort"
+)
+
+// recordOverhead is the size of length, sequence and metadata fields of a record
+const recordOverhead = 4 + 4 + 8 + 8
+
+// CompactionFilter reports whether a record must be dropped by compaction,
+// a kept record may be rewritten in place.
+// bottommost is true when no deeper level can hold an older version of the key.
+type CompactionFilter func(item *SSTableItem, bottommost bool) bool
+
+// compaction describes a single merge of tables from level into level+1
+type compaction struct {
+	// version pins the inputs until the compaction is installed
+	version  *Version
+	level    int
+	inputs   []*SSTable
+	overlaps []*SSTable
+}
+
+// maybeScheduleCompaction wakes up the background worker without blocking
+func (lm *LevelManager) maybeScheduleCompaction() {
+	select {
+	case lm.compactCh <- struct{}{}:
+	default:
+	}
+}
+
+// compact is called by the background listener,
+// it runs compactions until every level fits its limits
+func (lm *LevelManager) compact(struct{}) error {
+	for {
+		c := lm.pickCompaction()
+		if c == nil {
+			return nil
+		}
+
+		err := lm.runCompaction(c)
+		c.version.Unref()
+		if err != nil {
+			// keep the worker alive, the next flush will retry
+			slog.Error("compaction failed", "level", c.level, "error", err)
+			return nil
+		}
+	}
+}
+
+// pickCompaction selects tables to compact or returns nil if levels are in shape
+func (lm *LevelManager) pickCompaction() *compaction {
+	v := lm.Current()
+	if c := lm.pickFrom(v); c != nil {
+		return c
+	}
+	v.Unref()
+	return nil
+}
+
+func (lm *LevelManager) pickFrom(v *Version) *compaction {
+	if v.NumLevels() == 0 {
+		return nil
+	}
+
+	// L0 tables overlap each other, so all of them are merged at once
+	if l0 := v.Tables(0); len(l0) >= lm.cfg.SSTable.CompactThreshold {
+		inputs := append([]*SSTable{}, l0...)
+		smallest, largest := keyRange(inputs)
+		return &compaction{
+			version:  v,
+			level:    0,
+			inputs:   inputs,
+			overlaps: v.overlapping(1, smallest, largest),
+		}
+	}
+
+	for level := 1; level < v.NumLevels(); level++ {
+		if v.levelSize(level) <= v.levels[level].MaxSize {
+			continue
+		}
+
+		table := lm.nextToCompact(v.Tables(level), level)
+		return &compaction{
+			version:  v,
+			level:    level,
+			inputs:   []*SSTable{table},
+			overlaps: v.overlapping(level+1, table.Smallest(), table.Largest()),
+		}
+	}
+
+	return nil
+}
+
+// nextToCompact picks tables of a level in round-robin over the key space
+func (lm *LevelManager) nextToCompact(tables []*SSTable, level int) *SSTable {
+	lm.mu.RLock()
+	cursor := lm.compactCursor[level]
+	lm.mu.RUnlock()
+
+	for _, table := range tables {
+		if cursor == nil || bytes.Compare(table.Smallest(), cursor) > 0 {
+			return table
+		}
+	}
+	return tables[0]
+}
+
+// overlapping returns tables of the level intersecting [smallest, largest]
+func (v *Version) overlapping(level int, smallest, largest []byte) []*SSTable {
+	result := make([]*SSTable, 0)
+	for _, table := range v.Tables(level) {
+		if table.overlaps(smallest, largest) {
+			result = append(result, table)
+		}
+	}
+	return result
+}
+
+func (v *Version) levelSize(level int) int64 {
+	size := int64(0)
+	for _, table := range v.Tables(level) {
+		size += table.ApproximateSize()
+	}
+	return size
+}
+
+// isBottommost checks that no level deeper than the given one holds tables
+func (v *Version) isBottommost(level int) bool {
+	for l := level + 1; l < v.NumLevels(); l++ {
+		if len(v.Tables(l)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (lm *LevelManager) runCompaction(c *compaction) error {
+	target := c.level + 1
+
+	bottommost := c.version.isBottommost(target)
+
+	lm.mu.RLock()
+	filter := lm.compactFilter
+	merger := lm.merger
+	lm.mu.RUnlock()
+
+	// read once, snapshots opened later are pinned at or above it
+	oldestSnapshot := lm.OldestSnapshot()
+	pruner := NewVersionPruner(oldestSnapshot, merger)
+
+	// newest tables go first so the merging iterator keeps their versions
+	iters := make([]Iterator, 0, len(c.inputs)+len(c.overlaps))
+	for i := len(c.inputs) - 1; i >= 0; i-- {
+		iters = append(iters, c.inputs[i].NewIterator())
+	}
+	for _, table := range c.overlaps {
+		iters = append(iters, table.NewIterator())
+	}
+	merged := NewMergingIterator(iters...)
+	defer func() {
+		if err := merged.Close(); err != nil {
+			slog.Warn("failed to close compaction iterator", "error", err)
+		}
+	}()
+
+	targetSize := lm.cfg.SSTable.TargetTableSize
+	if targetSize <= 0 {
+		targetSize = defaultTargetTableSize
+	}
+
+	var (
+		outputs  []*SSTable
+		items    []SSTableItem
+		size     int
+		versions []SSTableItem
+	)
+	// flushKey writes the collected versions of a single key,
+	// versions of a key are never split between tables
+	flushKey := func() error {
+		if len(versions) == 0 {
+			return nil
+		}
+		if merger != nil {
+			folded, err := foldOperands(merger, versions, oldestSnapshot, bottommost)
+			if err != nil {
+				slog.Warn("failed to fold merge operands", "key", string(versions[0].Key), "error", err)
+			}
+			versions = folded
+		}
+		if size >= targetSize {
+			table, err := lm.writeTable(target, items)
+			if err != nil {
+				return err
+			}
+			outputs = append(outputs, table)
+			items, size = nil, 0
+		}
+		for _, item := range versions {
+			if pruner.Obsolete(item.Key, item.ID, item.Meta) {
+				continue
+			}
+			// the filter only sees versions no snapshot can read past
+			if filter != nil && item.ID <= oldestSnapshot && filter(&item, bottommost) {
+				continue
+			}
+			items = append(items, item)
+			size += len(item.Key) + len(item.Value) + recordOverhead
+		}
+		versions = versions[:0]
+		return nil
+	}
+
+	for merged.First(); merged.Valid(); merged.Next() {
+		item := SSTableItem{
+			Key:   merged.Key(),
+			Value: merged.Value(),
+			ID:    merged.SeqN(),
+			Meta:  merged.Meta(),
+		}
+		if len(versions) > 0 && !bytes.Equal(item.Key, versions[0].Key) {
+			if err := flushKey(); err != nil {
+				dropTables(outputs)
+				return err
+			}
+		}
+		versions = append(versions, item)
+	}
+	if err := flushKey(); err != nil {
+		dropTables(outputs)
+		return err
+	}
+	if err := merged.Error(); err != nil {
+		dropTables(outputs)
+		return fmt.Errorf("failed to merge tables: %w", err)
+	}
+	if len(items) > 0 {
+		table, err := lm.writeTable(target, items)
+		if err != nil {
+			dropTables(outputs)
+			return err
+		}
+		outputs = append(outputs, table)
+	}
+
+	return lm.installCompaction(c, outputs)
+}
+
+// writeTable writes items into a new table of the given level and opens it
+func (lm *LevelManager) writeTable(level int, items []SSTableItem) (*SSTable, error) {
+	tableID := lm.Manifest().GetNextTableID()
+	filePath := fmt.Sprintf("%s/L%d_%d.sst", lm.cfg.RootPath, level, tableID)
+
+	bloom := NewBloomFilter(uint32(len(items)), BloomBitsPerKey(lm.cfg.BloomFilter))
+	table := lm.NewSSTable(tableID, filePath, bloom)
+
+	if err := lm.WriteSSTableData(table, items); err != nil {
+		table.markObsolete()
+		table.Unref()
+		return nil, fmt.Errorf("failed to write compacted table: %w", err)
+	}
+	if err := table.Open(); err != nil {
+		table.markObsolete()
+		table.Unref()
+		return nil, fmt.Errorf("failed to open compacted table: %w", err)
+	}
+
+	return table, nil
+}
+
+// installCompaction records the result in the manifest and installs
+// the version with outputs in place of the compacted tables
+func (lm *LevelManager) installCompaction(c *compaction, outputs []*SSTable) error {
+	target := c.level + 1
+
+	var edit versionEdit
+	for _, table := range c.inputs {
+		edit.removed = append(edit.removed, levelTable{level: c.level, table: table})
+	}
+	for _, table := range c.overlaps {
+		edit.removed = append(edit.removed, levelTable{level: target, table: table})
+	}
+	for _, table := range outputs {
+		edit.added = append(edit.added, levelTable{level: target, table: table})
+	}
+
+	// files of removed tables are deleted once no version or iterator holds them
+	if err := lm.versions.LogAndApply(edit); err != nil {
+		dropTables(outputs)
+		return err
+	}
+
+	lm.mu.Lock()
+	_, lm.compactCursor[c.level] = keyRange(c.inputs)
+	onCompaction := lm.onCompaction
+	lm.mu.Unlock()
+
+	if onCompaction != nil {
+		onCompaction()
+	}
+
+	slog.Info("compaction finished",
+		"from_level", c.level,
+		"to_level", target,
+		"inputs", len(edit.removed),
+		"outputs", len(outputs))
+
+	return nil
+}
+
+// dropTables marks tables obsolete and releases the reference of their creator
+func dropTables(tables []*SSTable) {
+	for _, table := range tables {
+		table.markObsolete()
+		table.Unref()
+	}
+}
+
+// without returns a copy of tables excluding the removed ones
+func without(tables, removed []*SSTable) []*SSTable {
+	skip := make(map[*SSTable]struct{}, len(removed))
+	for _, table := range removed {
+		skip[table] = struct{}{}
+	}
+
+	result := make([]*SSTable, 0, len(tables))
+	for _, table := range tables {
+		if _, ok := skip[table]; !ok {
+			result = append(result, table)
+		}
+	}
+	return result
+}
+
+// keyRange returns the smallest and the largest key among tables
+func keyRange(tables []*SSTable) (smallest, largest []byte) {
+	for _, table := range tables {
+		if smallest == nil || bytes.Compare(table.Smallest(), smallest) < 0 {
+			smallest = table.Smallest()
+		}
+		if largest == nil || bytes.Compare(table.Largest(), largest) > 0 {
+			largest = table.Largest()
+		}
+	}
+	return smallest, largest
+}
+
+func sortByKey(tables []*SSTable) {
+	sort.Slice(tables, func(i, j int) bool {
+		return bytes.Compare(tables[i].Smallest(), tables[j].Smallest()) < 0
+	})
+}
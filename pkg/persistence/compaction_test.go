@@ -0,0 +1,239 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"lsmdb/pkg/config"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestLevelManager(t *testing.T) *LevelManager {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.Persistence.RootPath = t.TempDir()
+	lm, err := NewLevelManager(cfg.Persistence)
+	if err != nil {
+		t.Fatalf("NewLevelManager failed: %v", err)
+	}
+	lm.Start(context.Background())
+	t.Cleanup(lm.Stop)
+	return lm
+}
+
+func addL0Table(t *testing.T, lm *LevelManager, items []SSTableItem) *SSTable {
+	t.Helper()
+
+	tableID := lm.Manifest().GetNextTableID()
+	filePath := fmt.Sprintf("%s/L0_%d.sst", lm.cfg.RootPath, tableID)
+	table := lm.NewSSTable(tableID, filePath, NewBloomFilter(uint32(len(items)), 10))
+	if err := lm.WriteSSTableData(table, items); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+	if err := table.Open(); err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	if err := lm.AddSSTable(table, 0); err != nil {
+		t.Fatalf("Failed to add table: %v", err)
+	}
+	return table
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func levelTables(lm *LevelManager, level int) []*SSTable {
+	v := lm.Current()
+	defer v.Unref()
+	return append([]*SSTable{}, v.Tables(level)...)
+}
+
+func TestLevelManager_CompactL0(t *testing.T) {
+	lm := newTestLevelManager(t)
+
+	seq := uint64(0)
+	var l0 []*SSTable
+	for round := 0; round < lm.cfg.SSTable.CompactThreshold; round++ {
+		items := make([]SSTableItem, 0)
+		for i := 0; i < 10; i++ {
+			seq++
+			items = append(items, SSTableItem{
+				Key:   []byte(fmt.Sprintf("key%02d", i*2+round%2)),
+				Value: []byte(fmt.Sprintf("value%d_%d", i, round)),
+				ID:    seq,
+			})
+		}
+		l0 = append(l0, addL0Table(t, lm, items))
+	}
+
+	waitFor(t, func() bool { return len(levelTables(lm, 0)) == 0 })
+
+	if len(levelTables(lm, 1)) == 0 {
+		t.Fatal("expected compacted tables in L1")
+	}
+	for _, table := range l0 {
+		if _, err := os.Stat(table.GetFilePath()); !os.IsNotExist(err) {
+			t.Fatalf("obsolete table %s must be removed", table.GetFilePath())
+		}
+	}
+
+	// the newest round wins for every key
+	item, err := lm.Get([]byte("key00"))
+	if err != nil || item == nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if string(item.Value) != "value0_2" {
+		t.Fatalf("expected newest value, got %s", item.Value)
+	}
+
+	if tables := lm.Manifest().GetAllTables(); len(tables[0]) != 0 || len(tables[1]) == 0 {
+		t.Fatalf("manifest is not updated: %+v", tables)
+	}
+}
+
+func TestLevelManager_CompactKeepsPinnedFiles(t *testing.T) {
+	lm := newTestLevelManager(t)
+
+	first := addL0Table(t, lm, []SSTableItem{{Key: []byte("a"), Value: []byte("1"), ID: 1}})
+	it := first.NewIterator()
+	for i := 1; i < lm.cfg.SSTable.CompactThreshold; i++ {
+		addL0Table(t, lm, []SSTableItem{{Key: []byte("a"), Value: []byte("2"), ID: uint64(i + 1)}})
+	}
+
+	waitFor(t, func() bool { return len(levelTables(lm, 0)) == 0 })
+
+	// the iterator still reads the replaced table
+	it.First()
+	if !it.Valid() || string(it.Value()) != "1" {
+		t.Fatalf("pinned table is not readable: %v", it.Error())
+	}
+	if _, err := os.Stat(first.GetFilePath()); err != nil {
+		t.Fatalf("pinned table must not be removed: %v", err)
+	}
+
+	if err := it.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(first.GetFilePath()); !os.IsNotExist(err) {
+		t.Fatal("table must be removed after the last reader is gone")
+	}
+}
+
+func TestLevelManager_PinnedVersion(t *testing.T) {
+	lm := newTestLevelManager(t)
+
+	first := addL0Table(t, lm, []SSTableItem{{Key: []byte("a"), Value: []byte("1"), ID: 1}})
+	v := lm.Current()
+	for i := 1; i < lm.cfg.SSTable.CompactThreshold; i++ {
+		addL0Table(t, lm, []SSTableItem{{Key: []byte("a"), Value: []byte("2"), ID: uint64(i + 1)}})
+	}
+
+	waitFor(t, func() bool { return len(levelTables(lm, 0)) == 0 })
+
+	// the pinned version keeps the tables it was created with
+	if tables := v.Tables(0); len(tables) != 1 || tables[0] != first {
+		t.Fatalf("pinned version changed: %v", tables)
+	}
+	item, err := v.GetAt([]byte("a"), math.MaxUint64)
+	if err != nil || item == nil || string(item.Value) != "1" {
+		t.Fatalf("pinned version is not readable: %+v, %v", item, err)
+	}
+
+	v.Unref()
+	if _, err := os.Stat(first.GetFilePath()); !os.IsNotExist(err) {
+		t.Fatal("table must be removed once no version holds it")
+	}
+}
+
+func TestLevelManager_CompactDeeperLevel(t *testing.T) {
+	lm := newTestLevelManager(t)
+	lm.SetCompactionFilter(func(item *SSTableItem, bottommost bool) bool {
+		return bottommost && len(item.Value) == 0
+	})
+
+	for round := 0; round < lm.cfg.SSTable.CompactThreshold; round++ {
+		addL0Table(t, lm, []SSTableItem{
+			{Key: []byte("deleted"), ID: uint64(round*2 + 2)},
+			{Key: []byte(fmt.Sprintf("key%d", round)), Value: []byte("value"), ID: uint64(round*2 + 1)},
+		})
+	}
+	waitFor(t, func() bool { return len(levelTables(lm, 1)) > 0 })
+
+	// shrink L1 limit so its tables are pushed down
+	lm.versions.mu.Lock()
+	lm.versions.current.levels[1].MaxSize = 1
+	lm.versions.mu.Unlock()
+	lm.maybeScheduleCompaction()
+
+	waitFor(t, func() bool { return len(levelTables(lm, 1)) == 0 })
+
+	for round := 0; round < lm.cfg.SSTable.CompactThreshold; round++ {
+		item, err := lm.Get([]byte(fmt.Sprintf("key%d", round)))
+		if err != nil || item == nil {
+			t.Fatalf("key%d lost after compaction: %v", round, err)
+		}
+	}
+	if item, _ := lm.Get([]byte("deleted")); item != nil {
+		t.Fatal("filtered record must be dropped on the bottommost level")
+	}
+}
+
+// operandMeta marks merge operands of testMerger
+const operandMeta = 5
+
+// testMerger appends operand values to the base value
+type testMerger struct{}
+
+func (testMerger) IsOperand(meta uint64) bool {
+	return meta == operandMeta
+}
+
+func (testMerger) Merge(key []byte, operands []SSTableItem, base *SSTableItem) (SSTableItem, error) {
+	var value []byte
+	if base != nil {
+		value = append(value, base.Value...)
+	}
+	for i := len(operands) - 1; i >= 0; i-- {
+		value = append(value, operands[i].Value...)
+	}
+	return SSTableItem{Key: key, Value: value, ID: operands[0].ID}, nil
+}
+
+func TestLevelManager_CompactFoldsOperands(t *testing.T) {
+	lm := newTestLevelManager(t)
+	lm.SetMerger(testMerger{})
+
+	addL0Table(t, lm, []SSTableItem{{Key: []byte("counter"), Value: []byte("a"), ID: 1}})
+	want := "a"
+	for i := 1; i < lm.cfg.SSTable.CompactThreshold; i++ {
+		value := fmt.Sprint(i)
+		want += value
+		addL0Table(t, lm, []SSTableItem{
+			{Key: []byte("counter"), Value: []byte(value), ID: uint64(i*2 + 1), Meta: operandMeta},
+			{Key: []byte("operands"), Value: []byte(value), ID: uint64(i*2 + 2), Meta: operandMeta},
+		})
+	}
+	waitFor(t, func() bool { return len(levelTables(lm, 0)) == 0 })
+
+	item, err := lm.Get([]byte("counter"))
+	if err != nil || string(item.Value) != want || item.Meta == operandMeta {
+		t.Fatalf("operands are not folded into the base: %+v, %v", item, err)
+	}
+	// without a base operands are folded only on the bottommost level
+	item, err = lm.Get([]byte("operands"))
+	if err != nil || string(item.Value) != want[1:] || item.Meta == operandMeta {
+		t.Fatalf("operands are not folded on the bottommost level: %+v, %v", item, err)
+	}
+}
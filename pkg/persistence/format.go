@@ -0,0 +1,443 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+)
+
+// SSTable file layout:
+//
+//	[data block 1] ... [data block N]
+//	[filter block]
+//	[prefix filter block]
+//	[meta block]
+//	[index block]
+//	[footer]
+//
+// Every block is followed by a CRC32-C of its content.
+// Data blocks hold records sorted by key:
+//
+//	keyLen(4) | key | valueLen(4) | value | seq(8) | meta(8)
+//
+// The index block holds one entry per data block with the largest key of the block:
+//
+//	keyLen(4) | key | offset(8) | size(4)
+//
+// The filter block holds the serialized bloom filter over all keys of the table,
+// the prefix filter block a bloom filter over key prefixes tagged with the extractor name.
+// The footer is read from the end of the file, version and magic are always the last 12 bytes:
+//
+//	v1: meta handle | index handle | version(4) | magic(8)
+//	v2: filter handle | meta handle | index handle | version(4) | magic(8)
+//	v3: filter handle | prefix filter handle | meta handle | index handle | version(4) | magic(8)
+const (
+	tableMagic   uint64 = 0x54535342444d534c // "LSMDBSST" in little-endian
+	tableVersion uint32 = 3
+
+	blockTrailerSize = 4
+	blockHandleSize  = 8 + 4
+	footerTailSize   = 4 + 8
+	footerSizeV1     = 2*blockHandleSize + footerTailSize
+	footerSizeV2     = 3*blockHandleSize + footerTailSize
+	footerSizeV3     = 4*blockHandleSize + footerTailSize
+
+	// defaultBlockSize is used when SSTableConfig.BlockSize is not set
+	defaultBlockSize = 4096
+)
+
+var (
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrBadMagic           = errors.New("not an SSTable: bad magic number")
+	ErrBadChecksum        = errors.New("SSTable block checksum mismatch")
+	ErrUnsupportedVersion = errors.New("unsupported SSTable version")
+	ErrCorruptedData      = errors.New("SSTable data corrupted")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// blockHandle points to a block inside the table file
+type blockHandle struct {
+	offset int64
+	size   int
+}
+
+// footer is the fixed-size tail of the table file
+type footer struct {
+	filter       blockHandle
+	prefixFilter blockHandle
+	meta         blockHandle
+	index        blockHandle
+	version      uint32
+}
+
+func (h blockHandle) encode(buf []byte) []byte {
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(h.offset))
+	return binary.LittleEndian.AppendUint32(buf, uint32(h.size))
+}
+
+func decodeBlockHandle(buf []byte) blockHandle {
+	return blockHandle{
+		offset: int64(binary.LittleEndian.Uint64(buf)),
+		size:   int(binary.LittleEndian.Uint32(buf[8:])),
+	}
+}
+
+// encode writes the footer of the current version
+func (f footer) encode() []byte {
+	buf := make([]byte, 0, footerSizeV3)
+	buf = f.filter.encode(buf)
+	buf = f.prefixFilter.encode(buf)
+	buf = f.meta.encode(buf)
+	buf = f.index.encode(buf)
+	buf = binary.LittleEndian.AppendUint32(buf, tableVersion)
+	return binary.LittleEndian.AppendUint64(buf, tableMagic)
+}
+
+// footerSize returns the footer size of the given format version
+func footerSize(version uint32) (int64, error) {
+	switch version {
+	case 1:
+		return footerSizeV1, nil
+	case 2:
+		return footerSizeV2, nil
+	case 3:
+		return footerSizeV3, nil
+	default:
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+}
+
+// readFooter reads and validates the footer of a table of the given size
+func readFooter(r io.ReaderAt, fileSize int64) (footer, error) {
+	var f footer
+	if fileSize < footerTailSize {
+		return f, fmt.Errorf("file too small to contain footer: %w", ErrCorruptedData)
+	}
+
+	tail := make([]byte, footerTailSize)
+	if _, err := r.ReadAt(tail, fileSize-footerTailSize); err != nil {
+		return f, fmt.Errorf("failed to read footer: %w", err)
+	}
+	if binary.LittleEndian.Uint64(tail[4:]) != tableMagic {
+		return f, ErrBadMagic
+	}
+
+	f.version = binary.LittleEndian.Uint32(tail)
+	size, err := footerSize(f.version)
+	if err != nil {
+		return f, err
+	}
+	if fileSize < size {
+		return f, fmt.Errorf("file too small to contain footer: %w", ErrCorruptedData)
+	}
+
+	buf := make([]byte, size-footerTailSize)
+	if _, err := r.ReadAt(buf, fileSize-size); err != nil {
+		return f, fmt.Errorf("failed to read footer: %w", err)
+	}
+	if f.version >= 2 {
+		f.filter = decodeBlockHandle(buf)
+		buf = buf[blockHandleSize:]
+	}
+	if f.version >= 3 {
+		f.prefixFilter = decodeBlockHandle(buf)
+		buf = buf[blockHandleSize:]
+	}
+	f.meta = decodeBlockHandle(buf)
+	f.index = decodeBlockHandle(buf[blockHandleSize:])
+
+	for _, h := range []blockHandle{f.filter, f.prefixFilter, f.meta, f.index} {
+		if h.offset < 0 || h.offset+int64(h.size)+blockTrailerSize > fileSize-size {
+			return f, fmt.Errorf("block handle out of file bounds: %w", ErrCorruptedData)
+		}
+	}
+
+	return f, nil
+}
+
+// readBlock reads a block and verifies its checksum
+func readBlock(r io.ReaderAt, h blockHandle) ([]byte, error) {
+	buf := make([]byte, h.size+blockTrailerSize)
+	if _, err := r.ReadAt(buf, h.offset); err != nil {
+		return nil, fmt.Errorf("failed to read block at %d: %w", h.offset, err)
+	}
+
+	data := buf[:h.size]
+	if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(buf[h.size:]) {
+		return nil, fmt.Errorf("%w: block at %d", ErrBadChecksum, h.offset)
+	}
+	return data, nil
+}
+
+// appendRecord encodes a record at the end of buf
+func appendRecord(buf []byte, item *SSTableItem) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(item.Key)))
+	buf = append(buf, item.Key...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(item.Value)))
+	buf = append(buf, item.Value...)
+	buf = binary.LittleEndian.AppendUint64(buf, item.ID)
+	buf = binary.LittleEndian.AppendUint64(buf, item.Meta)
+	return buf
+}
+
+// decodeRecord parses a record from the head of buf and returns its encoded size
+func decodeRecord(buf []byte) (SSTableItem, int, error) {
+	const (
+		sizeFieldSize = 4
+		seqNumSize    = 8
+		metaSize      = 8
+	)
+
+	var item SSTableItem
+	if len(buf) < sizeFieldSize {
+		return item, 0, ErrCorruptedData
+	}
+	keyLen := int(binary.LittleEndian.Uint32(buf))
+	pos := sizeFieldSize
+	if len(buf) < pos+keyLen+sizeFieldSize {
+		return item, 0, ErrCorruptedData
+	}
+	item.Key = buf[pos : pos+keyLen]
+	pos += keyLen
+
+	valueLen := int(binary.LittleEndian.Uint32(buf[pos:]))
+	pos += sizeFieldSize
+	if len(buf) < pos+valueLen+seqNumSize+metaSize {
+		return item, 0, ErrCorruptedData
+	}
+	item.Value = buf[pos : pos+valueLen]
+	pos += valueLen
+
+	item.ID = binary.LittleEndian.Uint64(buf[pos:])
+	item.Meta = binary.LittleEndian.Uint64(buf[pos+seqNumSize:])
+	pos += seqNumSize + metaSize
+
+	return item, pos, nil
+}
+
+// decodeBlock parses all records of a data block
+func decodeBlock(buf []byte) ([]SSTableItem, error) {
+	items := make([]SSTableItem, 0)
+	for len(buf) > 0 {
+		item, n, err := decodeRecord(buf)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		buf = buf[n:]
+	}
+	return items, nil
+}
+
+func encodeIndex(index []IndexEntry) []byte {
+	buf := make([]byte, 0)
+	for _, entry := range index {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entry.Key)))
+		buf = append(buf, entry.Key...)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(entry.BlockOffset))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(entry.BlockSize))
+	}
+	return buf
+}
+
+func decodeIndex(buf []byte) ([]IndexEntry, error) {
+	index := make([]IndexEntry, 0)
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, ErrCorruptedData
+		}
+		keyLen := int(binary.LittleEndian.Uint32(buf))
+		if len(buf) < 4+keyLen+8+4 {
+			return nil, ErrCorruptedData
+		}
+		index = append(index, IndexEntry{
+			Key:         bytes.Clone(buf[4 : 4+keyLen]),
+			BlockOffset: int64(binary.LittleEndian.Uint64(buf[4+keyLen:])),
+			BlockSize:   int(binary.LittleEndian.Uint32(buf[4+keyLen+8:])),
+			BlockInd:    len(index),
+		})
+		buf = buf[4+keyLen+8+4:]
+	}
+	return index, nil
+}
+
+// encodeMeta serializes table properties
+func encodeMeta(meta SSTableMeta) []byte {
+	buf := make([]byte, 0)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(meta.NumBlocks))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(meta.NumKeys))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(meta.ApproxBytes))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(meta.CreatedAt.UnixNano()))
+	buf = binary.LittleEndian.AppendUint64(buf, meta.MaxSeqN)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(meta.Smallest)))
+	buf = append(buf, meta.Smallest...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(meta.Largest)))
+	buf = append(buf, meta.Largest...)
+	return buf
+}
+
+func decodeMeta(buf []byte) (SSTableMeta, error) {
+	const fixedSize = 8 * 5
+
+	var meta SSTableMeta
+	if len(buf) < fixedSize+4 {
+		return meta, ErrCorruptedData
+	}
+	meta.NumBlocks = int(binary.LittleEndian.Uint64(buf[0:]))
+	meta.NumKeys = int(binary.LittleEndian.Uint64(buf[8:]))
+	meta.ApproxBytes = int64(binary.LittleEndian.Uint64(buf[16:]))
+	meta.CreatedAt = time.Unix(0, int64(binary.LittleEndian.Uint64(buf[24:])))
+	meta.MaxSeqN = binary.LittleEndian.Uint64(buf[32:])
+	buf = buf[fixedSize:]
+
+	keys := make([][]byte, 0, 2)
+	for i := 0; i < 2; i++ {
+		if len(buf) < 4 {
+			return meta, ErrCorruptedData
+		}
+		keyLen := int(binary.LittleEndian.Uint32(buf))
+		if len(buf) < 4+keyLen {
+			return meta, ErrCorruptedData
+		}
+		keys = append(keys, bytes.Clone(buf[4:4+keyLen]))
+		buf = buf[4+keyLen:]
+	}
+	meta.Smallest, meta.Largest = keys[0], keys[1]
+
+	return meta, nil
+}
+
+// tableWriter splits sorted records into data blocks and writes the table layout
+type tableWriter struct {
+	w         io.Writer
+	blockSize int
+	offset    int64
+
+	block   []byte
+	last    []byte
+	lastSeq uint64
+	index   []IndexEntry
+	meta    SSTableMeta
+}
+
+func newTableWriter(w io.Writer, blockSize int) *tableWriter {
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
+	}
+	return &tableWriter{
+		w:         w,
+		blockSize: blockSize,
+		meta:      SSTableMeta{CreatedAt: time.Now()},
+	}
+}
+
+// add appends a record, items must be added in ascending key order
+func (tw *tableWriter) add(item *SSTableItem) error {
+	if len(item.Key) > math.MaxUint32 {
+		return fmt.Errorf("key too large: %d", len(item.Key))
+	}
+	if len(item.Value) > math.MaxUint32 {
+		return fmt.Errorf("value too large: %d", len(item.Value))
+	}
+	// versions of the same key go from newest to oldest
+	if tw.meta.NumKeys > 0 {
+		switch cmp := bytes.Compare(item.Key, tw.last); {
+		case cmp < 0:
+			return fmt.Errorf("keys are not sorted: %q after %q", item.Key, tw.last)
+		case cmp == 0 && item.ID >= tw.lastSeq:
+			return fmt.Errorf("versions of %q are not sorted: %d after %d", item.Key, item.ID, tw.lastSeq)
+		}
+	}
+
+	if tw.meta.NumKeys == 0 {
+		tw.meta.Smallest = bytes.Clone(item.Key)
+	}
+	tw.last = append(tw.last[:0], item.Key...)
+	tw.lastSeq = item.ID
+	tw.meta.NumKeys++
+	tw.meta.MaxSeqN = max(tw.meta.MaxSeqN, item.ID)
+
+	tw.block = appendRecord(tw.block, item)
+	if len(tw.block) >= tw.blockSize {
+		return tw.flushBlock()
+	}
+	return nil
+}
+
+// flushBlock writes the pending data block and indexes it by its largest key
+func (tw *tableWriter) flushBlock() error {
+	if len(tw.block) == 0 {
+		return nil
+	}
+
+	h, err := tw.writeBlock(tw.block)
+	if err != nil {
+		return err
+	}
+	tw.index = append(tw.index, IndexEntry{
+		Key:         bytes.Clone(tw.last),
+		BlockOffset: h.offset,
+		BlockSize:   h.size,
+		BlockInd:    len(tw.index),
+	})
+	tw.meta.ApproxBytes += int64(h.size)
+	tw.block = tw.block[:0]
+	return nil
+}
+
+func (tw *tableWriter) writeBlock(data []byte) (blockHandle, error) {
+	if len(data) > math.MaxUint32 {
+		return blockHandle{}, fmt.Errorf("block too large: %d", len(data))
+	}
+
+	h := blockHandle{offset: tw.offset, size: len(data)}
+	if _, err := tw.w.Write(data); err != nil {
+		return h, err
+	}
+	trailer := binary.LittleEndian.AppendUint32(nil, crc32.Checksum(data, crcTable))
+	if _, err := tw.w.Write(trailer); err != nil {
+		return h, err
+	}
+	tw.offset += int64(len(data) + blockTrailerSize)
+	return h, nil
+}
+
+// finish writes the last data block, filter, meta and index blocks and the footer.
+// filter and prefixFilter may be nil if the table has no such filter.
+func (tw *tableWriter) finish(filter, prefixFilter []byte) error {
+	if err := tw.flushBlock(); err != nil {
+		return err
+	}
+	tw.meta.NumBlocks = len(tw.index)
+	tw.meta.Largest = bytes.Clone(tw.last)
+
+	var (
+		f   = footer{version: tableVersion}
+		err error
+	)
+	if len(filter) > 0 {
+		if f.filter, err = tw.writeBlock(filter); err != nil {
+			return err
+		}
+	}
+	if len(prefixFilter) > 0 {
+		if f.prefixFilter, err = tw.writeBlock(prefixFilter); err != nil {
+			return err
+		}
+	}
+	if f.meta, err = tw.writeBlock(encodeMeta(tw.meta)); err != nil {
+		return err
+	}
+	if f.index, err = tw.writeBlock(encodeIndex(tw.index)); err != nil {
+		return err
+	}
+
+	_, err = tw.w.Write(f.encode())
+	return err
+}
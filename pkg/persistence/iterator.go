@@ -1,14 +1,142 @@
 package persistence
 
-type Iterator struct {
+import (
+	"bytes"
+)
+
+// Iterator is an ordered cursor over records of a single data source
+// (memtable, SSTable) or over several sources merged together.
+type Iterator interface {
+	// First moves to the smallest key
+	First()
+	// Seek moves to the first key that is greater than or equal to key
+	Seek(key []byte)
+	// Next moves to the next record, which may be an older version of the same key
+	Next()
+	Valid() bool
+
+	Key() []byte
+	Value() []byte
+	SeqN() uint64
+	Meta() uint64
+
+	Error() error
+	Close() error
+}
+
+// MergingIterator merges several ordered iterators into one.
+// Records come ordered by key and, for the same key, from the newest
+// sequence number to the oldest. A record present in several children
+// with the same sequence number is returned once from the child passed first.
+type MergingIterator struct {
+	children []Iterator
+	current  int
+	err      error
+}
+
+// NewMergingIterator creates a merging iterator over children
+func NewMergingIterator(children ...Iterator) *MergingIterator {
+	return &MergingIterator{
+		children: children,
+		current:  -1,
+	}
+}
+
+// First moves to the smallest key among all children
+func (it *MergingIterator) First() {
+	for _, child := range it.children {
+		child.First()
+	}
+	it.pick()
+}
+
+// Seek moves every child to key and picks the smallest one
+func (it *MergingIterator) Seek(key []byte) {
+	for _, child := range it.children {
+		child.Seek(key)
+	}
+	it.pick()
+}
+
+// Next moves to the next record skipping copies of the current one
+func (it *MergingIterator) Next() {
+	if it.current < 0 {
+		return
+	}
+
+	current := it.children[it.current]
+	key, seqN := current.Key(), current.SeqN()
+	for _, child := range it.children {
+		if child.Valid() && child.SeqN() == seqN && bytes.Equal(child.Key(), key) {
+			child.Next()
+		}
+	}
+	it.pick()
+}
+
+// pick selects the child holding the smallest key with the newest version
+func (it *MergingIterator) pick() {
+	it.current = -1
+	for i, child := range it.children {
+		if err := child.Error(); err != nil {
+			it.err = err
+			return
+		}
+		if !child.Valid() {
+			continue
+		}
+		if it.current < 0 {
+			it.current = i
+			continue
+		}
+
+		best := it.children[it.current]
+		switch cmp := bytes.Compare(child.Key(), best.Key()); {
+		case cmp < 0:
+			it.current = i
+		case cmp == 0 && child.SeqN() > best.SeqN():
+			it.current = i
+		}
+	}
+}
+
+// Valid checks if the iterator is positioned on a record
+func (it *MergingIterator) Valid() bool {
+	return it.err == nil && it.current >= 0
+}
+
+// Key returns the current key
+func (it *MergingIterator) Key() []byte {
+	return it.children[it.current].Key()
+}
+
+// Value returns the current value
+func (it *MergingIterator) Value() []byte {
+	return it.children[it.current].Value()
+}
+
+// SeqN returns the sequence number of the current record
+func (it *MergingIterator) SeqN() uint64 {
+	return it.children[it.current].SeqN()
+}
+
+// Meta returns the current metadata
+func (it *MergingIterator) Meta() uint64 {
+	return it.children[it.current].Meta()
 }
 
-func NewIterator(dirPath string) (*Iterator, error) {
-	// TODO
-	panic("TODO")
+// Error returns the first error met by any child
+func (it *MergingIterator) Error() error {
+	return it.err
 }
 
-func (iter *Iterator) Next() (*SSTable, bool) {
-	// TODO
-	panic("TODO")
+// Close closes all children
+func (it *MergingIterator) Close() error {
+	var firstErr error
+	for _, child := range it.children {
+		if err := child.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
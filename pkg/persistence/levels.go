@@ -1,21 +1,47 @@
 package persistence
 
 import (
-	"encoding/binary"
+	"bufio"
+	"errors"
 	"fmt"
 	"log/slog"
 	"lsmdb/pkg/config"
+	"lsmdb/pkg/listener"
 	"math"
 	"os"
+	"sort"
 	"sync"
 )
 
+const (
+	// levelSizeUnit is the unit of SSTableConfig.SizeMultiplier
+	levelSizeUnit = 1 << 20
+	// defaultTargetTableSize is used when SSTableConfig.TargetTableSize is not set
+	defaultTargetTableSize = 2 << 20
+)
+
 // LevelManager manages the LSM-tree levels
 type LevelManager struct {
+	*listener.Listener[struct{}]
+
 	mu       sync.RWMutex
 	cfg      *config.PersistenceConfig
-	levels   []Level
-	manifest *Manifest
+	versions *VersionSet
+	// blockCache is shared by all tables of the tree
+	blockCache BlockCache
+	tableCache *TableCache
+	// prefix extracts key prefixes of table prefix filters, nil disables them
+	prefix PrefixExtractor
+
+	compactCh     chan struct{}
+	compactFilter CompactionFilter
+	merger        Merger
+	// oldestSnapshot reports the sequence number of the oldest open snapshot
+	oldestSnapshot func() uint64
+	// onCompaction is called after every installed compaction
+	onCompaction func()
+	// compactCursor holds the largest key of the last table compacted on each level
+	compactCursor map[int][]byte
 }
 
 // Level represents a single level in the LSM-tree
@@ -25,124 +51,204 @@ type Level struct {
 	MaxSize  int64
 }
 
-// NewLevelManager creates a new level manager
-func NewLevelManager(config config.PersistenceConfig) *LevelManager {
+// NewLevelManager creates a level manager over the tables of the manifest,
+// a table that cannot be opened fails it rather than losing its keys
+func NewLevelManager(config config.PersistenceConfig) (*LevelManager, error) {
 	lm := &LevelManager{
-		cfg:      &config,
-		levels:   make([]Level, 0),
-		manifest: NewManifest(config.RootPath),
+		cfg:           &config,
+		blockCache:    NewBlockCache(config.Cache.CapacityBytes, config.Cache.Shards),
+		tableCache:    NewTableCache(config.MaxOpenTables),
+		prefix:        NewPrefixExtractor(config.BloomFilter.Prefix),
+		compactCh:     make(chan struct{}, 1),
+		compactCursor: make(map[int][]byte),
 	}
+	lm.versions = newVersionSet(NewManifest(config.RootPath), lm.levelMaxSize)
+	// compaction runs in background on every signal from compactCh
+	lm.Listener = listener.New(lm.compactCh, lm.compact)
 
 	// Load existing SSTables from manifest
-	lm.loadSSTablesFromManifest()
+	if err := lm.loadSSTablesFromManifest(); err != nil {
+		return nil, err
+	}
 
-	return lm
+	return lm, nil
 }
 
-// AddSSTable adds an SSTable to the appropriate level
-func (lm *LevelManager) AddSSTable(sstable *SSTable, level int) error {
+// Manifest returns the manifest the level manager keeps in sync with levels
+func (lm *LevelManager) Manifest() *Manifest {
+	return lm.versions.Manifest()
+}
+
+// Current returns the pinned current version of the tree, the caller must Unref it
+func (lm *LevelManager) Current() *Version {
+	return lm.versions.Current()
+}
+
+// BlockCache returns the block cache shared by all tables of the tree
+func (lm *LevelManager) BlockCache() BlockCache {
+	return lm.blockCache
+}
+
+// TableCache returns the cache limiting open table files
+func (lm *LevelManager) TableCache() *TableCache {
+	return lm.tableCache
+}
+
+// NewSSTable creates a handle of a table of the tree sharing its block and table caches
+func (lm *LevelManager) NewSSTable(id uint64, path string, bloom BloomFilter) *SSTable {
+	table := NewSSTable(id, path, bloom, lm.blockCache)
+	table.files = lm.tableCache
+	return table
+}
+
+// SetCompactionFilter sets a filter consulted for every record written by compaction
+func (lm *LevelManager) SetCompactionFilter(filter CompactionFilter) {
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
+	lm.compactFilter = filter
+}
 
-	// Ensure we have enough levels
-	for len(lm.levels) <= level {
-		lm.levels = append(lm.levels, Level{
-			LevelNum: len(lm.levels),
-			Tables:   []*SSTable{},
-			MaxSize:  int64(lm.cfg.SSTable.SizeMultiplier * (1 << (len(lm.levels) * 2))), // 10MB, 40MB, 160MB, etc.
-		})
+// SetMerger sets the merger folding merge operands during compaction
+func (lm *LevelManager) SetMerger(merger Merger) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.merger = merger
+}
+
+// Merger returns the merger set by SetMerger or nil
+func (lm *LevelManager) Merger() Merger {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	return lm.merger
+}
+
+// OnCompaction registers a hook called after every compaction
+func (lm *LevelManager) OnCompaction(fn func()) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.onCompaction = fn
+}
+
+// L0Tables returns the number of tables waiting for compaction on L0
+func (lm *LevelManager) L0Tables() int {
+	v := lm.Current()
+	defer v.Unref()
+	return len(v.Tables(0))
+}
+
+// SetSnapshotSource sets a function reporting the oldest sequence number a snapshot
+// is or may later be pinned at, versions visible to it survive compaction
+func (lm *LevelManager) SetSnapshotSource(oldest func() uint64) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.oldestSnapshot = oldest
+}
+
+// OldestSnapshot returns the oldest sequence number a snapshot is or may later
+// be pinned at, NoSnapshot without a source
+func (lm *LevelManager) OldestSnapshot() uint64 {
+	lm.mu.RLock()
+	oldest := lm.oldestSnapshot
+	lm.mu.RUnlock()
+
+	if oldest == nil {
+		return NoSnapshot
 	}
+	return oldest()
+}
 
-	// Add to level
-	lm.levels[level].Tables = append(lm.levels[level].Tables, sstable)
+// levelMaxSize returns the size limit of a level: 10MB, 40MB, 160MB, etc.
+func (lm *LevelManager) levelMaxSize(level int) int64 {
+	return int64(lm.cfg.SSTable.SizeMultiplier) * levelSizeUnit << (level * 2)
+}
 
-	// TODO compact
+// AddSSTable records the table in the manifest and installs it on the level,
+// the level manager takes over the reference of the caller
+func (lm *LevelManager) AddSSTable(sstable *SSTable, level int) error {
+	edit := versionEdit{added: []levelTable{{level: level, table: sstable}}}
+	if err := lm.versions.LogAndApply(edit); err != nil {
+		return err
+	}
+
+	lm.maybeScheduleCompaction()
 
 	return nil
 }
 
 // loadSSTablesFromManifest loads existing SSTables from manifest
-func (lm *LevelManager) loadSSTablesFromManifest() {
-	// Load manifest
-	if err := lm.manifest.Load(); err != nil {
-		// If manifest doesn't exist, that's OK for new database
-		return
+func (lm *LevelManager) loadSSTablesFromManifest() error {
+	manifest := lm.Manifest()
+	// Load manifest, a missing one is not an error
+	if err := manifest.Load(); err != nil {
+		return fmt.Errorf("failed to load manifest: %w", err)
 	}
 
-	// Get all tables from manifest
-	tablesByLevel := lm.manifest.GetAllTables()
-
-	for level, tables := range tablesByLevel {
+	var edit versionEdit
+	for level, tables := range manifest.GetAllTables() {
 		for _, table := range tables {
-			// Create SSTable
-			bloom := NewBloomFilter(1000, lm.cfg.BloomFilter.FPRate) // TODO replace with correct
-			cache := NewBlockCache(lm.cfg.Cache.Capacity)
-			sstable := NewSSTable(table.FilePath, bloom, cache)
+			// Create SSTable, the bloom filter is loaded from its filter block
+			sstable := lm.NewSSTable(table.ID, table.FilePath, nil)
 
 			// Open the table
 			if err := sstable.Open(); err != nil {
-				// Skip invalid tables
-				continue
-			}
-
-			// Add to appropriate level; log error if it fails
-			if err := lm.AddSSTable(sstable, level); err != nil {
-				slog.Error("failed to add SSTable from manifest", "level", level, "path", table.FilePath, "error", err)
-				// Close and remove the table file to avoid leaking resources
-				if cerr := sstable.Close(); cerr != nil {
-					slog.Warn("failed to close SSTable after AddSSTable error", "error", cerr)
+				for _, opened := range edit.added {
+					if cerr := opened.table.Close(); cerr != nil {
+						slog.Warn("failed to close SSTable", "path", opened.table.GetFilePath(), "error", cerr)
+					}
 				}
-				if rerr := os.Remove(table.FilePath); rerr != nil {
-					slog.Warn("failed to remove SSTable file after AddSSTable error", "path", table.FilePath, "error", rerr)
+				if errors.Is(err, ErrBadMagic) {
+					// tables of the first versions end with the index size, not a footer
+					err = fmt.Errorf("%w, the table has no format footer and was likely written by an older version", err)
 				}
-				continue
+				return fmt.Errorf("failed to open SSTable %s from manifest: %w", table.FilePath, err)
 			}
+			edit.added = append(edit.added, levelTable{level: level, table: sstable})
 		}
 	}
-}
+	// L0 keeps tables in order of creation
+	sort.SliceStable(edit.added, func(i, j int) bool {
+		return edit.added[i].table.ID() < edit.added[j].table.ID()
+	})
 
-// Get retrieves a value by key from all levels
-func (lm *LevelManager) Get(key []byte) (*SSTableItem, error) {
-	lm.mu.RLock()
-	defer lm.mu.RUnlock()
+	// the tables are in the manifest already
+	lm.versions.mu.Lock()
+	lm.versions.install(edit)
+	lm.versions.mu.Unlock()
 
-	// Search from newest to oldest (L0 to Ln)
-	for level := 0; level < len(lm.levels); level++ {
-		// Search in reverse order (newest first)
-		for i := len(lm.levels[level].Tables) - 1; i >= 0; i-- {
-			table := lm.levels[level].Tables[i]
+	lm.maybeScheduleCompaction()
+	return nil
+}
 
-			// Check bloom filter first
-			if table.bloom != nil && !table.bloom.MayContain(key) {
-				continue
-			}
+// Get retrieves the newest version of the key from all levels
+func (lm *LevelManager) Get(key []byte) (*SSTableItem, error) {
+	return lm.GetAt(key, math.MaxUint64)
+}
 
-			// Try to get from this table
-			item, err := table.Get(key)
-			if err != nil {
-				// If key not found, continue to next table
-				if err.Error() == "key not found" {
-					continue
-				}
-				return nil, fmt.Errorf("failed to get from table: %w", err)
-			}
+// GetAt retrieves the newest version of the key with sequence number not greater than seqN
+func (lm *LevelManager) GetAt(key []byte, seqN uint64) (*SSTableItem, error) {
+	v := lm.Current()
+	defer v.Unref()
+	return v.GetAt(key, seqN)
+}
 
-			if item != nil {
-				return item, nil
-			}
-		}
-	}
+// Iterators returns iterators over every table ordered from newest to oldest,
+// the iterators keep their tables open after a compaction replaces them
+func (lm *LevelManager) Iterators() []Iterator {
+	v := lm.Current()
+	defer v.Unref()
+	return v.Iterators()
+}
 
-	return nil, nil
+// PrefixIterators returns iterators over tables which may hold keys starting
+// with prefix, tables ruled out by their prefix filter are skipped
+func (lm *LevelManager) PrefixIterators(prefix []byte) []Iterator {
+	v := lm.Current()
+	defer v.Unref()
+	return v.PrefixIterators(lm.prefix, prefix)
 }
 
+// WriteSSTableData writes sorted items into the table file using the block format
 func (lm *LevelManager) WriteSSTableData(sstable *SSTable, items []SSTableItem) error {
-	const (
-		sizeFieldSize = 4
-		seqNumSize    = 8
-		metaSize      = 8
-	)
-
 	file, err := os.Create(sstable.filePath)
 	if err != nil {
 		return fmt.Errorf("failed to create SSTable file: %w", err)
@@ -153,109 +259,37 @@ func (lm *LevelManager) WriteSSTableData(sstable *SSTable, items []SSTableItem)
 		}
 	}()
 
-	// Write data blocks
-	blockIndex := make([]IndexEntry, 0)
-	blockOffset := int64(0)
-	blockNum := 0
-
-	for _, item := range items {
+	writer := bufio.NewWriter(file)
+	tw := newTableWriter(writer, lm.cfg.SSTable.BlockSize)
+	for i := range items {
 		// Add to bloom filter
 		if sstable.bloom != nil {
-			sstable.bloom.Add(item.Key)
-		}
-
-		// Check sizes before casting
-		if len(item.Key) > math.MaxUint32 {
-			return fmt.Errorf("key too large: %d", len(item.Key))
-		}
-		if len(item.Value) > math.MaxUint32 {
-			return fmt.Errorf("value too large: %d", len(item.Value))
-		}
-
-		// Write key length
-		if err := binary.Write(file, binary.LittleEndian, uint32(len(item.Key))); err != nil {
-			return err
+			sstable.bloom.Add(items[i].Key)
 		}
 
-		// Write key
-		if _, err := file.Write(item.Key); err != nil {
-			return err
+		if err := tw.add(&items[i]); err != nil {
+			return fmt.Errorf("failed to add record: %w", err)
 		}
-
-		// Write value length
-		if err := binary.Write(file, binary.LittleEndian, uint32(len(item.Value))); err != nil {
-			return err
-		}
-
-		// Write value
-		if _, err := file.Write(item.Value); err != nil {
-			return err
-		}
-
-		// Write sequence number (placeholder)
-		if err := binary.Write(file, binary.LittleEndian, uint64(0)); err != nil {
-			return err
-		}
-
-		// Write metadata
-		if err := binary.Write(file, binary.LittleEndian, item.Meta); err != nil {
-			return err
-		}
-
-		// Add to block index
-		blockSz := sizeFieldSize + len(item.Key) + sizeFieldSize + len(item.Value) + seqNumSize + metaSize
-		blockIndex = append(blockIndex, IndexEntry{
-			Key:         item.Key,
-			BlockOffset: blockOffset,
-			BlockSize:   blockSz,
-			BlockInd:    blockNum,
-		})
-
-		blockOffset += int64(blockSz)
-		blockNum++
 	}
-
-	// Write block index
-	indexData := make([]byte, 0)
-
-	for _, entry := range blockIndex {
-		// Write key length
-		indexData = append(indexData, make([]byte, 4)...)
-		binary.LittleEndian.PutUint32(indexData[len(indexData)-4:], uint32(len(entry.Key)))
-
-		// Write key
-		indexData = append(indexData, entry.Key...)
-
-		// Write block offset
-		indexData = append(indexData, make([]byte, 8)...)
-		if entry.BlockOffset < 0 {
-			return fmt.Errorf("negative block offset: %d", entry.BlockOffset)
-		}
-		binary.LittleEndian.PutUint64(indexData[len(indexData)-8:], uint64(entry.BlockOffset))
-
-		// Write block size
-		indexData = append(indexData, make([]byte, 4)...)
-		if entry.BlockSize < 0 {
-			return fmt.Errorf("negative block size: %d", entry.BlockSize)
-		}
-		binary.LittleEndian.PutUint32(indexData[len(indexData)-4:], uint32(entry.BlockSize))
-
-		// Write block index
-		indexData = append(indexData, make([]byte, 4)...)
-		binary.LittleEndian.PutUint32(indexData[len(indexData)-4:], uint32(entry.BlockInd))
+	var filter, prefixFilter []byte
+	if sstable.bloom != nil {
+		filter = sstable.bloom.Encode()
 	}
-
-	// Write index to file
-	if _, err := file.Write(indexData); err != nil {
-		return err
+	if lm.prefix != nil {
+		sstable.prefixFilter = buildPrefixFilter(lm.prefix, items, BloomBitsPerKey(lm.cfg.BloomFilter))
+	}
+	if sstable.prefixFilter != nil {
+		prefixFilter = sstable.prefixFilter.encode()
+	}
+	if err := tw.finish(filter, prefixFilter); err != nil {
+		return fmt.Errorf("failed to finish table: %w", err)
 	}
 
-	// Write index size
-	if len(indexData) > math.MaxUint32 {
-		return fmt.Errorf("index too large: %d", len(indexData))
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush SSTable file: %w", err)
 	}
-	if err := binary.Write(file, binary.LittleEndian, uint32(len(indexData))); err != nil {
-		return err
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync SSTable file: %w", err)
 	}
 
 	return nil
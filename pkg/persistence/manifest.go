@@ -3,17 +3,30 @@ package persistence
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"lsmdb/pkg/types"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 )
 
-// Manifest manages metadata about SSTables and levels
+// Manifest manages metadata about SSTables and levels. Changes are appended
+// to the manifest log as version edits, the log is rewritten into a new file
+// once it grows over maxFileSize.
 type Manifest struct {
 	mu       sync.RWMutex
-	filePath string
+	dir      string
 	metadata ManifestData
+
+	// fileNum is the number of the live manifest file, 0 until Load
+	fileNum  uint64
+	fileSize int64
+	// maxFileSize is the size of the log triggering its rewrite
+	maxFileSize int64
+	// pending collects changes applied in memory and not saved yet
+	pending VersionEdit
 }
 
 // ManifestData represents the manifest data
@@ -22,6 +35,7 @@ type ManifestData struct {
 	Levels       map[int][]TableInfo `json:"levels"`
 	Version      int                 `json:"version"`
 	PersistentID types.SeqN          `json:"persistent_id"`
+	LogNumber    uint64              `json:"log_number"`
 }
 
 // TableInfo represents information about an SSTable
@@ -35,7 +49,8 @@ type TableInfo struct {
 // NewManifest creates a new manifest
 func NewManifest(dataDir string) *Manifest {
 	return &Manifest{
-		filePath: filepath.Join(dataDir, "MANIFEST"),
+		dir:         dataDir,
+		maxFileSize: defaultMaxManifestSize,
 		metadata: ManifestData{
 			NextTableID: 1,
 			Levels:      make(map[int][]TableInfo),
@@ -44,105 +59,154 @@ func NewManifest(dataDir string) *Manifest {
 	}
 }
 
-// Load loads the manifest from disk
+// Load replays the manifest log pointed by CURRENT and starts a new log
+// holding the result. A JSON manifest of older versions is converted.
 func (m *Manifest) Load() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Check if manifest file exists
-	if _, err := os.Stat(m.filePath); os.IsNotExist(err) {
-		// Create new manifest
-		return m.save()
+	// the manifest is loaded once, later changes live in memory
+	if m.fileNum != 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(m.dir, 0750); err != nil {
+		return fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+
+	legacyPath := filepath.Join(m.dir, legacyManifestName)
+	current, err := os.ReadFile(filepath.Join(m.dir, currentFileName))
+	switch {
+	case err == nil:
+		num, err := parseManifestFileName(strings.TrimSpace(string(current)))
+		if err != nil {
+			return err
+		}
+		if err := readEdits(filepath.Join(m.dir, manifestFileName(num)), m.metadata.apply); err != nil {
+			return err
+		}
+		m.fileNum = num
+	case os.IsNotExist(err):
+		if err := m.loadLegacy(legacyPath); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("failed to read %s: %w", currentFileName, err)
+	}
+
+	// a new log drops replayed edits of removed tables and a torn tail
+	if err := m.rewrite(); err != nil {
+		return err
+	}
+	if err := os.Remove(legacyPath); err != nil && !os.IsNotExist(err) {
+		slog.Warn("failed to remove legacy manifest", "error", err)
 	}
+	return nil
+}
 
-	// Read manifest file
-	data, err := os.ReadFile(m.filePath)
+// loadLegacy reads the JSON manifest written by older versions if it exists
+func (m *Manifest) loadLegacy(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("failed to read manifest: %w", err)
 	}
 
-	// Parse JSON
 	if err := json.Unmarshal(data, &m.metadata); err != nil {
 		return fmt.Errorf("failed to parse manifest: %w", err)
 	}
-
+	// a manifest written before the first table holds null levels
+	if m.metadata.Levels == nil {
+		m.metadata.Levels = make(map[int][]TableInfo)
+	}
 	return nil
 }
 
-// Save saves the manifest to disk
+// Save appends changes made since the last save to the manifest log
 func (m *Manifest) Save() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return m.save()
+	return m.logEdit(&VersionEdit{})
 }
 
-// save saves the manifest to disk (internal method)
-func (m *Manifest) save() error {
-	// Ensure directory exists
-	dir := filepath.Dir(m.filePath)
-	if err := os.MkdirAll(dir, 0750); err != nil {
-		return fmt.Errorf("failed to create manifest directory: %w", err)
+// logEdit appends pending changes together with the edit as a single record
+// and applies the edit in memory
+func (m *Manifest) logEdit(edit *VersionEdit) error {
+	record := m.pending
+	record.Added = append(append([]TableInfo{}, m.pending.Added...), edit.Added...)
+	record.Removed = append(append([]TableRef{}, m.pending.Removed...), edit.Removed...)
+	if record.empty() {
+		return nil
+	}
+	if m.fileNum == 0 {
+		m.metadata.apply(edit)
+		return m.rewrite()
 	}
 
-	// Marshal to JSON
-	data, err := json.MarshalIndent(m.metadata, "", "  ")
+	data, err := encodeEdit(&record)
 	if err != nil {
-		return fmt.Errorf("failed to marshal manifest: %w", err)
+		return err
 	}
-
-	// Write to file with restrictive permissions
-	if err := os.WriteFile(m.filePath, data, 0600); err != nil {
-		return fmt.Errorf("failed to write manifest: %w", err)
+	if err := appendEdit(filepath.Join(m.dir, manifestFileName(m.fileNum)), data); err != nil {
+		return err
 	}
+	m.metadata.apply(edit)
+	m.fileSize += int64(len(data))
+	m.pending = VersionEdit{}
 
+	if m.fileSize > m.maxFileSize {
+		return m.rewrite()
+	}
 	return nil
 }
 
-// AddTable adds a table to the manifest
-func (m *Manifest) AddTable(
-	tableID uint64,
-	filePath string,
-	level int,
-	size int64,
-) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	// Add table info
-	tableInfo := TableInfo{
-		ID:       tableID,
-		FilePath: filePath,
-		Level:    level,
-		Size:     size,
+// rewrite writes the whole state as the first edit of a new manifest file,
+// switches CURRENT to it and removes the previous file
+func (m *Manifest) rewrite() error {
+	snapshot := VersionEdit{
+		NextTableID:  m.metadata.NextTableID,
+		PersistentID: m.metadata.PersistentID,
+		LogNumber:    m.metadata.LogNumber,
 	}
-
-	m.metadata.Levels[level] = append(m.metadata.Levels[level], tableInfo)
-
-	// Update next table ID
-	if tableID >= m.metadata.NextTableID {
-		m.metadata.NextTableID = tableID + 1
+	for _, tables := range m.metadata.Levels {
+		snapshot.Added = append(snapshot.Added, tables...)
 	}
-}
+	sort.Slice(snapshot.Added, func(i, j int) bool {
+		return snapshot.Added[i].ID < snapshot.Added[j].ID
+	})
 
-// RemoveTable removes a table from the manifest
-func (m *Manifest) RemoveTable(tableID uint64, level int) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	data, err := encodeEdit(&snapshot)
+	if err != nil {
+		return err
+	}
 
-	if level >= len(m.metadata.Levels) {
-		return fmt.Errorf("invalid level: %d", level)
+	num := m.fileNum + 1
+	name := manifestFileName(num)
+	if err := writeFileSync(filepath.Join(m.dir, name), data); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := setCurrent(m.dir, name); err != nil {
+		return err
 	}
 
-	// Find and remove table
-	tables := m.metadata.Levels[level]
-	for i, table := range tables {
-		if table.ID == tableID {
-			m.metadata.Levels[level] = append(tables[:i], tables[i+1:]...)
-			return m.save()
+	if m.fileNum != 0 {
+		if err := os.Remove(filepath.Join(m.dir, manifestFileName(m.fileNum))); err != nil {
+			slog.Warn("failed to remove old manifest", "error", err)
 		}
 	}
+	m.fileNum = num
+	m.fileSize = int64(len(data))
+	m.pending = VersionEdit{}
+	return nil
+}
 
-	return fmt.Errorf("table not found: %d", tableID)
+// LogEdit appends the edit together with pending changes to the manifest log
+func (m *Manifest) LogEdit(edit *VersionEdit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.logEdit(edit)
 }
 
 // GetTables returns all tables for a given level
@@ -179,6 +243,7 @@ func (m *Manifest) GetNextTableID() uint64 {
 
 	id := m.metadata.NextTableID
 	m.metadata.NextTableID++
+	m.pending.NextTableID = m.metadata.NextTableID
 	return id
 }
 
@@ -190,46 +255,6 @@ func (m *Manifest) GetLevelCount() int {
 	return len(m.metadata.Levels)
 }
 
-// CompactLevels performs compaction between levels
-func (m *Manifest) CompactLevels(fromLevel, toLevel int, tablesToRemove []uint64, newTables []TableInfo) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	// Remove old tables
-	for _, tableID := range tablesToRemove {
-		if err := m.removeTableFromLevel(tableID, fromLevel); err != nil {
-			return fmt.Errorf("failed to remove table %d: %w", tableID, err)
-		}
-	}
-
-	// Add new tables
-	for _, table := range newTables {
-		if m.metadata.Levels[table.Level] == nil {
-			m.metadata.Levels[table.Level] = make([]TableInfo, 0)
-		}
-		m.metadata.Levels[table.Level] = append(m.metadata.Levels[table.Level], table)
-	}
-
-	return m.save()
-}
-
-// removeTableFromLevel removes a table from a specific level
-func (m *Manifest) removeTableFromLevel(tableID uint64, level int) error {
-	if level >= len(m.metadata.Levels) {
-		return fmt.Errorf("invalid level: %d", level)
-	}
-
-	tables := m.metadata.Levels[level]
-	for i, table := range tables {
-		if table.ID == tableID {
-			m.metadata.Levels[level] = append(tables[:i], tables[i+1:]...)
-			return nil
-		}
-	}
-
-	return fmt.Errorf("table not found: %d", tableID)
-}
-
 // GetTableInfo returns information about a specific table
 func (m *Manifest) GetTableInfo(tableID uint64) (*TableInfo, error) {
 	m.mu.RLock()
@@ -279,17 +304,37 @@ func (m *Manifest) GetLevelSize(level int) int64 {
 }
 
 func (m *Manifest) UpdateMeta(items []SSTableItem) {
-	persistentID := m.metadata.PersistentID
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	for i := range items {
-		persistentID = max(persistentID, items[i].ID)
+		m.metadata.PersistentID = max(m.metadata.PersistentID, items[i].ID)
 	}
-
-	// TODO optimize lock
-	m.mu.RLock()
-	m.metadata.PersistentID = persistentID
-	m.mu.RUnlock()
+	m.pending.PersistentID = m.metadata.PersistentID
 }
 
 func (m *Manifest) PersistentID() types.SeqN {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return m.metadata.PersistentID
 }
+
+// SetLogNumber records that journal segments before logNum are not needed
+// for recovery, the change is persisted by the next save
+func (m *Manifest) SetLogNumber(logNum uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if logNum <= m.metadata.LogNumber {
+		return
+	}
+	m.metadata.LogNumber = logNum
+	m.pending.LogNumber = logNum
+}
+
+// LogNumber returns the journal segment recovery replays from
+func (m *Manifest) LogNumber() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.metadata.LogNumber
+}
@@ -0,0 +1,200 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"lsmdb/pkg/types"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Manifest log record layout:
+//
+//	crc32c(4) | payload length(4) | payload
+//
+// payload is a JSON encoded VersionEdit. The checksum covers the length
+// field and the payload. CURRENT holds the name of the live manifest file.
+const (
+	manifestHeaderSize = 4 + 4
+	currentFileName    = "CURRENT"
+	manifestFilePrefix = "MANIFEST-"
+	// legacyManifestName is the JSON manifest rewritten in place by older versions
+	legacyManifestName = "MANIFEST"
+
+	// defaultMaxManifestSize is the size of the manifest log triggering its rewrite
+	defaultMaxManifestSize = 4 << 20
+)
+
+// ErrManifestCorrupted is returned when a manifest record in the middle of the log is damaged
+var ErrManifestCorrupted = errors.New("corrupted manifest record")
+
+var manifestCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// VersionEdit is a single change of the set of live tables
+type VersionEdit struct {
+	Added        []TableInfo `json:"added,omitempty"`
+	Removed      []TableRef  `json:"removed,omitempty"`
+	NextTableID  uint64      `json:"next_table_id,omitempty"`
+	PersistentID types.SeqN  `json:"persistent_id,omitempty"`
+	LogNumber    uint64      `json:"log_number,omitempty"`
+}
+
+// TableRef identifies a table removed from a level
+type TableRef struct {
+	ID    uint64 `json:"id"`
+	Level int    `json:"level"`
+}
+
+func (e *VersionEdit) empty() bool {
+	return len(e.Added) == 0 && len(e.Removed) == 0 && e.NextTableID == 0 && e.PersistentID == 0 && e.LogNumber == 0
+}
+
+// apply replays the edit over the manifest data
+func (d *ManifestData) apply(edit *VersionEdit) {
+	for _, ref := range edit.Removed {
+		tables := d.Levels[ref.Level]
+		for i, table := range tables {
+			if table.ID == ref.ID {
+				d.Levels[ref.Level] = append(tables[:i:i], tables[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, table := range edit.Added {
+		d.Levels[table.Level] = append(d.Levels[table.Level], table)
+		d.NextTableID = max(d.NextTableID, table.ID+1)
+	}
+	d.NextTableID = max(d.NextTableID, edit.NextTableID)
+	d.PersistentID = max(d.PersistentID, edit.PersistentID)
+	d.LogNumber = max(d.LogNumber, edit.LogNumber)
+}
+
+func encodeEdit(edit *VersionEdit) ([]byte, error) {
+	payload, err := json.Marshal(edit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal version edit: %w", err)
+	}
+
+	record := make([]byte, manifestHeaderSize, manifestHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(payload)))
+	record = append(record, payload...)
+	binary.LittleEndian.PutUint32(record, crc32.Checksum(record[4:], manifestCRCTable))
+	return record, nil
+}
+
+// readEdits calls fn for every edit of the manifest file. A torn last record
+// left by a crash during append is dropped, damage before it is an error.
+func readEdits(path string, fn func(*VersionEdit)) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < manifestHeaderSize {
+			slog.Warn("dropping torn manifest record", "path", path, "offset", offset)
+			return nil
+		}
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		end := offset + manifestHeaderSize + size
+		if end > len(data) || end < offset {
+			slog.Warn("dropping torn manifest record", "path", path, "offset", offset)
+			return nil
+		}
+
+		checksum := binary.LittleEndian.Uint32(data[offset:])
+		if crc32.Checksum(data[offset+4:end], manifestCRCTable) != checksum {
+			if end == len(data) {
+				slog.Warn("dropping torn manifest record", "path", path, "offset", offset)
+				return nil
+			}
+			return fmt.Errorf("%w: checksum mismatch at offset %d", ErrManifestCorrupted, offset)
+		}
+
+		var edit VersionEdit
+		if err := json.Unmarshal(data[offset+manifestHeaderSize:end], &edit); err != nil {
+			return fmt.Errorf("%w: %v", ErrManifestCorrupted, err)
+		}
+		fn(&edit)
+		offset = end
+	}
+	return nil
+}
+
+// appendEdit appends the encoded edit to the manifest file and syncs it
+func appendEdit(path string, record []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(record); err != nil {
+		return fmt.Errorf("failed to append to manifest: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync manifest: %w", err)
+	}
+	return nil
+}
+
+func manifestFileName(num uint64) string {
+	return fmt.Sprintf("%s%06d", manifestFilePrefix, num)
+}
+
+func parseManifestFileName(name string) (uint64, error) {
+	num, err := strconv.ParseUint(strings.TrimPrefix(name, manifestFilePrefix), 10, 64)
+	if err != nil || !strings.HasPrefix(name, manifestFilePrefix) {
+		return 0, fmt.Errorf("invalid manifest name %q in %s", name, currentFileName)
+	}
+	return num, nil
+}
+
+// writeFileSync creates the file with the data and syncs it
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// setCurrent points CURRENT to the manifest file, the pointer is swapped
+// by rename so a crash leaves either the old or the new one
+func setCurrent(dir, name string) error {
+	tmp := filepath.Join(dir, currentFileName+".tmp")
+	if err := writeFileSync(tmp, []byte(name+"\n")); err != nil {
+		return fmt.Errorf("failed to write %s: %w", currentFileName, err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, currentFileName)); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", currentFileName, err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes renames and new files in the directory durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
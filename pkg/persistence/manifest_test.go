@@ -0,0 +1,175 @@
+package persistence
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadManifest(t *testing.T, dir string) *Manifest {
+	t.Helper()
+
+	m := NewManifest(dir)
+	if err := m.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	return m
+}
+
+func manifestPath(t *testing.T, dir string) string {
+	t.Helper()
+
+	current, err := os.ReadFile(filepath.Join(dir, currentFileName))
+	if err != nil {
+		t.Fatalf("failed to read CURRENT: %v", err)
+	}
+	return filepath.Join(dir, strings.TrimSpace(string(current)))
+}
+
+func logEdit(t *testing.T, m *Manifest, edit VersionEdit) {
+	t.Helper()
+
+	if err := m.LogEdit(&edit); err != nil {
+		t.Fatalf("LogEdit failed: %v", err)
+	}
+}
+
+func addTable(t *testing.T, m *Manifest, id uint64, path string) {
+	t.Helper()
+	logEdit(t, m, VersionEdit{Added: []TableInfo{{ID: id, FilePath: path, Size: 10}}})
+}
+
+func TestManifest_ReplaysEdits(t *testing.T) {
+	dir := t.TempDir()
+	m := loadManifest(t, dir)
+
+	var edit VersionEdit
+	for level, id := range []uint64{m.GetNextTableID(), m.GetNextTableID()} {
+		edit.Added = append(edit.Added, TableInfo{ID: id, FilePath: filepath.Join(dir, "table.sst"), Level: level, Size: 100})
+	}
+	m.UpdateMeta([]SSTableItem{{ID: 42}})
+	logEdit(t, m, edit)
+	logEdit(t, m, VersionEdit{
+		Added:   []TableInfo{{ID: 3, Level: 1, Size: 150}},
+		Removed: []TableRef{{ID: 1, Level: 0}, {ID: 2, Level: 1}},
+	})
+
+	reloaded := loadManifest(t, dir)
+	tables := reloaded.GetAllTables()
+	if len(tables[0]) != 0 || len(tables[1]) != 1 || tables[1][0].ID != 3 {
+		t.Fatalf("unexpected tables after reload: %+v", tables)
+	}
+	if reloaded.PersistentID() != 42 {
+		t.Fatalf("expected persistent ID 42, got %d", reloaded.PersistentID())
+	}
+	if id := reloaded.GetNextTableID(); id != 4 {
+		t.Fatalf("expected next table ID 4, got %d", id)
+	}
+}
+
+func TestManifest_TornTail(t *testing.T) {
+	dir := t.TempDir()
+	m := loadManifest(t, dir)
+	addTable(t, m, m.GetNextTableID(), "a.sst")
+
+	// a crash in the middle of an append leaves a part of the record
+	record, err := encodeEdit(&VersionEdit{Added: []TableInfo{{ID: 2, FilePath: "b.sst"}}})
+	if err != nil {
+		t.Fatalf("encodeEdit failed: %v", err)
+	}
+	if err := appendEdit(manifestPath(t, dir), record[:len(record)-3]); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+
+	tables := loadManifest(t, dir).GetAllTables()
+	if len(tables[0]) != 1 || tables[0][0].FilePath != "a.sst" {
+		t.Fatalf("unexpected tables after torn append: %+v", tables)
+	}
+}
+
+func TestManifest_CorruptedRecord(t *testing.T) {
+	dir := t.TempDir()
+	m := loadManifest(t, dir)
+	for i := 0; i < 2; i++ {
+		addTable(t, m, m.GetNextTableID(), "a.sst")
+	}
+
+	path := manifestPath(t, dir)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	// damage the first record, later ones are intact
+	data[manifestHeaderSize] ^= 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	if err := NewManifest(dir).Load(); !errors.Is(err, ErrManifestCorrupted) {
+		t.Fatalf("expected ErrManifestCorrupted, got %v", err)
+	}
+}
+
+func TestManifest_Rewrite(t *testing.T) {
+	dir := t.TempDir()
+	m := loadManifest(t, dir)
+	m.maxFileSize = 512
+
+	for i := 0; i < 50; i++ {
+		id := m.GetNextTableID()
+		addTable(t, m, id, "t.sst")
+		logEdit(t, m, VersionEdit{Removed: []TableRef{{ID: id, Level: 0}}})
+	}
+	addTable(t, m, m.GetNextTableID(), "last.sst")
+
+	info, err := os.Stat(manifestPath(t, dir))
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size() > m.maxFileSize {
+		t.Fatalf("manifest is not rewritten, size %d", info.Size())
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, manifestFilePrefix+"*")); len(files) != 1 {
+		t.Fatalf("old manifest files are left: %v", files)
+	}
+
+	tables := loadManifest(t, dir).GetAllTables()
+	if len(tables[0]) != 1 || tables[0][0].FilePath != "last.sst" {
+		t.Fatalf("unexpected tables after rewrite: %+v", tables)
+	}
+}
+
+func TestManifest_ConvertsLegacyJSON(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `{"next_table_id": 8, "levels": {"1": [{"id": 7, "file_path": "x.sst", "level": 1, "size": 5}]}, "version": 1, "persistent_id": 99}`
+	if err := os.WriteFile(filepath.Join(dir, legacyManifestName), []byte(legacy), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	m := loadManifest(t, dir)
+	if tables := m.GetAllTables(); len(tables[1]) != 1 || tables[1][0].ID != 7 || m.PersistentID() != 99 {
+		t.Fatalf("legacy manifest is not converted: %+v", tables)
+	}
+	if _, err := os.Stat(filepath.Join(dir, legacyManifestName)); !os.IsNotExist(err) {
+		t.Fatal("legacy manifest must be removed after conversion")
+	}
+	if id := loadManifest(t, dir).GetNextTableID(); id != 8 {
+		t.Fatalf("expected next table ID 8, got %d", id)
+	}
+}
+
+func TestManifest_ConvertsLegacyJSONWithoutLevels(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `{"next_table_id": 1, "levels": null, "version": 1, "persistent_id": 5}`
+	if err := os.WriteFile(filepath.Join(dir, legacyManifestName), []byte(legacy), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	m := loadManifest(t, dir)
+	logEdit(t, m, VersionEdit{Added: []TableInfo{{ID: m.GetNextTableID(), Level: 0, Size: 100}}})
+	if tables := loadManifest(t, dir).GetAllTables(); len(tables[0]) != 1 || tables[0][0].ID != 1 {
+		t.Fatalf("unexpected tables after reload: %+v", tables)
+	}
+}
@@ -0,0 +1,126 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"lsmdb/pkg/config"
+)
+
+// PrefixExtractor maps keys to the prefixes a table prefix filter holds.
+// If Extract returns a prefix for a key, it returns the same prefix
+// for every key starting with that key, so a prefix scan is checked
+// against the filter by extracting from the scanned prefix itself.
+type PrefixExtractor interface {
+	// Name identifies the extractor, filters built by another extractor are ignored
+	Name() string
+	// Extract returns the prefix of the key, false if the key has none
+	Extract(key []byte) ([]byte, bool)
+}
+
+// NewPrefixExtractor creates the extractor of the config, nil if none is configured
+func NewPrefixExtractor(cfg config.PrefixExtractorConfig) PrefixExtractor {
+	switch {
+	case cfg.Length > 0:
+		return fixedPrefix(cfg.Length)
+	case cfg.Delimiter != "":
+		return delimiterPrefix(cfg.Delimiter)
+	default:
+		return nil
+	}
+}
+
+// fixedPrefix extracts the first n bytes, shorter keys have no prefix
+type fixedPrefix int
+
+func (p fixedPrefix) Name() string {
+	return "fixed:" + strconv.Itoa(int(p))
+}
+
+func (p fixedPrefix) Extract(key []byte) ([]byte, bool) {
+	if len(key) < int(p) {
+		return nil, false
+	}
+	return key[:p], true
+}
+
+// delimiterPrefix extracts the key up to and including the first delimiter,
+// keys without the delimiter have no prefix
+type delimiterPrefix string
+
+func (p delimiterPrefix) Name() string {
+	return "delimiter:" + string(p)
+}
+
+func (p delimiterPrefix) Extract(key []byte) ([]byte, bool) {
+	i := bytes.Index(key, []byte(p))
+	if i < 0 {
+		return nil, false
+	}
+	return key[:i+len(p)], true
+}
+
+// prefixFilter is a bloom filter over prefixes of the table keys
+type prefixFilter struct {
+	extractor string
+	bloom     BloomFilter
+}
+
+// buildPrefixFilter adds distinct prefixes of sorted items to a new filter,
+// nil if no key has a prefix
+func buildPrefixFilter(extractor PrefixExtractor, items []SSTableItem, bitsPerKey int) *prefixFilter {
+	// keys sharing a prefix are adjacent in sorted order
+	var prefixes [][]byte
+	for i := range items {
+		prefix, ok := extractor.Extract(items[i].Key)
+		if !ok || len(prefixes) > 0 && bytes.Equal(prefixes[len(prefixes)-1], prefix) {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+
+	bloom := NewBloomFilter(uint32(len(prefixes)), bitsPerKey)
+	for _, prefix := range prefixes {
+		bloom.Add(prefix)
+	}
+	return &prefixFilter{extractor: extractor.Name(), bloom: bloom}
+}
+
+// mayContain reports whether the table may hold keys starting with prefix
+func (pf *prefixFilter) mayContain(extractor PrefixExtractor, prefix []byte) bool {
+	if pf == nil || extractor == nil || extractor.Name() != pf.extractor {
+		return true
+	}
+	extracted, ok := extractor.Extract(prefix)
+	if !ok {
+		return true
+	}
+	return pf.bloom.MayContain(extracted)
+}
+
+// encode serializes the filter as nameLen(4) | extractor name | bloom filter
+func (pf *prefixFilter) encode() []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(pf.extractor)))
+	buf = append(buf, pf.extractor...)
+	return append(buf, pf.bloom.Encode()...)
+}
+
+func decodePrefixFilter(data []byte) (*prefixFilter, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("prefix filter header is truncated: %w", ErrCorruptedData)
+	}
+	nameLen := int(binary.LittleEndian.Uint32(data))
+	if len(data) < 4+nameLen {
+		return nil, fmt.Errorf("prefix filter name is truncated: %w", ErrCorruptedData)
+	}
+	bloom, err := DecodeBloomFilter(data[4+nameLen:])
+	if err != nil {
+		return nil, err
+	}
+	return &prefixFilter{extractor: string(data[4 : 4+nameLen]), bloom: bloom}, nil
+}
@@ -0,0 +1,61 @@
+package persistence
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLevelManager_PrefixFilterSkipsTables(t *testing.T) {
+	lm := newTestLevelManager(t)
+	lm.prefix = delimiterPrefix("/")
+
+	seq := uint64(0)
+	var tables []*SSTable
+	for _, tenant := range []string{"tenant1/", "tenant2/"} {
+		items := make([]SSTableItem, 0)
+		for i := 0; i < 10; i++ {
+			seq++
+			items = append(items, SSTableItem{
+				Key:   []byte(fmt.Sprintf("%skey%02d", tenant, i)),
+				Value: []byte("value"),
+				ID:    seq,
+			})
+		}
+		tables = append(tables, addL0Table(t, lm, items))
+	}
+
+	for _, tc := range []struct {
+		prefix string
+		tables int
+	}{
+		{"tenant1/", 1},
+		{"tenant2/key0", 1},
+		{"tenant3/", 0},
+		// no delimiter, so the filter cannot rule out any table
+		{"tenant", 2},
+		{"", 2},
+	} {
+		iters := lm.PrefixIterators([]byte(tc.prefix))
+		if len(iters) != tc.tables {
+			t.Errorf("prefix %q: expected %d tables, got %d", tc.prefix, tc.tables, len(iters))
+		}
+		for _, it := range iters {
+			if err := it.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+		}
+	}
+
+	// the filter is read back from the table file
+	reopened := NewSSTable(tables[0].ID(), tables[0].GetFilePath(), nil, nil)
+	if err := reopened.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer reopened.Close()
+	if reopened.MayContainPrefix(lm.prefix, []byte("tenant2/")) {
+		t.Fatal("reopened prefix filter does not rule out another tenant")
+	}
+	if !reopened.MayContainPrefix(fixedPrefix(8), []byte("tenant2/")) {
+		t.Fatal("a filter built by another extractor must not rule out tables")
+	}
+}
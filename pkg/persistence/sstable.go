@@ -1,15 +1,15 @@
 package persistence
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
+	"math"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,11 +24,15 @@ type SSTableItem struct {
 type BloomFilter interface {
 	Add(key []byte)
 	MayContain(key []byte) bool
+	// Encode serializes the filter into the table filter block
+	Encode() []byte
 }
 
+// BlockCache keeps raw data blocks shared by all tables of the tree
 type BlockCache interface {
-	Get(key string) ([]byte, bool)
-	Set(key string, value []byte)
+	Get(key BlockKey) ([]byte, bool)
+	Set(key BlockKey, value []byte)
+	Stats() CacheStats
 }
 
 type IndexEntry struct {
@@ -43,28 +47,64 @@ type SSTableMeta struct {
 	NumKeys     int
 	ApproxBytes int64
 	CreatedAt   time.Time
+	MaxSeqN     uint64
+	Smallest    []byte
+	Largest     []byte
 }
 
 type SSTable struct {
+	id       uint64
 	filePath string
 	reader   *os.File
 
-	bloom      BloomFilter
-	blockIndex []IndexEntry
+	bloom       BloomFilter
+	filterBlock blockHandle
+	// prefixFilter is nil for tables written without a prefix extractor
+	prefixFilter      *prefixFilter
+	prefixFilterBlock blockHandle
+	blockIndex        []IndexEntry
+	meta              SSTableMeta
 
 	cache BlockCache
-	mu    sync.RWMutex
+	// files closes the file of the table while it is not read, nil keeps it open
+	files *TableCache
+	// size is the file size read on Open
+	size int64
+	// mu guards the file handle lifecycle. Reads are positional (ReadAt),
+	// so readers share RLock. Index, filter and meta are immutable once opened.
+	mu sync.RWMutex
+
+	// refs counts the level manager and every open iterator,
+	// an obsolete table file is removed when the last reference is gone
+	refs     atomic.Int64
+	obsolete atomic.Bool
 }
 
-func NewSSTable(path string, bloom BloomFilter, cache BlockCache) *SSTable {
-	return &SSTable{
+// NewSSTable creates a table handle. bloom is filled by WriteSSTableData
+// for new tables, existing tables load their filter on Open.
+func NewSSTable(id uint64, path string, bloom BloomFilter, cache BlockCache) *SSTable {
+	s := &SSTable{
+		id:       id,
 		filePath: path,
 		bloom:    bloom,
 		cache:    cache,
 	}
+	s.refs.Store(1)
+	return s
 }
 
+// Open opens the table file and loads the index and the filter
 func (s *SSTable) Open() error {
+	if err := s.open(); err != nil {
+		return err
+	}
+	if s.files != nil {
+		s.files.add(s)
+	}
+	return nil
+}
+
+func (s *SSTable) open() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -80,6 +120,7 @@ func (s *SSTable) Open() error {
 		if cerr := file.Close(); cerr != nil {
 			slog.Warn("failed to close sstable file after LoadIndex error", "path", s.filePath, "error", cerr)
 		}
+		s.reader = nil
 		return fmt.Errorf("failed to load index: %w", err)
 	}
 
@@ -88,319 +129,313 @@ func (s *SSTable) Open() error {
 		if cerr := file.Close(); cerr != nil {
 			slog.Warn("failed to close sstable file after LoadBloomFilter error", "path", s.filePath, "error", cerr)
 		}
+		s.reader = nil
 		return fmt.Errorf("failed to load bloom filter: %w", err)
 	}
 
 	return nil
 }
 
+// Close closes the table file, it is not reopened by the table cache
 func (s *SSTable) Close() error {
+	if s.files != nil {
+		s.files.remove(s)
+	}
+	return s.closeFile()
+}
+
+func (s *SSTable) closeFile() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.reader == nil {
+		return nil
+	}
+
+	// readers hold RLock, so no ReadAt is in flight here
+	err := s.reader.Close()
+	s.reader = nil
+	return err
+}
+
+// reopen opens the file closed by the table cache
+func (s *SSTable) reopen() error {
+	s.mu.Lock()
 	if s.reader != nil {
-		return s.reader.Close()
+		s.mu.Unlock()
+		return nil
+	}
+	file, err := os.Open(s.filePath)
+	if err != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("failed to reopen SSTable file: %w", err)
 	}
+	s.reader = file
+	s.mu.Unlock()
+
+	s.files.add(s)
 	return nil
 }
 
+// LoadIndex reads the footer, the meta block and the index block.
+// Data blocks are not touched, so opening a table costs O(index).
 func (s *SSTable) LoadIndex() error {
-	const (
-		sizeFieldSize = 4
-		seqNumSize    = 8
-		metaSize      = 8
-	)
-
 	if s.reader == nil {
 		return fmt.Errorf("SSTable file not open")
 	}
 
-	// Получаем размер файла
 	fileInfo, err := s.reader.Stat()
 	if err != nil {
 		return fmt.Errorf("failed to stat file: %w", err)
 	}
-	fileSize := fileInfo.Size()
-	if fileSize < 4 {
-		return fmt.Errorf("file too small to contain index size")
-	}
 
-	// Read index size (4 bytes at the end of the file)
-	var (
-		indexSize uint32
-	)
-	_, err = s.reader.Seek(fileSize-sizeFieldSize, io.SeekStart)
+	f, err := readFooter(s.reader, fileInfo.Size())
 	if err != nil {
-		return fmt.Errorf("failed to seek to index size: %w", err)
+		return err
 	}
-	err = binary.Read(s.reader, binary.LittleEndian, &indexSize)
+
+	metaData, err := readBlock(s.reader, f.meta)
 	if err != nil {
-		return fmt.Errorf("failed to read index size: %w", err)
+		return fmt.Errorf("failed to read meta block: %w", err)
 	}
-	// simple index size validation
-	if int64(indexSize) > fileSize-sizeFieldSize {
-		return fmt.Errorf("invalid index size")
+	meta, err := decodeMeta(metaData)
+	if err != nil {
+		return fmt.Errorf("failed to decode meta block: %w", err)
 	}
 
-	// reset file pointer to the beginning
-	_, err = s.reader.Seek(0, io.SeekStart)
+	indexData, err := readBlock(s.reader, f.index)
 	if err != nil {
-		return fmt.Errorf("failed to seek file: %w", err)
+		return fmt.Errorf("failed to read index block: %w", err)
+	}
+	index, err := decodeIndex(indexData)
+	if err != nil {
+		return fmt.Errorf("failed to decode index block: %w", err)
+	}
+	if len(index) != meta.NumBlocks {
+		return fmt.Errorf("index has %d blocks, meta expects %d: %w", len(index), meta.NumBlocks, ErrCorruptedData)
 	}
 
-	// Read index entries until reaching indexOffsetR
-	var (
-		indexOffsetR = fileSize - sizeFieldSize - int64(indexSize)
-		reader       = bufio.NewReader(s.reader)
-
-		blockIndexSz, offset int64
-		lenBuff              [4]byte
-	)
-	for offset < indexOffsetR {
-		n, err := io.ReadFull(reader, lenBuff[:])
-		if err != nil {
-			if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
-				break
-			}
-			return fmt.Errorf("failed to read key length: %w", err)
-		}
-		if n != 4 {
-			break
-		}
-		keyLen := binary.LittleEndian.Uint32(lenBuff[:])
-
-		key := make([]byte, keyLen)
-		n, err = io.ReadFull(reader, key)
-		if err != nil {
-			return fmt.Errorf("failed to read key: %w", err)
-		}
-		if n != int(keyLen) {
-			break
-		}
+	s.meta = meta
+	s.size = fileInfo.Size()
+	s.blockIndex = index
+	s.filterBlock = f.filter
+	s.prefixFilterBlock = f.prefixFilter
+	return nil
+}
 
-		n, err = io.ReadFull(reader, lenBuff[:])
-		if err != nil {
-			return fmt.Errorf("failed to read value length: %w", err)
-		}
-		if n != 4 {
-			break
-		}
-		valueLen := binary.LittleEndian.Uint32(lenBuff[:])
+// LoadBloomFilter reads the filter blocks located by LoadIndex.
+// Tables written without a filter are left unfiltered.
+func (s *SSTable) LoadBloomFilter() error {
+	if err := s.loadPrefixFilter(); err != nil {
+		return err
+	}
+	if s.filterBlock.size == 0 {
+		s.bloom = nil
+		return nil
+	}
 
-		blockSize := 4 + int(keyLen) + 4 + int(valueLen) + 8 + 8
+	data, err := readBlock(s.reader, s.filterBlock)
+	if err != nil {
+		return fmt.Errorf("failed to read filter block: %w", err)
+	}
+	bloom, err := DecodeBloomFilter(data)
+	if err != nil {
+		return fmt.Errorf("failed to decode filter block: %w", err)
+	}
 
-		s.blockIndex = append(s.blockIndex, IndexEntry{
-			Key:         key,
-			BlockOffset: offset,
-			BlockSize:   blockSize,
-			BlockInd:    int(blockIndexSz),
-		})
+	s.bloom = bloom
+	return nil
+}
 
-		skip := int(valueLen) + seqNumSize + metaSize
-		skipped, err := reader.Discard(skip)
-		if err != nil {
-			return fmt.Errorf("failed to skip to next entry: %w", err)
-		}
-		if skipped != skip {
-			break
-		}
+func (s *SSTable) loadPrefixFilter() error {
+	if s.prefixFilterBlock.size == 0 {
+		s.prefixFilter = nil
+		return nil
+	}
 
-		offset += int64(blockSize)
-		blockIndexSz++
+	data, err := readBlock(s.reader, s.prefixFilterBlock)
+	if err != nil {
+		return fmt.Errorf("failed to read prefix filter block: %w", err)
+	}
+	filter, err := decodePrefixFilter(data)
+	if err != nil {
+		return fmt.Errorf("failed to decode prefix filter block: %w", err)
 	}
 
+	s.prefixFilter = filter
 	return nil
 }
 
-func (s *SSTable) LoadBloomFilter() error {
-	// For now, just create an empty bloom filter
-	// In a real implementation, this would load from file
-	return nil
+// MayContainPrefix reports whether the table may hold keys starting with prefix.
+// Tables without a prefix filter built by the extractor may hold any prefix.
+func (s *SSTable) MayContainPrefix(extractor PrefixExtractor, prefix []byte) bool {
+	return s.prefixFilter.mayContain(extractor, prefix)
 }
 
-func (s *SSTable) HasKey(key []byte) (bool, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// Meta returns table properties read from the meta block
+func (s *SSTable) Meta() SSTableMeta {
+	return s.meta
+}
 
-	if s.bloom != nil {
-		if !s.bloom.MayContain(key) {
-			return false, nil
+// readDataBlock reads and decodes the data block described by the index entry.
+// Verified raw blocks are kept in the block cache keyed by table ID and offset.
+func (s *SSTable) readDataBlock(entry IndexEntry) ([]SSTableItem, error) {
+	cacheKey := BlockKey{TableID: s.id, Offset: entry.BlockOffset}
+	if s.cache != nil {
+		if data, ok := s.cache.Get(cacheKey); ok {
+			return decodeBlock(data)
 		}
 	}
 
-	// Simple key search in file
-	if s.reader == nil {
-		return false, fmt.Errorf("SSTable file not open")
-	}
-
-	// Read the file and search for key
-	_, err := s.reader.Seek(0, 0)
+	data, err := s.readBlock(blockHandle{offset: entry.BlockOffset, size: entry.BlockSize})
 	if err != nil {
-		return false, fmt.Errorf("failed to seek file: %w", err)
+		return nil, err
 	}
+	if s.cache != nil {
+		s.cache.Set(cacheKey, data)
+	}
+	return decodeBlock(data)
+}
 
-	reader := bufio.NewReader(s.reader)
+// readBlock reads the block from the file, reopening it if the table cache closed it
+func (s *SSTable) readBlock(h blockHandle) ([]byte, error) {
 	for {
-		// Read key length
-		keyLenBytes := make([]byte, 4)
-		_, err := reader.Read(keyLenBytes)
-		if err != nil {
-			if err == io.EOF {
-				break
+		s.mu.RLock()
+		if s.reader != nil {
+			data, err := readBlock(s.reader, h)
+			s.mu.RUnlock()
+			if s.files != nil {
+				s.files.touch(s)
 			}
-			return false, fmt.Errorf("failed to read key length: %w", err)
+			return data, err
 		}
-		keyLen := binary.LittleEndian.Uint32(keyLenBytes)
+		s.mu.RUnlock()
 
-		// Read key
-		fileKey := make([]byte, keyLen)
-		_, err = reader.Read(fileKey)
-		if err != nil {
-			return false, fmt.Errorf("failed to read key: %w", err)
-		}
-
-		// Compare keys
-		if bytes.Equal(key, fileKey) {
-			return true, nil
+		if s.files == nil {
+			return nil, fmt.Errorf("SSTable file not open")
 		}
-
-		// Read value length
-		valueLenBytes := make([]byte, 4)
-		_, err = reader.Read(valueLenBytes)
-		if err != nil {
-			return false, fmt.Errorf("failed to read value length: %w", err)
-		}
-		valueLen := binary.LittleEndian.Uint32(valueLenBytes)
-
-		// Skip value
-		_, err = reader.Discard(int(valueLen))
-		if err != nil {
-			return false, fmt.Errorf("failed to skip value: %w", err)
+		if err := s.reopen(); err != nil {
+			return nil, err
 		}
+	}
+}
 
-		// Skip sequence number and metadata
-		skipBytes := make([]byte, 8+8) // 8 bytes for seq, 8 for meta
-		_, err = reader.Read(skipBytes)
-		if err != nil {
-			return false, fmt.Errorf("failed to skip metadata: %w", err)
+func (s *SSTable) HasKey(key []byte) (bool, error) {
+	item, err := s.Get(key)
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return false, nil
 		}
+		return false, err
 	}
-
-	return false, nil
+	return item != nil, nil
 }
 
+// Get returns the newest version of the key
 func (s *SSTable) Get(key []byte) (*SSTableItem, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	return s.GetAt(key, math.MaxUint64)
+}
 
+// GetAt returns the newest version of the key with sequence number not greater than seqN
+func (s *SSTable) GetAt(key []byte, seqN uint64) (*SSTableItem, error) {
 	if s.bloom != nil {
 		if !s.bloom.MayContain(key) {
-			return nil, fmt.Errorf("key not found")
+			return nil, ErrKeyNotFound
 		}
 	}
 
-	// Simple key search in file
-	if s.reader == nil {
-		return nil, fmt.Errorf("SSTable file not open")
-	}
-
-	// Read the file and search for key
-	_, err := s.reader.Seek(0, 0)
-	if err != nil {
-		return nil, fmt.Errorf("failed to seek file: %w", err)
-	}
-
-	reader := bufio.NewReader(s.reader)
-	for {
-		// Read key length
-		keyLenBytes := make([]byte, 4)
-		_, err := reader.Read(keyLenBytes)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, fmt.Errorf("failed to read key length: %w", err)
-		}
-		keyLen := binary.LittleEndian.Uint32(keyLenBytes)
-
-		// Read key
-		fileKey := make([]byte, keyLen)
-		_, err = reader.Read(fileKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read key: %w", err)
-		}
-
-		// Read value length
-		valueLenBytes := make([]byte, 4)
-		_, err = reader.Read(valueLenBytes)
+	// the first block whose largest key is not less than key may hold it,
+	// older versions may continue in the next blocks
+	block := sort.Search(len(s.blockIndex), func(i int) bool {
+		return bytes.Compare(s.blockIndex[i].Key, key) >= 0
+	})
+	for ; block < len(s.blockIndex); block++ {
+		items, err := s.readDataBlock(s.blockIndex[block])
 		if err != nil {
-			return nil, fmt.Errorf("failed to read value length: %w", err)
+			return nil, fmt.Errorf("failed to read data block: %w", err)
 		}
-		valueLen := binary.LittleEndian.Uint32(valueLenBytes)
 
-		// Read value
-		value := make([]byte, valueLen)
-		_, err = reader.Read(value)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read value: %w", err)
-		}
-
-		// Read sequence number
-		seqBytes := make([]byte, 8)
-		_, err = reader.Read(seqBytes)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read sequence: %w", err)
-		}
-
-		// Read metadata
-		metaBytes := make([]byte, 8)
-		_, err = reader.Read(metaBytes)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read metadata: %w", err)
-		}
-		meta := binary.LittleEndian.Uint64(metaBytes)
-
-		// Compare keys
-		if bytes.Equal(key, fileKey) {
-			return &SSTableItem{
-				Key:   fileKey,
-				Value: value,
-				Meta:  meta,
-			}, nil
+		i := sort.Search(len(items), func(i int) bool {
+			return bytes.Compare(items[i].Key, key) >= 0
+		})
+		for ; i < len(items); i++ {
+			if !bytes.Equal(items[i].Key, key) {
+				return nil, ErrKeyNotFound
+			}
+			if items[i].ID <= seqN {
+				return &items[i], nil
+			}
 		}
 	}
 
-	return nil, fmt.Errorf("key not found")
+	return nil, ErrKeyNotFound
 }
 
 // Iterator creates an iterator for the SSTable
 func (s *SSTable) Iterator() *SSTableIterator {
-	return &SSTableIterator{
-		sstable: s,
-		reader:  s.reader,
-	}
+	return s.NewIterator()
 }
 
-// NewIterator creates a new iterator
+// NewIterator creates a new iterator.
+// The table is pinned until the iterator is closed.
 func (s *SSTable) NewIterator() *SSTableIterator {
+	s.Ref()
 	return &SSTableIterator{
 		sstable: s,
-		reader:  s.reader,
+		block:   len(s.blockIndex),
 	}
 }
 
-// ApproximateSize returns the approximate size of the SSTable
-func (s *SSTable) ApproximateSize() int64 {
-	if s.reader == nil {
-		return 0
+// Ref pins the table so its file is not removed while it is being read
+func (s *SSTable) Ref() {
+	s.refs.Add(1)
+}
+
+// Unref releases a reference. The last one closes the table
+// and removes its file if the table was marked obsolete.
+func (s *SSTable) Unref() {
+	if s.refs.Add(-1) > 0 {
+		return
 	}
 
-	fileInfo, err := s.reader.Stat()
-	if err != nil {
-		return 0
+	if err := s.Close(); err != nil {
+		slog.Warn("failed to close released SSTable", "path", s.filePath, "error", err)
+	}
+	if s.obsolete.Load() {
+		if err := os.Remove(s.filePath); err != nil && !os.IsNotExist(err) {
+			slog.Warn("failed to remove obsolete SSTable", "path", s.filePath, "error", err)
+		}
 	}
+}
 
-	return fileInfo.Size()
+// markObsolete schedules removal of the table file once it is unreferenced
+func (s *SSTable) markObsolete() {
+	s.obsolete.Store(true)
+}
+
+// ID returns the table id assigned by the manifest
+func (s *SSTable) ID() uint64 {
+	return s.id
+}
+
+// Smallest returns the smallest key stored in the table
+func (s *SSTable) Smallest() []byte {
+	return s.meta.Smallest
+}
+
+// Largest returns the largest key stored in the table
+func (s *SSTable) Largest() []byte {
+	return s.meta.Largest
+}
+
+// overlaps checks if the table key range intersects [smallest, largest]
+func (s *SSTable) overlaps(smallest, largest []byte) bool {
+	return bytes.Compare(s.Smallest(), largest) <= 0 && bytes.Compare(s.Largest(), smallest) >= 0
+}
+
+// ApproximateSize returns the approximate size of the SSTable
+func (s *SSTable) ApproximateSize() int64 {
+	return s.size
 }
 
 // GetFilePath returns the file path of the SSTable
@@ -408,110 +443,103 @@ func (s *SSTable) GetFilePath() string {
 	return s.filePath
 }
 
-// SSTableIterator iterates over SSTable entries
+// SSTableIterator iterates over SSTable entries block by block
 type SSTableIterator struct {
 	sstable *SSTable
-	reader  *os.File
-	key     []byte
-	value   []byte
-	meta    uint64
+	block   int
+	items   []SSTableItem
+	pos     int
 	err     error
+	closed  bool
 }
 
 // First moves to the first entry
 func (it *SSTableIterator) First() {
-	if _, err := it.reader.Seek(0, 0); err != nil {
-		it.err = err
-		return
-	}
-	it.Next()
+	it.loadBlock(0)
+	it.pos = 0
+	it.skipEmpty()
+}
+
+// Seek moves to the first entry with key greater than or equal to key
+func (it *SSTableIterator) Seek(key []byte) {
+	index := it.sstable.blockIndex
+	it.loadBlock(sort.Search(len(index), func(i int) bool {
+		return bytes.Compare(index[i].Key, key) >= 0
+	}))
+	it.pos = sort.Search(len(it.items), func(i int) bool {
+		return bytes.Compare(it.items[i].Key, key) >= 0
+	})
+	it.skipEmpty()
 }
 
 // Next moves to the next entry
 func (it *SSTableIterator) Next() {
-	if it.reader == nil {
-		it.err = fmt.Errorf("reader not available")
-		return
-	}
-
-	// Read key length
-	keyLenBytes := make([]byte, 4)
-	_, err := it.reader.Read(keyLenBytes)
-	if err != nil {
-		if err == io.EOF {
-			it.key = nil
-			it.value = nil
-			return
-		}
-		it.err = err
-		return
-	}
-	keyLen := binary.LittleEndian.Uint32(keyLenBytes)
-
-	// Read key
-	it.key = make([]byte, keyLen)
-	_, err = it.reader.Read(it.key)
-	if err != nil {
-		it.err = err
+	if !it.Valid() {
 		return
 	}
+	it.pos++
+	it.skipEmpty()
+}
 
-	// Read value length
-	valueLenBytes := make([]byte, 4)
-	_, err = it.reader.Read(valueLenBytes)
-	if err != nil {
-		it.err = err
-		return
-	}
-	valueLen := binary.LittleEndian.Uint32(valueLenBytes)
-
-	// Read value
-	it.value = make([]byte, valueLen)
-	_, err = it.reader.Read(it.value)
-	if err != nil {
-		it.err = err
-		return
+// skipEmpty moves to the following blocks while the current one is exhausted
+func (it *SSTableIterator) skipEmpty() {
+	for it.err == nil && it.pos >= len(it.items) && it.block < len(it.sstable.blockIndex) {
+		it.loadBlock(it.block + 1)
+		it.pos = 0
 	}
+}
 
-	// Read sequence number
-	seqBytes := make([]byte, 8)
-	_, err = it.reader.Read(seqBytes)
-	if err != nil {
-		it.err = err
+func (it *SSTableIterator) loadBlock(block int) {
+	it.block = block
+	it.items = nil
+	if it.err != nil || block < 0 || block >= len(it.sstable.blockIndex) {
 		return
 	}
 
-	// Read metadata
-	metaBytes := make([]byte, 8)
-	_, err = it.reader.Read(metaBytes)
+	items, err := it.sstable.readDataBlock(it.sstable.blockIndex[block])
 	if err != nil {
 		it.err = err
 		return
 	}
-	it.meta = binary.LittleEndian.Uint64(metaBytes)
+	it.items = items
 }
 
 // Valid checks if the iterator is valid
 func (it *SSTableIterator) Valid() bool {
-	return it.key != nil && it.err == nil
+	return it.err == nil && it.pos < len(it.items)
 }
 
 // Key returns the current key
 func (it *SSTableIterator) Key() []byte {
-	return it.key
+	return it.items[it.pos].Key
 }
 
 // Value returns the current value
 func (it *SSTableIterator) Value() []byte {
-	return it.value
+	return it.items[it.pos].Value
+}
+
+// SeqN returns the sequence number of the current entry
+func (it *SSTableIterator) SeqN() uint64 {
+	return it.items[it.pos].ID
 }
 
 // Meta returns the current metadata
 func (it *SSTableIterator) Meta() uint64 {
-	return it.meta
+	return it.items[it.pos].Meta
 }
 
-// Close closes the iterator
+// Error returns the last read error
+func (it *SSTableIterator) Error() error {
+	return it.err
+}
+
+// Close closes the iterator and unpins the table
 func (it *SSTableIterator) Close() error {
+	if !it.closed {
+		it.closed = true
+		it.items = nil
+		it.sstable.Unref()
+	}
 	return nil
 }
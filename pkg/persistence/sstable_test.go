@@ -0,0 +1,330 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"lsmdb/pkg/config"
+)
+
+func writeTestTable(t *testing.T, lm *LevelManager, n int) *SSTable {
+	t.Helper()
+
+	items := make([]SSTableItem, 0, n)
+	for i := 0; i < n; i++ {
+		items = append(items, SSTableItem{
+			Key:   []byte(fmt.Sprintf("key%05d", i)),
+			Value: []byte(fmt.Sprintf("value%d", i)),
+			ID:    uint64(i + 1),
+			Meta:  uint64(i % 3),
+		})
+	}
+
+	filePath := fmt.Sprintf("%s/table.sst", lm.cfg.RootPath)
+	table := NewSSTable(1, filePath, NewBloomFilter(uint32(n), 10), NewBlockCache(1<<20, 1))
+	if err := lm.WriteSSTableData(table, items); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+	if err := table.Open(); err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	t.Cleanup(func() { _ = table.Close() })
+	return table
+}
+
+func TestSSTable_BlockFormat(t *testing.T) {
+	lm := newTestLevelManager(t)
+	lm.cfg.SSTable.BlockSize = 256
+
+	table := writeTestTable(t, lm, 500)
+
+	meta := table.Meta()
+	if meta.NumKeys != 500 || meta.NumBlocks < 2 || meta.NumBlocks != len(table.blockIndex) {
+		t.Fatalf("unexpected table meta: %+v", meta)
+	}
+	if string(table.Smallest()) != "key00000" || string(table.Largest()) != "key00499" {
+		t.Fatalf("unexpected key range: %s - %s", table.Smallest(), table.Largest())
+	}
+	if meta.MaxSeqN != 500 {
+		t.Fatalf("expected max seq 500, got %d", meta.MaxSeqN)
+	}
+
+	for i := 0; i < 500; i++ {
+		item, err := table.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if err != nil {
+			t.Fatalf("Get key%05d failed: %v", i, err)
+		}
+		if string(item.Value) != fmt.Sprintf("value%d", i) || item.ID != uint64(i+1) || item.Meta != uint64(i%3) {
+			t.Fatalf("unexpected item: %+v", item)
+		}
+	}
+	if _, err := table.Get([]byte("key99999")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	it := table.NewIterator()
+	defer it.Close()
+
+	count := 0
+	for it.First(); it.Valid(); it.Next() {
+		count++
+	}
+	if it.Error() != nil || count != 500 {
+		t.Fatalf("iterated over %d records: %v", count, it.Error())
+	}
+
+	it.Seek([]byte("key00250a"))
+	if !it.Valid() || string(it.Key()) != "key00251" {
+		t.Fatalf("Seek landed on a wrong key: %s", it.Key())
+	}
+}
+
+func TestSSTable_OpenRejectsCorruptedFile(t *testing.T) {
+	lm := newTestLevelManager(t)
+	table := writeTestTable(t, lm, 10)
+	path := table.GetFilePath()
+	if err := table.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	// broken magic number
+	broken := append([]byte{}, data...)
+	broken[len(broken)-1] ^= 0xff
+	if err := os.WriteFile(path, broken, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := NewSSTable(1, path, nil, nil).Open(); !errors.Is(err, ErrBadMagic) {
+		t.Fatalf("expected ErrBadMagic, got %v", err)
+	}
+
+	// broken index block
+	broken = append([]byte{}, data...)
+	broken[len(broken)-footerSizeV3-blockTrailerSize-1] ^= 0xff
+	if err := os.WriteFile(path, broken, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := NewSSTable(1, path, nil, nil).Open(); !errors.Is(err, ErrBadChecksum) {
+		t.Fatalf("expected ErrBadChecksum, got %v", err)
+	}
+}
+
+func TestSSTable_BloomFilterSurvivesReopen(t *testing.T) {
+	lm := newTestLevelManager(t)
+	table := writeTestTable(t, lm, 200)
+	written := table.bloom.Encode()
+	if err := table.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reopened := NewSSTable(1, table.GetFilePath(), nil, nil)
+	if err := reopened.Open(); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer reopened.Close()
+
+	if reopened.bloom == nil {
+		t.Fatal("bloom filter is not loaded")
+	}
+	if !bytes.Equal(reopened.bloom.Encode(), written) {
+		t.Fatal("loaded bloom filter differs from the written one")
+	}
+	for i := 0; i < 200; i++ {
+		if !reopened.bloom.MayContain([]byte(fmt.Sprintf("key%05d", i))) {
+			t.Fatalf("false negative for key%05d", i)
+		}
+	}
+}
+
+func TestSSTable_GetReadsSingleCachedBlock(t *testing.T) {
+	lm := newTestLevelManager(t)
+	lm.cfg.SSTable.BlockSize = 256
+	table := writeTestTable(t, lm, 500)
+
+	cache := NewBlockCache(1<<20, 1)
+	table.cache = cache
+
+	for round := 0; round < 2; round++ {
+		item, err := table.Get([]byte("key00321"))
+		if err != nil || string(item.Value) != "value321" {
+			t.Fatalf("Get failed: %v", err)
+		}
+	}
+	if stats := cache.Stats(); stats.Misses != 1 || stats.Hits != 1 {
+		t.Fatalf("expected one block read and one cache hit, got %d misses and %d hits", stats.Misses, stats.Hits)
+	}
+
+	// keys between existing ones and past the last block
+	for _, key := range []string{"key00321a", "key", "key99999"} {
+		if _, err := table.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("expected ErrKeyNotFound for %s, got %v", key, err)
+		}
+	}
+}
+
+func TestSSTable_ConcurrentReads(t *testing.T) {
+	lm := newTestLevelManager(t)
+	lm.cfg.SSTable.BlockSize = 256
+	const n = 2000
+	table := writeTestTable(t, lm, n)
+	table.cache = NewBlockCache(4096, 4)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			if g%4 == 0 {
+				// scanners walk the whole table
+				it := table.NewIterator()
+				defer it.Close()
+				count := 0
+				for it.First(); it.Valid(); it.Next() {
+					if want := fmt.Sprintf("key%05d", count); string(it.Key()) != want {
+						errs <- fmt.Errorf("iterator returned %s, want %s", it.Key(), want)
+						return
+					}
+					count++
+				}
+				if it.Error() != nil || count != n {
+					errs <- fmt.Errorf("iterated over %d records: %v", count, it.Error())
+				}
+				return
+			}
+
+			// point readers jump between blocks
+			for i := 0; i < n; i++ {
+				k := (i*7919 + g*31) % n
+				item, err := table.Get([]byte(fmt.Sprintf("key%05d", k)))
+				if err != nil {
+					errs <- fmt.Errorf("Get key%05d failed: %w", k, err)
+					return
+				}
+				if string(item.Value) != fmt.Sprintf("value%d", k) {
+					errs <- fmt.Errorf("Get key%05d returned %s", k, item.Value)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSSTable_GetAtVersions(t *testing.T) {
+	lm := newTestLevelManager(t)
+	lm.cfg.SSTable.BlockSize = 64
+
+	// versions of "key" span several blocks, newest first
+	items := []SSTableItem{{Key: []byte("a"), Value: []byte("a"), ID: 1}}
+	for seq := uint64(40); seq >= 10; seq -= 10 {
+		items = append(items, SSTableItem{Key: []byte("key"), Value: []byte(fmt.Sprintf("value%d", seq)), ID: seq})
+	}
+	items = append(items, SSTableItem{Key: []byte("z"), Value: []byte("z"), ID: 2})
+
+	table := NewSSTable(1, lm.cfg.RootPath+"/versions.sst", NewBloomFilter(uint32(len(items)), 10), nil)
+	if err := lm.WriteSSTableData(table, items); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+	if err := table.Open(); err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	defer table.Close()
+
+	for _, tc := range []struct {
+		seqN uint64
+		want string
+	}{
+		{seqN: 100, want: "value40"},
+		{seqN: 39, want: "value30"},
+		{seqN: 20, want: "value20"},
+		{seqN: 10, want: "value10"},
+	} {
+		item, err := table.GetAt([]byte("key"), tc.seqN)
+		if err != nil || string(item.Value) != tc.want {
+			t.Fatalf("GetAt %d: expected %s, got %v", tc.seqN, tc.want, err)
+		}
+	}
+	if _, err := table.GetAt([]byte("key"), 9); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound below the oldest version, got %v", err)
+	}
+
+	// versions must go from newest to oldest
+	broken := NewSSTable(2, lm.cfg.RootPath+"/broken.sst", nil, nil)
+	err := lm.WriteSSTableData(broken, []SSTableItem{{Key: []byte("k"), ID: 1}, {Key: []byte("k"), ID: 2}})
+	if err == nil {
+		t.Fatal("expected error for unordered versions")
+	}
+}
+
+func TestVersionPruner(t *testing.T) {
+	records := []struct {
+		key  string
+		seqN uint64
+		meta uint64
+	}{
+		{"a", 50, 0}, {"a", 30, 0}, {"a", 20, 0}, {"a", 10, 0}, {"b", 5, 0}, {"c", 40, 0},
+		{"d", 70, operandMeta}, {"d", 60, operandMeta}, {"d", 55, 0}, {"d", 45, 0},
+	}
+
+	keep := func(oldestSnapshot uint64) []uint64 {
+		pruner := NewVersionPruner(oldestSnapshot, testMerger{})
+		var kept []uint64
+		for _, r := range records {
+			if !pruner.Obsolete([]byte(r.key), r.seqN, r.meta) {
+				kept = append(kept, r.seqN)
+			}
+		}
+		return kept
+	}
+
+	// without snapshots only the newest versions stay
+	// merge operands keep the version they apply to
+	if got := fmt.Sprint(keep(NoSnapshot)); got != "[50 5 40 70 60 55]" {
+		t.Fatalf("unexpected versions without snapshots: %s", got)
+	}
+	// a snapshot at 25 reads version 20, the versions below it are not needed
+	if got := fmt.Sprint(keep(25)); got != "[50 30 20 5 40 70 60 55 45]" {
+		t.Fatalf("unexpected versions with a snapshot: %s", got)
+	}
+}
+
+func TestLevelManager_OpenFailsOnLegacyTable(t *testing.T) {
+	cfg := config.Default()
+	cfg.Persistence.RootPath = t.TempDir()
+
+	// a table of the first versions holds records followed by the index and its size
+	var legacy []byte
+	legacy = binary.LittleEndian.AppendUint32(legacy, 3)
+	legacy = append(legacy, "key"...)
+	legacy = binary.LittleEndian.AppendUint32(legacy, 5)
+	legacy = append(legacy, "value"...)
+	legacy = binary.LittleEndian.AppendUint64(legacy, 1)
+	legacy = binary.LittleEndian.AppendUint64(legacy, 0)
+	legacy = binary.LittleEndian.AppendUint32(legacy, 0)
+	path := filepath.Join(cfg.Persistence.RootPath, "L0_1.sst")
+	if err := os.WriteFile(path, legacy, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	addTable(t, loadManifest(t, cfg.Persistence.RootPath), 1, path)
+
+	if _, err := NewLevelManager(cfg.Persistence); !errors.Is(err, ErrBadMagic) {
+		t.Fatalf("expected the legacy table to fail the open, got %v", err)
+	}
+}
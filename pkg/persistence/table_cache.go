@@ -0,0 +1,81 @@
+package persistence
+
+import (
+	"container/list"
+	"log/slog"
+	"sync"
+)
+
+// TableCache limits the number of open table files. Tables keep their
+// index and filter in memory, the least recently read ones have their
+// files closed and reopened by the next read of a data block.
+type TableCache struct {
+	mu       sync.Mutex
+	capacity int
+	tables   map[*SSTable]*list.Element
+	// lru holds tables with open files, the most recently read at the front
+	lru *list.List
+}
+
+// NewTableCache creates a cache keeping up to capacity files open, zero means no limit
+func NewTableCache(capacity int) *TableCache {
+	return &TableCache{
+		capacity: capacity,
+		tables:   make(map[*SSTable]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// add registers a table which file has just been opened
+// and closes files of the least recently read tables over the limit
+func (tc *TableCache) add(table *SSTable) {
+	tc.mu.Lock()
+	if elem, ok := tc.tables[table]; ok {
+		tc.lru.MoveToFront(elem)
+	} else {
+		tc.tables[table] = tc.lru.PushFront(table)
+	}
+
+	var victims []*SSTable
+	for tc.capacity > 0 && tc.lru.Len() > tc.capacity {
+		victim := tc.lru.Remove(tc.lru.Back()).(*SSTable)
+		delete(tc.tables, victim)
+		victims = append(victims, victim)
+	}
+	tc.mu.Unlock()
+
+	// closing waits for reads in progress, so it happens outside of the lock
+	for _, victim := range victims {
+		if err := victim.closeFile(); err != nil {
+			slog.Warn("failed to close evicted SSTable", "path", victim.filePath, "error", err)
+		}
+	}
+}
+
+// touch marks the table as recently read
+func (tc *TableCache) touch(table *SSTable) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if elem, ok := tc.tables[table]; ok {
+		tc.lru.MoveToFront(elem)
+	}
+}
+
+// remove forgets a closed table
+func (tc *TableCache) remove(table *SSTable) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if elem, ok := tc.tables[table]; ok {
+		tc.lru.Remove(elem)
+		delete(tc.tables, table)
+	}
+}
+
+// Len returns the number of tables with open files
+func (tc *TableCache) Len() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.lru.Len()
+}
@@ -0,0 +1,47 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"lsmdb/pkg/config"
+	"testing"
+)
+
+func TestTableCache_LimitsOpenFiles(t *testing.T) {
+	cfg := config.Default()
+	cfg.Persistence.RootPath = t.TempDir()
+	cfg.Persistence.SSTable.CompactThreshold = 100
+	cfg.Persistence.MaxOpenTables = 2
+	lm, err := NewLevelManager(cfg.Persistence)
+	if err != nil {
+		t.Fatalf("NewLevelManager failed: %v", err)
+	}
+	lm.Start(context.Background())
+	t.Cleanup(lm.Stop)
+
+	const tables = 5
+	for i := 0; i < tables; i++ {
+		addL0Table(t, lm, []SSTableItem{{Key: []byte(fmt.Sprintf("key%d", i)), Value: []byte("value"), ID: uint64(i + 1)}})
+	}
+	if n := lm.TableCache().Len(); n != 2 {
+		t.Fatalf("expected 2 open tables, got %d", n)
+	}
+
+	// evicted tables are reopened on read
+	for round := 0; round < 2; round++ {
+		for i := 0; i < tables; i++ {
+			item, err := lm.Get([]byte(fmt.Sprintf("key%d", i)))
+			if err != nil || item == nil {
+				t.Fatalf("key%d is not readable: %v", i, err)
+			}
+		}
+	}
+	if n := lm.TableCache().Len(); n > 2 {
+		t.Fatalf("open tables exceed the limit: %d", n)
+	}
+	for _, table := range levelTables(lm, 0) {
+		if table.ApproximateSize() == 0 {
+			t.Fatalf("size of table %d is lost after its file is closed", table.ID())
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Version is an immutable set of tables of every level. Readers pin
+// the version they started with, so flushes and compactions never change
+// the tables they see, and tables stay open until no version holds them.
+type Version struct {
+	levels []Level
+	refs   atomic.Int64
+}
+
+// newVersion references every table of the levels
+func newVersion(levels []Level) *Version {
+	v := &Version{levels: levels}
+	for _, level := range levels {
+		for _, table := range level.Tables {
+			table.Ref()
+		}
+	}
+	v.refs.Store(1)
+	return v
+}
+
+// Ref pins the version
+func (v *Version) Ref() {
+	v.refs.Add(1)
+}
+
+// Unref releases the version, the last reference releases its tables
+func (v *Version) Unref() {
+	if v.refs.Add(-1) > 0 {
+		return
+	}
+	for _, level := range v.levels {
+		for _, table := range level.Tables {
+			table.Unref()
+		}
+	}
+}
+
+// NumLevels returns the number of levels including empty ones
+func (v *Version) NumLevels() int {
+	return len(v.levels)
+}
+
+// Tables returns tables of the level, L0 in order of creation,
+// deeper levels sorted by key. The slice must not be modified.
+func (v *Version) Tables(level int) []*SSTable {
+	if level >= len(v.levels) {
+		return nil
+	}
+	return v.levels[level].Tables
+}
+
+// GetAt retrieves the newest version of the key with sequence number not greater than seqN
+func (v *Version) GetAt(key []byte, seqN uint64) (*SSTableItem, error) {
+	// Search from newest to oldest (L0 to Ln)
+	for level := 0; level < len(v.levels); level++ {
+		// Search in reverse order (newest first)
+		for i := len(v.levels[level].Tables) - 1; i >= 0; i-- {
+			table := v.levels[level].Tables[i]
+
+			// Check bloom filter first
+			if table.bloom != nil && !table.bloom.MayContain(key) {
+				continue
+			}
+
+			// Try to get from this table
+			item, err := table.GetAt(key, seqN)
+			if err != nil {
+				// If key not found, continue to next table
+				if errors.Is(err, ErrKeyNotFound) {
+					continue
+				}
+				return nil, fmt.Errorf("failed to get from table: %w", err)
+			}
+
+			if item != nil {
+				return item, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// Iterators returns iterators over every table ordered from newest to oldest
+func (v *Version) Iterators() []Iterator {
+	iters := make([]Iterator, 0)
+	for level := 0; level < len(v.levels); level++ {
+		for i := len(v.levels[level].Tables) - 1; i >= 0; i-- {
+			iters = append(iters, v.levels[level].Tables[i].NewIterator())
+		}
+	}
+	return iters
+}
+
+// PrefixIterators returns iterators over tables which prefix filter
+// may hold keys starting with prefix, ordered from newest to oldest
+func (v *Version) PrefixIterators(extractor PrefixExtractor, prefix []byte) []Iterator {
+	iters := make([]Iterator, 0)
+	for level := 0; level < len(v.levels); level++ {
+		for i := len(v.levels[level].Tables) - 1; i >= 0; i-- {
+			table := v.levels[level].Tables[i]
+			if !table.MayContainPrefix(extractor, prefix) {
+				continue
+			}
+			iters = append(iters, table.NewIterator())
+		}
+	}
+	return iters
+}
+
+// versionEdit lists tables a flush or compaction adds to and removes from levels
+type versionEdit struct {
+	added   []levelTable
+	removed []levelTable
+}
+
+type levelTable struct {
+	level int
+	table *SSTable
+}
+
+// VersionSet owns the manifest and the current version of the tree
+type VersionSet struct {
+	mu       sync.Mutex
+	manifest *Manifest
+	current  *Version
+	// maxSize returns the size limit of a new level
+	maxSize func(level int) int64
+}
+
+func newVersionSet(manifest *Manifest, maxSize func(level int) int64) *VersionSet {
+	return &VersionSet{
+		manifest: manifest,
+		current:  newVersion(nil),
+		maxSize:  maxSize,
+	}
+}
+
+// Manifest returns the manifest recording every installed version
+func (vs *VersionSet) Manifest() *Manifest {
+	return vs.manifest
+}
+
+// Current returns the pinned current version, the caller must Unref it
+func (vs *VersionSet) Current() *Version {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.current.Ref()
+	return vs.current
+}
+
+// LogAndApply records the edit together with pending manifest changes
+// and installs the resulting version. Added tables are handed over to the
+// version set, removed ones are deleted once no version or iterator holds them.
+func (vs *VersionSet) LogAndApply(edit versionEdit) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	var record VersionEdit
+	for _, lt := range edit.added {
+		record.Added = append(record.Added, TableInfo{
+			ID:       lt.table.ID(),
+			FilePath: lt.table.GetFilePath(),
+			Level:    lt.level,
+			Size:     lt.table.ApproximateSize(),
+		})
+	}
+	for _, lt := range edit.removed {
+		record.Removed = append(record.Removed, TableRef{ID: lt.table.ID(), Level: lt.level})
+	}
+
+	if err := vs.manifest.LogEdit(&record); err != nil {
+		return fmt.Errorf("failed to update manifest: %w", err)
+	}
+
+	vs.install(edit)
+	return nil
+}
+
+// install switches to the version with the edit applied, it must be called under mu
+func (vs *VersionSet) install(edit versionEdit) {
+	levels := make([]Level, len(vs.current.levels))
+	for i, level := range vs.current.levels {
+		levels[i] = Level{
+			LevelNum: level.LevelNum,
+			Tables:   append([]*SSTable{}, level.Tables...),
+			MaxSize:  level.MaxSize,
+		}
+	}
+
+	for _, lt := range edit.removed {
+		levels[lt.level].Tables = without(levels[lt.level].Tables, []*SSTable{lt.table})
+		lt.table.markObsolete()
+	}
+	for _, lt := range edit.added {
+		for len(levels) <= lt.level {
+			levels = append(levels, Level{
+				LevelNum: len(levels),
+				Tables:   []*SSTable{},
+				MaxSize:  vs.maxSize(len(levels)),
+			})
+		}
+		// L0 keeps tables in order of creation, deeper levels are sorted by key
+		levels[lt.level].Tables = append(levels[lt.level].Tables, lt.table)
+	}
+	for i := 1; i < len(levels); i++ {
+		sortByKey(levels[i].Tables)
+	}
+
+	previous := vs.current
+	vs.current = newVersion(levels)
+	previous.Unref()
+
+	// the new version holds added tables instead of their creator
+	for _, lt := range edit.added {
+		lt.table.Unref()
+	}
+}
@@ -0,0 +1,98 @@
+package persistence
+
+import (
+	"bytes"
+	"errors"
+	"math"
+)
+
+// NoSnapshot is the oldest snapshot sequence number when no snapshot is held,
+// only the newest version of every key is kept then
+const NoSnapshot uint64 = math.MaxUint64
+
+// ErrMergeSkipped is returned by Merger.Merge to keep operands unfolded
+var ErrMergeSkipped = errors.New("merge skipped")
+
+// Merger lets the tree fold merge operands, records holding a change
+// to the older versions of a key rather than a complete value
+type Merger interface {
+	// IsOperand reports whether the record is a merge operand
+	IsOperand(meta uint64) bool
+	// Merge folds operands, newest first, into base, which is nil when
+	// the key has no older version. The result replaces the newest operand.
+	Merge(key []byte, operands []SSTableItem, base *SSTableItem) (SSTableItem, error)
+}
+
+// VersionPruner detects versions no reader can see. A version is obsolete
+// when a newer complete version of the same key is visible to the oldest snapshot,
+// merge operands keep the versions below them.
+type VersionPruner struct {
+	oldestSnapshot uint64
+	merger         Merger
+
+	started bool
+	key     []byte
+	// shadowed is set once a complete version visible to the oldest snapshot is seen
+	shadowed bool
+}
+
+// NewVersionPruner creates a pruner keeping versions needed by snapshots
+// pinned at oldestSnapshot and later, merger may be nil
+func NewVersionPruner(oldestSnapshot uint64, merger Merger) *VersionPruner {
+	return &VersionPruner{oldestSnapshot: oldestSnapshot, merger: merger}
+}
+
+// Obsolete must be called for records in key order, newer versions of a key first
+func (p *VersionPruner) Obsolete(key []byte, seqN, meta uint64) bool {
+	if !p.started || !bytes.Equal(key, p.key) {
+		p.started = true
+		p.key = append(p.key[:0], key...)
+		p.shadowed = false
+	}
+
+	if p.shadowed {
+		return true
+	}
+	if seqN <= p.oldestSnapshot && (p.merger == nil || !p.merger.IsOperand(meta)) {
+		p.shadowed = true
+	}
+	return false
+}
+
+// foldOperands merges the operands no snapshot can read past into the
+// complete version below them. versions hold a single key, newest first.
+// Without a complete version the operands are folded only if no deeper
+// level can hold one.
+func foldOperands(merger Merger, versions []SSTableItem, oldestSnapshot uint64, bottommost bool) ([]SSTableItem, error) {
+	start := 0
+	for start < len(versions) && versions[start].ID > oldestSnapshot {
+		start++
+	}
+	end := start
+	for end < len(versions) && merger.IsOperand(versions[end].Meta) {
+		end++
+	}
+	if end == start {
+		return versions, nil
+	}
+
+	var base *SSTableItem
+	if end < len(versions) {
+		base = &versions[end]
+	} else if !bottommost {
+		return versions, nil
+	}
+
+	folded, err := merger.Merge(versions[start].Key, versions[start:end], base)
+	if errors.Is(err, ErrMergeSkipped) {
+		return versions, nil
+	}
+	if err != nil {
+		return versions, err
+	}
+
+	// versions below the base are shadowed by the folded one
+	result := make([]SSTableItem, 0, start+1)
+	result = append(result, versions[:start]...)
+	return append(result, folded), nil
+}
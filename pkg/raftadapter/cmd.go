@@ -1,7 +1,9 @@
 package raftadapter
 
 import (
+	"fmt"
 	"lsmdb/pkg/store"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -10,7 +12,20 @@ type Cmd struct {
 	Op    store.Operation `json:"op"`
 	Key   []byte          `json:"key"`
 	Value []byte          `json:"value"`
-	ID    uuid.UUID       `json:"id"`
+	// Type is the value type name understood by store.ParseValue,
+	// Value holds its text form. Empty means a string.
+	Type string `json:"type,omitempty"`
+	// ExpiresAt is the deadline of the value, zero means it never expires.
+	// The leader sets it once, so every replica expires the key at the same time.
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// Expected is the text form of the value PutIfEqualOp compares with
+	Expected []byte `json:"expected,omitempty"`
+	// ExpectedVersion is the version DeleteIfVersionOp compares with
+	ExpectedVersion uint64 `json:"expected_version,omitempty"`
+	// AppliedAt is the time conditions check expiry at. The proposer sets it,
+	// so replicas with skewed clocks take the same decision near a deadline.
+	AppliedAt time.Time `json:"applied_at,omitzero"`
+	ID        uuid.UUID `json:"id"`
 }
 
 func NewCmd(op store.Operation, key, value []byte) Cmd {
@@ -21,3 +36,78 @@ func NewCmd(op store.Operation, key, value []byte) Cmd {
 		ID:    uuid.New(),
 	}
 }
+
+// NewTypedCmd creates an insert of a value given in the text form of the named type
+func NewTypedCmd(key []byte, typeName, value string) Cmd {
+	cmd := NewCmd(store.InsertOp, key, []byte(value))
+	cmd.Type = typeName
+	return cmd
+}
+
+// NewMergeCmd creates a merge of an operand given in the text form of the named type
+func NewMergeCmd(key []byte, typeName, operand string) Cmd {
+	cmd := NewTypedCmd(key, typeName, operand)
+	cmd.Op = store.MergeOp
+	return cmd
+}
+
+// WithTTL sets the command value to expire after ttl from now
+func (c Cmd) WithTTL(ttl time.Duration) Cmd {
+	c.ExpiresAt = time.Now().Add(ttl)
+	return c
+}
+
+// IfAbsent makes the insert apply only if the key does not exist
+func (c Cmd) IfAbsent() Cmd {
+	c.Op = store.PutIfAbsentOp
+	return c
+}
+
+// IfEqual makes the insert apply only if the current value equals expected,
+// given in the text form of the command type
+func (c Cmd) IfEqual(expected string) Cmd {
+	c.Op = store.PutIfEqualOp
+	c.Expected = []byte(expected)
+	return c
+}
+
+// IfVersion makes the delete apply only if the current value has the version
+func (c Cmd) IfVersion(version uint64) Cmd {
+	c.Op = store.DeleteIfVersionOp
+	c.ExpectedVersion = version
+	return c
+}
+
+// mutation converts the command applied at the log index into a store mutation
+func (c Cmd) mutation(index uint64) (store.Mutation, error) {
+	m := store.Mutation{
+		Op:              c.Op,
+		Key:             string(c.Key),
+		ExpectedVersion: c.ExpectedVersion,
+		Version:         index,
+		ExpiresAt:       c.ExpiresAt,
+		AppliedAt:       c.AppliedAt,
+	}
+
+	switch c.Op {
+	case store.InsertOp, store.PutIfAbsentOp, store.PutIfEqualOp, store.MergeOp:
+		value, err := store.ParseValue(c.Type, string(c.Value))
+		if err != nil {
+			return m, err
+		}
+		m.Value = value
+	case store.DeleteOp, store.DeleteIfVersionOp:
+	default:
+		return m, fmt.Errorf("unknown command operation: %v", c.Op)
+	}
+
+	if c.Op == store.PutIfEqualOp {
+		expected, err := store.ParseValue(c.Type, string(c.Expected))
+		if err != nil {
+			return m, fmt.Errorf("invalid expected value: %w", err)
+		}
+		m.Expected = expected
+	}
+
+	return m, nil
+}
@@ -16,9 +16,10 @@ import (
 )
 
 type iStoreAPI interface {
-	PutString(key, value string) error
+	// Apply writes a replicated mutation, a failed condition
+	// returns store.ErrConditionFailed
+	Apply(m store.Mutation) error
 	GetString(key string) (string, bool, error)
-	Delete(key string) error
 }
 
 type iTransport interface {
@@ -194,14 +195,11 @@ func (n *Node) applyEntry(entry raftpb.Entry) error {
 		return n.notifyProposalResult(cmd.ID, proposeResult{Err: nil})
 	}
 
-	var err error
-	switch cmd.Op {
-	case store.InsertOp:
-		err = n.store.PutString(string(cmd.Key), string(cmd.Value))
-	case store.DeleteOp:
-		err = n.store.Delete(string(cmd.Key))
-	default:
-		err = fmt.Errorf("unknown command operation: %v", cmd.Op)
+	// conditions are evaluated by every replica against the same state,
+	// the log index versions the value identically everywhere
+	mutation, err := cmd.mutation(entry.Index)
+	if err == nil {
+		err = n.store.Apply(mutation)
 	}
 
 	return n.notifyProposalResult(cmd.ID, proposeResult{Err: err})
@@ -244,21 +242,27 @@ func (n *Node) notifyProposalResult(cmdID uuid.UUID, result proposeResult) error
 
 func (n *Node) validateCommand(cmd Cmd) error {
 	switch cmd.Op {
-	case store.InsertOp:
+	case store.InsertOp, store.PutIfAbsentOp, store.PutIfEqualOp, store.MergeOp:
 		if len(cmd.Key) == 0 || len(cmd.Value) == 0 {
 			return fmt.Errorf("invalid command: empty key or value")
 		}
-	case store.DeleteOp:
+	case store.DeleteOp, store.DeleteIfVersionOp:
 		if len(cmd.Key) == 0 {
 			return fmt.Errorf("invalid command: empty key")
 		}
 	default:
 		return fmt.Errorf("unknown operation: %v", cmd.Op)
 	}
+	if _, err := cmd.mutation(0); err != nil {
+		return fmt.Errorf("invalid command: %w", err)
+	}
 	return nil
 }
 
 func (n *Node) Execute(ctx context.Context, cmd Cmd) error {
+	if cmd.AppliedAt.IsZero() {
+		cmd.AppliedAt = time.Now()
+	}
 	data, err := json.Marshal(cmd)
 	if err != nil {
 		return fmt.Errorf("marshal command: %w", err)
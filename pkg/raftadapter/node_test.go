@@ -4,8 +4,10 @@ package raftadapter
 import (
 	"sync"
 	"testing"
+	"time"
 
 	"lsmdb/pkg/config"
+	"lsmdb/pkg/store"
 
 	"go.etcd.io/etcd/raft/v3/raftpb"
 )
@@ -14,6 +16,7 @@ import (
 type mockStore struct{}
 
 func (m *mockStore) PutString(key, value string) error          { _ = key; _ = value; return nil }
+func (m *mockStore) Apply(mutation store.Mutation) error        { _ = mutation; return nil }
 func (m *mockStore) GetString(key string) (string, bool, error) { _ = key; return "", false, nil }
 func (m *mockStore) Delete(key string) error                    { _ = key; return nil }
 
@@ -129,3 +132,31 @@ func TestNode_UpdateTransport(t *testing.T) {
 		t.Fatalf("peer still present after removal")
 	}
 }
+
+func TestCmd_Mutation(t *testing.T) {
+	cmd := NewTypedCmd([]byte("k"), "int64", "2").IfEqual("1")
+	cmd.AppliedAt = time.Unix(100, 0)
+	m, err := cmd.mutation(7)
+	if err != nil {
+		t.Fatalf("mutation failed: %v", err)
+	}
+	if m.Op != store.PutIfEqualOp || m.Key != "k" || m.Version != 7 ||
+		m.Value != store.Int64(2) || m.Expected != store.Int64(1) || !m.AppliedAt.Equal(cmd.AppliedAt) {
+		t.Fatalf("unexpected mutation: %+v", m)
+	}
+
+	m, err = NewCmd(store.DeleteOp, []byte("k"), nil).IfVersion(7).mutation(8)
+	if err != nil || m.Op != store.DeleteIfVersionOp || m.ExpectedVersion != 7 {
+		t.Fatalf("unexpected delete mutation: %+v, %v", m, err)
+	}
+
+	m, err = NewMergeCmd([]byte("k"), "int64", "5").mutation(9)
+	if err != nil || m.Op != store.MergeOp || m.Value != store.Int64(5) || m.Version != 9 {
+		t.Fatalf("unexpected merge mutation: %+v, %v", m, err)
+	}
+
+	n := &Node{}
+	if err := n.validateCommand(NewTypedCmd([]byte("k"), "int64", "2").IfEqual("x")); err == nil {
+		t.Fatal("expected invalid expected value to be rejected")
+	}
+}
@@ -30,6 +30,17 @@ func (s *recordingStore) PutString(key, value string) error {
 	return nil
 }
 
+func (s *recordingStore) Apply(m store.Mutation) error {
+	if m.Op == store.DeleteOp || m.Op == store.DeleteIfVersionOp {
+		return s.Delete(m.Key)
+	}
+	_, text, err := store.FormatValue(m.Value)
+	if err != nil {
+		return err
+	}
+	return s.PutString(m.Key, text)
+}
+
 func (s *recordingStore) GetString(key string) (string, bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
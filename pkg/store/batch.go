@@ -0,0 +1,71 @@
+package store
+
+import (
+	"lsmdb/pkg/wal"
+)
+
+// WriteBatch collects puts, merges and deletes applied to the store atomically.
+// Later operations on the same key win over earlier ones.
+type WriteBatch struct {
+	entries []wal.Entry
+}
+
+// NewWriteBatch creates an empty batch
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put adds a put of a value of any type supported by Store.Put
+func (b *WriteBatch) Put(key string, value any) error {
+	val, err := toValue(value)
+	if err != nil {
+		return err
+	}
+	b.entries = append(b.entries, newEntry(key, val, InsertOp))
+	return nil
+}
+
+// PutString adds a put of a string value
+func (b *WriteBatch) PutString(key string, value string) {
+	b.entries = append(b.entries, newEntry(key, String(value), InsertOp))
+}
+
+// Merge adds a merge operand applied to the value of the key
+func (b *WriteBatch) Merge(key string, operand any) error {
+	val, err := toValue(operand)
+	if err != nil {
+		return err
+	}
+	b.entries = append(b.entries, newEntry(key, val, MergeOp))
+	return nil
+}
+
+// Delete adds a deletion of the key
+func (b *WriteBatch) Delete(key string) {
+	b.entries = append(b.entries, newEntry(key, tombstone{}, DeleteOp))
+}
+
+// Len returns the number of operations in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Reset empties the batch so it can be reused
+func (b *WriteBatch) Reset() {
+	b.entries = b.entries[:0]
+}
+
+// Write applies the batch as a single journal record, readers and
+// recovery see either all of its operations or none of them.
+// A batch holding a too large entry is rejected as a whole.
+func (s *Store) Write(b *WriteBatch) error {
+	return s.write(b.entries)
+}
+
+func newEntry(key string, val value, op Operation) wal.Entry {
+	return wal.Entry{
+		Key:   []byte(key),
+		Value: val.bin(),
+		Meta:  uint64(newMD(op, val.typeOf())),
+	}
+}
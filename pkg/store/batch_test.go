@@ -0,0 +1,151 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"lsmdb/pkg/config"
+	"lsmdb/pkg/memtable"
+	"lsmdb/pkg/wal"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteBatch_AppliesAllOperations(t *testing.T) {
+	cfg := config.Default()
+	cfg.Persistence.RootPath = t.TempDir()
+	journal, err := wal.New(cfg.Persistence.RootPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	store, err := New(&cfg, journal)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if err := store.PutString(key, "1"); err != nil {
+			t.Fatalf("PutString failed: %v", err)
+		}
+	}
+
+	batch := NewWriteBatch()
+	batch.PutString("a", "2")
+	batch.Delete("b")
+	batch.PutString("c", "1")
+	batch.PutString("c", "2")
+	if err := batch.Put("d", struct{}{}); err == nil {
+		t.Fatal("expected error for unsupported value type")
+	}
+	if batch.Len() != 4 {
+		t.Fatalf("expected 4 operations, got %d", batch.Len())
+	}
+	if err := store.Write(batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	check := func(store *Store) {
+		t.Helper()
+		got := collect(t, store.Scan("", ""))
+		if len(got) != 2 || got["a"] != "2" || got["c"] != "2" {
+			t.Fatalf("unexpected state after batch: %v", got)
+		}
+	}
+	check(store)
+
+	// the batch survives restart
+	store.Close()
+	if err := journal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+	journal, err = wal.New(cfg.Persistence.RootPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer journal.Close()
+	store, err = New(&cfg, journal)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	check(store)
+}
+
+func TestWriteBatch_ReadersSeeAllOrNothing(t *testing.T) {
+	store := newTestStore(t)
+
+	keys := []string{"k1", "k2", "k3"}
+	const rounds = 200
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		batch := NewWriteBatch()
+		for i := 0; i < rounds; i++ {
+			batch.Reset()
+			for _, key := range keys {
+				batch.PutString(key, fmt.Sprint(i))
+			}
+			if err := store.Write(batch); err != nil {
+				t.Errorf("Write failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				got := collect(t, store.Scan("", ""))
+				if len(got) != 0 && (len(got) != len(keys) || got["k1"] != got["k2"] || got["k2"] != got["k3"]) {
+					t.Errorf("reader saw a part of a batch: %v", got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWriteBatch_TooLargeEntryRejectsWholeBatch(t *testing.T) {
+	cfg := config.Default()
+	cfg.Persistence.RootPath = t.TempDir()
+	store := openStore(t, &cfg)
+
+	batch := NewWriteBatch()
+	batch.PutString("a", "1")
+	batch.PutString(strings.Repeat("k", cfg.Memtable.FlushThresholdBytes), "1")
+	batch.PutString("b", "1")
+	if err := store.Write(batch); !errors.Is(err, memtable.ErrTooLargeEntry) {
+		t.Fatalf("expected ErrTooLargeEntry, got %v", err)
+	}
+
+	check := func(store *Store) {
+		t.Helper()
+		if got := collect(t, store.Scan("", "")); len(got) != 0 {
+			t.Fatalf("expected no key of the rejected batch, got %v", got)
+		}
+	}
+	check(store)
+	// a later write makes every earlier sequence number visible
+	if err := store.PutString("c", "1"); err != nil {
+		t.Fatalf("PutString failed: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, found, err := store.GetString(key); err != nil || found {
+			t.Fatalf("expected %s to be absent, got found=%v err=%v", key, found, err)
+		}
+	}
+	closeStore(t, store)
+
+	store = openStore(t, &cfg)
+	defer closeStore(t, store)
+	for _, key := range []string{"a", "b"} {
+		if _, found, err := store.GetString(key); err != nil || found {
+			t.Fatalf("expected %s to be absent after reopen, got found=%v err=%v", key, found, err)
+		}
+	}
+}
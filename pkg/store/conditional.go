@@ -0,0 +1,126 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"lsmdb/pkg/wal"
+	"time"
+)
+
+// Mutation is a write replicated through consensus. Conditions are
+// evaluated against the local state, which is the same on every replica
+// that applied the same log, and judge expiry at AppliedAt rather than
+// by the local clock, so all replicas take the same decision.
+type Mutation struct {
+	Op    Operation
+	Key   string
+	Value any
+	// Expected is the value PutIfEqualOp compares the current one with
+	Expected any
+	// ExpectedVersion is the version DeleteIfVersionOp compares the current one with
+	ExpectedVersion uint64
+	// Version is the log index of the write, zero leaves the value unversioned
+	Version uint64
+	// ExpiresAt is the deadline of an inserted value, zero means no expiry
+	ExpiresAt time.Time
+	// AppliedAt is the time conditions check expiry at, zero uses the local clock
+	AppliedAt time.Time
+}
+
+// Apply checks the condition of the mutation and writes it. A failed
+// condition returns ErrConditionFailed, ErrKeyExists for PutIfAbsentOp.
+// Conditions are atomic with respect to other mutations applied concurrently.
+func (s *Store) Apply(m Mutation) error {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+
+	if err := s.check(m); err != nil {
+		return err
+	}
+
+	switch m.Op {
+	case InsertOp, PutIfAbsentOp, PutIfEqualOp:
+		entry, err := newInsert(m.Key, m.Value, m.ExpiresAt, m.Version)
+		if err != nil {
+			return err
+		}
+		return s.write([]wal.Entry{entry})
+	case MergeOp:
+		entry, err := newInsert(m.Key, m.Value, time.Time{}, m.Version)
+		if err != nil {
+			return err
+		}
+		entry.Meta = uint64(MD(entry.Meta).withOperation(MergeOp))
+		return s.write([]wal.Entry{entry})
+	case DeleteOp, DeleteIfVersionOp:
+		return s.Delete(m.Key)
+	default:
+		return fmt.Errorf("unknown operation: %d", m.Op)
+	}
+}
+
+// check evaluates the condition of the mutation against the current value
+func (s *Store) check(m Mutation) error {
+	if m.Op != PutIfAbsentOp && m.Op != PutIfEqualOp && m.Op != DeleteIfVersionOp {
+		return nil
+	}
+
+	now := m.AppliedAt
+	if now.IsZero() {
+		now = s.now()
+	}
+	current, version, found, err := s.lookup(m.Key, s.inflight.visible(), now)
+	if err != nil {
+		return err
+	}
+
+	switch m.Op {
+	case PutIfAbsentOp:
+		if found {
+			return ErrKeyExists
+		}
+	case PutIfEqualOp:
+		expected, err := toValue(m.Expected)
+		if err != nil {
+			return err
+		}
+		if !found || !sameValue(current, expected) {
+			return fmt.Errorf("%w: value mismatch", ErrConditionFailed)
+		}
+	case DeleteIfVersionOp:
+		if !found || version != m.ExpectedVersion {
+			return fmt.Errorf("%w: version mismatch", ErrConditionFailed)
+		}
+	}
+	return nil
+}
+
+// GetWithVersion returns the value of the key and the version of its write,
+// unversioned values have version 0
+func (s *Store) GetWithVersion(key string) (any, uint64, bool, error) {
+	return s.lookup(key, s.inflight.visible(), s.now())
+}
+
+// newInsert builds the journal entry of a put, zero deadline and version are not recorded
+func newInsert(key string, value any, deadline time.Time, version uint64) (wal.Entry, error) {
+	val, err := toValue(value)
+	if err != nil {
+		return wal.Entry{}, err
+	}
+
+	entry := newEntry(key, val, InsertOp)
+	md := MD(entry.Meta)
+	if !deadline.IsZero() {
+		if !validExpiry(deadline) {
+			return wal.Entry{}, fmt.Errorf("%w: deadline %s", ErrInvalidTTL, deadline)
+		}
+		md = md.withExpiry(deadline)
+	}
+	if version != 0 {
+		md |= versionedFlag
+		entry.Value = append(binary.LittleEndian.AppendUint64(nil, version), entry.Value...)
+	}
+	entry.Meta = uint64(md)
+
+	return entry, nil
+}
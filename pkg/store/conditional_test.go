@@ -0,0 +1,96 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStore_ApplyConditions(t *testing.T) {
+	store := newTestStore(t)
+
+	apply := func(m Mutation) error {
+		t.Helper()
+		return store.Apply(m)
+	}
+
+	if err := apply(Mutation{Op: PutIfAbsentOp, Key: "lock", Value: "a", Version: 10}); err != nil {
+		t.Fatalf("PutIfAbsent on a missing key failed: %v", err)
+	}
+	if err := apply(Mutation{Op: PutIfAbsentOp, Key: "lock", Value: "b", Version: 11}); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("expected ErrKeyExists, got %v", err)
+	}
+
+	// versioned values read as plain ones
+	if value, found, _ := store.GetString("lock"); !found || value != "a" {
+		t.Fatalf("expected a, got %q", value)
+	}
+	if got := collect(t, store.Scan("", "")); got["lock"] != "a" {
+		t.Fatalf("unexpected scan result: %v", got)
+	}
+	if _, version, _, _ := store.GetWithVersion("lock"); version != 10 {
+		t.Fatalf("expected version 10, got %d", version)
+	}
+
+	if err := apply(Mutation{Op: PutIfEqualOp, Key: "lock", Value: "c", Expected: "b", Version: 12}); !errors.Is(err, ErrConditionFailed) || errors.Is(err, ErrKeyExists) {
+		t.Fatalf("expected value mismatch, got %v", err)
+	}
+	if err := apply(Mutation{Op: PutIfEqualOp, Key: "lock", Value: Int64(1), Expected: "a", Version: 13}); err != nil {
+		t.Fatalf("PutIfEqual failed: %v", err)
+	}
+	// equal encodings of different types are not equal values
+	if err := apply(Mutation{Op: PutIfEqualOp, Key: "lock", Value: "d", Expected: Float64(0), Version: 14}); !errors.Is(err, ErrConditionFailed) {
+		t.Fatalf("expected type mismatch to fail the condition, got %v", err)
+	}
+
+	if err := apply(Mutation{Op: DeleteIfVersionOp, Key: "lock", ExpectedVersion: 10}); !errors.Is(err, ErrConditionFailed) {
+		t.Fatalf("expected version mismatch, got %v", err)
+	}
+	if err := apply(Mutation{Op: DeleteIfVersionOp, Key: "lock", ExpectedVersion: 13}); err != nil {
+		t.Fatalf("DeleteIfVersion failed: %v", err)
+	}
+	if _, found, _ := store.Get("lock"); found {
+		t.Fatal("key must be deleted")
+	}
+	if err := apply(Mutation{Op: DeleteIfVersionOp, Key: "lock", ExpectedVersion: 13}); !errors.Is(err, ErrConditionFailed) {
+		t.Fatalf("expected missing key to fail the condition, got %v", err)
+	}
+
+	// an expired key is absent for conditions as well
+	deadline := time.Now().Add(-time.Second)
+	if err := apply(Mutation{Op: InsertOp, Key: "session", Value: "x", Version: 20, ExpiresAt: deadline}); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if err := apply(Mutation{Op: PutIfAbsentOp, Key: "session", Value: "y", Version: 21}); err != nil {
+		t.Fatalf("PutIfAbsent on an expired key failed: %v", err)
+	}
+}
+
+func TestStore_ApplyConditionsIgnoreLocalClock(t *testing.T) {
+	// replicas with clocks on both sides of the deadline
+	before, advance := fakeNow()
+	after, _ := fakeNow()
+	advance(2 * time.Minute)
+	replicas := []*Store{newTestStore(t), newTestStore(t)}
+	replicas[0].now, replicas[1].now = before, after
+
+	deadline := before().Add(time.Minute)
+	appliedAt := deadline.Add(-time.Second)
+	for i, store := range replicas {
+		if err := store.Apply(Mutation{Op: InsertOp, Key: "session", Value: "x", Version: 1, ExpiresAt: deadline}); err != nil {
+			t.Fatalf("replica %d: Apply failed: %v", i, err)
+		}
+		err := store.Apply(Mutation{Op: PutIfAbsentOp, Key: "session", Value: "y", Version: 2, AppliedAt: appliedAt})
+		if !errors.Is(err, ErrKeyExists) {
+			t.Fatalf("replica %d: expected ErrKeyExists before the deadline, got %v", i, err)
+		}
+		err = store.Apply(Mutation{Op: PutIfEqualOp, Key: "session", Value: "z", Expected: "x", Version: 3, ExpiresAt: deadline, AppliedAt: appliedAt})
+		if err != nil {
+			t.Fatalf("replica %d: PutIfEqual before the deadline failed: %v", i, err)
+		}
+		err = store.Apply(Mutation{Op: DeleteIfVersionOp, Key: "session", ExpectedVersion: 3, AppliedAt: deadline.Add(time.Second)})
+		if !errors.Is(err, ErrConditionFailed) {
+			t.Fatalf("replica %d: expected the expired key to fail the condition, got %v", i, err)
+		}
+	}
+}
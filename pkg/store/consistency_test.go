@@ -21,6 +21,7 @@ func TestDataConsistency(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %v", err)
 	}
+	defer store.Close()
 
 	// Test data consistency
 	t.Run("BasicConsistency", func(t *testing.T) {
@@ -142,6 +143,7 @@ func TestConcurrentConsistency(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %v", err)
 	}
+	defer store.Close()
 
 	// Test concurrent writes to different keys
 	done := make(chan bool, 10)
@@ -197,6 +199,7 @@ func TestTransactionConsistency(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %v", err)
 	}
+	defer store.Close()
 
 	// Simulate transaction: write multiple keys
 	keys := []string{"tx_key1", "tx_key2", "tx_key3"}
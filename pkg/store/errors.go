@@ -1,9 +1,21 @@
 package store
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrWALNotInitialized     = errors.New("WAL not initialized")
+	ErrStoreClosed           = errors.New("store is closed")
 	ErrValueTypeNotSupported = errors.New("value type not supported")
 	ErrValueTypeMismatch     = errors.New("value type mismatch")
+	ErrInvalidJSON           = errors.New("invalid JSON value")
+	ErrInvalidTTL            = errors.New("invalid TTL")
+	ErrCorruptedValue        = errors.New("corrupted value")
+
+	// ErrConditionFailed is returned when the condition of a conditional write does not hold
+	ErrConditionFailed = errors.New("condition failed")
+	// ErrKeyExists is the ErrConditionFailed of a put if absent
+	ErrKeyExists = fmt.Errorf("%w: key exists", ErrConditionFailed)
 )
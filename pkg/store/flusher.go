@@ -5,6 +5,7 @@ import (
 	"lsmdb/pkg/listener"
 	"lsmdb/pkg/memtable"
 	"lsmdb/pkg/persistence"
+	"time"
 )
 
 type Flusher struct {
@@ -13,6 +14,10 @@ type Flusher struct {
 	lvlManager *persistence.LevelManager
 	manifest   *persistence.Manifest
 	dataDir    string
+	bitsPerKey int
+	now        func() time.Time
+	// flushed is called once the table is readable from SSTables
+	flushed func(memtable.SortedSet)
 }
 
 func NewFlusher(
@@ -20,11 +25,17 @@ func NewFlusher(
 	dataDir string,
 	manager *persistence.LevelManager,
 	manifest *persistence.Manifest,
+	bitsPerKey int,
+	now func() time.Time,
+	flushed func(memtable.SortedSet),
 ) *Flusher {
 	flusher := &Flusher{
 		lvlManager: manager,
 		manifest:   manifest,
 		dataDir:    dataDir,
+		bitsPerKey: bitsPerKey,
+		now:        now,
+		flushed:    flushed,
 	}
 	flusher.Listener = listener.New(in, flusher.flush)
 	return flusher
@@ -34,6 +45,7 @@ func (f *Flusher) flush(ss memtable.SortedSet) error {
 	snapshot := ss.Sorted()
 
 	if len(snapshot) == 0 {
+		f.flushed(ss)
 		return nil
 	}
 
@@ -42,21 +54,25 @@ func (f *Flusher) flush(ss memtable.SortedSet) error {
 	filePath := fmt.Sprintf("%s/L0_%d.sst", f.dataDir, tableID)
 
 	// Create bloom filter
-	bloom := persistence.NewBloomFilter(uint32(len(snapshot)), 0.01)
+	bloom := persistence.NewBloomFilter(uint32(len(snapshot)), f.bitsPerKey)
 
-	// Create cache
-	cache := persistence.NewBlockCache(100)
+	// Create SSTable sharing the block and table caches of the tree
+	sstable := f.lvlManager.NewSSTable(tableID, filePath, bloom)
 
-	// Create SSTable
-	sstable := persistence.NewSSTable(filePath, bloom, cache)
-
-	// Convert memtable items to SSTable items
+	// Convert memtable items to SSTable items keeping versions open snapshots need,
+	// expired values are written as tombstones
+	pruner := persistence.NewVersionPruner(f.lvlManager.OldestSnapshot(), f.lvlManager.Merger())
+	now := f.now()
 	sstableItems := make([]persistence.SSTableItem, 0, len(snapshot))
 	for _, item := range snapshot {
+		if pruner.Obsolete(item.Key, item.SeqN, item.Meta) {
+			continue
+		}
+		meta, value := expireRecord(item.Meta, item.Value, now)
 		sstableItems = append(sstableItems, persistence.SSTableItem{
 			Key:   item.Key,
-			Value: item.Value,
-			Meta:  item.Meta,
+			Value: value,
+			Meta:  meta,
 			ID:    item.SeqN,
 		})
 	}
@@ -71,16 +87,13 @@ func (f *Flusher) flush(ss memtable.SortedSet) error {
 		return fmt.Errorf("failed to open SSTable: %w", err)
 	}
 
-	// Add to level manager (L0)
+	// Add to level manager (L0), the manifest records the table
+	// together with the persistent seq number
+	f.manifest.UpdateMeta(sstableItems)
 	if err := f.lvlManager.AddSSTable(sstable, 0); err != nil {
 		return fmt.Errorf("failed to add SSTable to level manager: %w", err)
 	}
 
-	f.manifest.AddTable(tableID, filePath, 0, sstable.ApproximateSize())
-	f.manifest.UpdateMeta(sstableItems)
-	if err := f.manifest.Save(); err != nil {
-		return fmt.Errorf("failed to add table to manifest: %w", err)
-	}
-
+	f.flushed(ss)
 	return nil
 }
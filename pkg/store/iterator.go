@@ -0,0 +1,231 @@
+package store
+
+import (
+	"bytes"
+	"lsmdb/pkg/persistence"
+	"lsmdb/pkg/types"
+	"time"
+)
+
+// Iterator walks over live keys of the store in ascending order.
+// Deleted keys are skipped, only the newest version of a key
+// not newer than the iterator sequence number is returned,
+// merge operands are folded into the older value.
+type Iterator struct {
+	merged *persistence.MergingIterator
+	end    []byte
+	seqN   types.SeqN
+	// now is the time expiry of records is checked against
+	now   time.Time
+	merge func(key string, base storable, operands []storable) (storable, error)
+	// resolve reads values kept in the value log
+	resolve func(md MD, raw []byte) (MD, []byte, error)
+	// release unpins the sequence number of the iterator
+	release func()
+	// ahead is set when folding operands moved merged to the next key already
+	ahead bool
+
+	// lastKey is the key whose visible version is already processed
+	lastKey []byte
+	hasLast bool
+
+	key   string
+	value storable
+	err   error
+}
+
+// Scan returns an iterator over keys in range [start, end).
+// An empty end means the range is unbounded.
+func (s *Store) Scan(start, end string) *Iterator {
+	return s.scan(start, end, "")
+}
+
+// Prefix returns an iterator over all keys starting with prefix
+func (s *Store) Prefix(prefix string) *Iterator {
+	return s.scan(prefix, string(prefixSuccessor([]byte(prefix))), prefix)
+}
+
+func (s *Store) scan(start, end, prefix string) *Iterator {
+	// the iterator is pinned like a snapshot, so value log files
+	// it may read survive garbage collection until Close
+	seqN := s.snapshots.acquire(s.inflight.visible)
+	it := s.scanAt(start, end, prefix, seqN)
+	it.release = func() { s.snapshots.release(seqN) }
+	return it
+}
+
+// scanAt iterates over keys in range [start, end) as of seqN, a non-empty prefix
+// every key of the range starts with lets prefix filters skip tables
+func (s *Store) scanAt(start, end, prefix string, seqN types.SeqN) *Iterator {
+	children := make([]persistence.Iterator, 0)
+	for _, it := range s.mt.Iterators() {
+		children = append(children, it)
+	}
+	if prefix != "" {
+		children = append(children, s.levelManager.PrefixIterators([]byte(prefix))...)
+	} else {
+		children = append(children, s.levelManager.Iterators()...)
+	}
+
+	it := &Iterator{
+		merged:  persistence.NewMergingIterator(children...),
+		seqN:    seqN,
+		now:     s.now(),
+		merge:   s.fullMerge,
+		resolve: s.values.resolve,
+	}
+	if end != "" {
+		it.end = []byte(end)
+	}
+
+	it.merged.Seek([]byte(start))
+	it.settle()
+
+	return it
+}
+
+// prefixSuccessor returns the smallest key greater than every key with the given prefix,
+// nil means there is no such key
+func prefixSuccessor(prefix []byte) []byte {
+	succ := bytes.Clone(prefix)
+	for i := len(succ) - 1; i >= 0; i-- {
+		if succ[i] < 0xff {
+			succ[i]++
+			return succ[:i+1]
+		}
+	}
+	return nil
+}
+
+// settle skips invisible versions, tombstones and expired values and stops at the end of the range
+func (it *Iterator) settle() {
+	it.value = nil
+	for ; it.merged.Valid(); it.merged.Next() {
+		key := it.merged.Key()
+		if it.end != nil && bytes.Compare(key, it.end) >= 0 {
+			break
+		}
+
+		// versions of a key go from newest to oldest, the first one
+		// not newer than seqN is visible and the rest are shadowed
+		if it.merged.SeqN() > it.seqN {
+			continue
+		}
+		if it.hasLast && bytes.Equal(key, it.lastKey) {
+			continue
+		}
+		it.lastKey = append(it.lastKey[:0], key...)
+		it.hasLast = true
+
+		md := MD(it.merged.Meta())
+		if md.hidden(it.now) {
+			continue
+		}
+
+		raw := it.merged.Value()
+		if md.operation() == MergeOp {
+			// folding moves merged, which reuses the buffer of the value
+			raw = bytes.Clone(raw)
+		}
+		md, raw, err := it.resolve(md, raw)
+		if err != nil {
+			it.err = err
+			return
+		}
+		value, _, err := decodeValue(md, raw)
+		if err == nil && md.operation() == MergeOp {
+			value, err = it.fold(value)
+		}
+		if err != nil {
+			it.err = err
+			return
+		}
+		it.key = string(it.lastKey)
+		it.value = value
+		return
+	}
+
+	if err := it.merged.Error(); err != nil {
+		it.err = err
+	}
+}
+
+// fold collects the older versions of the current key up to the complete value
+// and applies the operand to it. It leaves merged on the last version read
+// or, when the key has no value below the operands, on the next key.
+func (it *Iterator) fold(operand storable) (storable, error) {
+	operands := []storable{operand}
+	var base storable
+	for {
+		it.merged.Next()
+		if !it.merged.Valid() || !bytes.Equal(it.merged.Key(), it.lastKey) {
+			it.ahead = true
+			break
+		}
+
+		md := MD(it.merged.Meta())
+		if md.hidden(it.now) {
+			break
+		}
+		md, raw, err := it.resolve(md, bytes.Clone(it.merged.Value()))
+		if err != nil {
+			return nil, err
+		}
+		value, _, err := decodeValue(md, raw)
+		if err != nil {
+			return nil, err
+		}
+		if md.operation() != MergeOp {
+			base = value
+			break
+		}
+		operands = append(operands, value)
+	}
+	if err := it.merged.Error(); err != nil {
+		return nil, err
+	}
+
+	return it.merge(string(it.lastKey), base, operands)
+}
+
+// Valid checks if the iterator is positioned on a live key
+func (it *Iterator) Valid() bool {
+	return it.err == nil && it.value != nil
+}
+
+// Next moves to the next live key
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	if it.ahead {
+		it.ahead = false
+	} else {
+		it.merged.Next()
+	}
+	it.settle()
+}
+
+// Key returns the current key
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the current value
+func (it *Iterator) Value() storable {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases resources held by the iterator
+func (it *Iterator) Close() error {
+	if it.release != nil {
+		it.release()
+		it.release = nil
+	}
+	return it.merged.Close()
+}
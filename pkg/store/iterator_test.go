@@ -0,0 +1,138 @@
+package store
+
+import (
+	"fmt"
+	"lsmdb/pkg/config"
+	"lsmdb/pkg/wal"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.Persistence.RootPath = t.TempDir()
+	journal, err := wal.New(cfg.Persistence.RootPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	t.Cleanup(func() { _ = journal.Close() })
+
+	store, err := New(&cfg, journal)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := store.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	})
+	return store
+}
+
+func collect(t *testing.T, it *Iterator) map[string]string {
+	t.Helper()
+	defer func() { _ = it.Close() }()
+
+	result := make(map[string]string)
+	prev := ""
+	for ; it.Valid(); it.Next() {
+		if prev != "" && it.Key() <= prev {
+			t.Fatalf("keys are not ordered: %q after %q", it.Key(), prev)
+		}
+		prev = it.Key()
+
+		str, ok := it.Value().(String)
+		if !ok {
+			t.Fatalf("unexpected value type for %s", it.Key())
+		}
+		result[it.Key()] = string(str)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("iteration failed: %v", err)
+	}
+	return result
+}
+
+func TestStore_Scan(t *testing.T) {
+	store := newTestStore(t)
+
+	// enough data to rotate the memtable several times
+	for i := 0; i < 100; i++ {
+		if err := store.PutString(fmt.Sprintf("scan_key%03d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatalf("PutString failed: %v", err)
+		}
+	}
+	if err := store.PutString("scan_key010", "updated"); err != nil {
+		t.Fatalf("PutString failed: %v", err)
+	}
+	if err := store.Delete("scan_key011"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	got := collect(t, store.Scan("scan_key005", "scan_key015"))
+	if len(got) != 9 {
+		t.Fatalf("expected 9 keys, got %d: %v", len(got), got)
+	}
+	if got["scan_key010"] != "updated" {
+		t.Fatalf("expected newest value, got %q", got["scan_key010"])
+	}
+	if _, ok := got["scan_key011"]; ok {
+		t.Fatal("deleted key must be hidden")
+	}
+	if _, ok := got["scan_key015"]; ok {
+		t.Fatal("end of range must be exclusive")
+	}
+
+	all := collect(t, store.Scan("", ""))
+	if len(all) != 99 {
+		t.Fatalf("expected 99 keys in full scan, got %d", len(all))
+	}
+}
+
+func TestStore_Prefix(t *testing.T) {
+	store := newTestStore(t)
+
+	for _, key := range []string{"tenant/1/a", "tenant/1/b", "tenant/2/a", "tenant/10/a", "tenant0"} {
+		if err := store.PutString(key, key); err != nil {
+			t.Fatalf("PutString failed: %v", err)
+		}
+	}
+
+	got := collect(t, store.Prefix("tenant/1/"))
+	if len(got) != 2 || got["tenant/1/a"] == "" || got["tenant/1/b"] == "" {
+		t.Fatalf("unexpected prefix result: %v", got)
+	}
+}
+
+func TestStore_PrefixFilter(t *testing.T) {
+	cfg := config.Default()
+	cfg.Persistence.RootPath = t.TempDir()
+	cfg.Persistence.BloomFilter.Prefix.Length = len("tenant/1/")
+
+	store := openStore(t, &cfg)
+	for _, key := range []string{"tenant/1/a", "tenant/1/b", "tenant/2/a", "tenant/10/a", "tenant0"} {
+		if err := store.PutString(key, key); err != nil {
+			t.Fatalf("PutString failed: %v", err)
+		}
+	}
+	// closing flushes the memtable into a table with a prefix filter
+	closeStore(t, store)
+
+	store = openStore(t, &cfg)
+	defer closeStore(t, store)
+
+	got := collect(t, store.Prefix("tenant/1/"))
+	if len(got) != 2 || got["tenant/1/a"] == "" || got["tenant/1/b"] == "" {
+		t.Fatalf("unexpected prefix result: %v", got)
+	}
+	if store.levelManager.L0Tables() == 0 {
+		t.Fatal("expected a flushed table")
+	}
+	if iters := store.levelManager.PrefixIterators([]byte("tenant/3/")); len(iters) != 0 {
+		t.Fatalf("expected the table to be skipped, got %d iterators", len(iters))
+	}
+	if got := collect(t, store.Prefix("tenant/3/")); len(got) != 0 {
+		t.Fatalf("unexpected prefix result: %v", got)
+	}
+}
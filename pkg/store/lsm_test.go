@@ -1,12 +1,16 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"lsmdb/pkg/config"
 	"lsmdb/pkg/wal"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // TestLSMTreeFlow tests the complete LSM-tree data flow
@@ -27,6 +31,7 @@ func TestLSMTreeFlow(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %v", err)
 	}
+	defer store.Close()
 	// Test data flow
 	t.Run("MemtableOperations", func(t *testing.T) {
 		// Put data that should stay in memtable
@@ -144,6 +149,7 @@ func TestWALFunctionality(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %v", err)
 	}
+	defer store.Close()
 
 	// Add some data
 	err = store.PutString("wal_test_key", "wal_test_value")
@@ -151,10 +157,10 @@ func TestWALFunctionality(t *testing.T) {
 		t.Fatalf("PutString failed: %v", err)
 	}
 
-	// Check if WAL file exists
-	walPath := filepath.Join(tempDir, "wal.log")
-	if _, err := os.Stat(walPath); os.IsNotExist(err) {
-		t.Fatal("WAL file should exist")
+	// Check if WAL segment exists
+	segments, err := filepath.Glob(filepath.Join(tempDir, "wal-*.log"))
+	if err != nil || len(segments) == 0 {
+		t.Fatal("WAL segment should exist")
 	}
 
 	// Verify data is still accessible
@@ -170,6 +176,202 @@ func TestWALFunctionality(t *testing.T) {
 	}
 }
 
+// TestWALSegmentTruncation tests that flushed WAL segments are removed
+// and the rest is enough to restore data after restart
+func TestWALSegmentTruncation(t *testing.T) {
+	tempDir := t.TempDir()
+	cfg := config.Default()
+	cfg.Persistence.RootPath = tempDir
+
+	journal, err := wal.New(cfg.Persistence.RootPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	store, err := New(&cfg, journal)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	// every memtable rotation starts a new segment
+	for i := 0; i < 200; i++ {
+		if err := store.PutString(fmtKey(i), fmtValue(i)); err != nil {
+			t.Fatalf("PutString failed: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		segments, _ := filepath.Glob(filepath.Join(tempDir, "wal-*.log"))
+		if len(segments) > 0 && len(segments) <= cfg.Memtable.MaxImmTables+1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("flushed WAL segments are not removed, %d left", len(segments))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "wal-00000001.log")); !os.IsNotExist(err) {
+		t.Fatal("the first segment must be removed after flush")
+	}
+
+	store.Close()
+	journal.Close()
+
+	journal, err = wal.New(cfg.Persistence.RootPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer journal.Close()
+	store, err = New(&cfg, journal)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	for i := 0; i < 200; i++ {
+		value, found, err := store.GetString(fmtKey(i))
+		if err != nil || !found || value != fmtValue(i) {
+			t.Fatalf("key %s is lost after restart: %v", fmtKey(i), err)
+		}
+	}
+}
+
+func TestWALKeepsSegmentsOfUnappliedWrites(t *testing.T) {
+	cfg := config.Default()
+	cfg.Persistence.RootPath = t.TempDir()
+	store := openStore(t, &cfg)
+
+	// a write journaled but not in the memtable yet, as if its writer was paused
+	entry := newEntry("paused", String("value"), InsertOp)
+	first, logNum := store.inflight.begin(1)
+	entry.SeqNum = first
+	if err := <-store.jr.Append(entry); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	// later writes rotate the journal and are flushed with higher seq numbers,
+	// they return only once the paused write is applied
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.PutString(fmtKey(i), fmtValue(i)); err != nil {
+				t.Errorf("PutString failed: %v", err)
+			}
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for store.manifest.PersistentID() <= first {
+		if time.Now().After(deadline) {
+			t.Fatal("memtable is not flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := store.trimJournal(); err != nil {
+		t.Fatalf("trimJournal failed: %v", err)
+	}
+
+	// recovery still replays the segment of the paused write
+	if store.manifest.LogNumber() > logNum {
+		t.Fatalf("log number %d is past the segment %d of the paused write", store.manifest.LogNumber(), logNum)
+	}
+	found := false
+	if err := store.jr.Replay(store.manifest.LogNumber(), func(e wal.Entry) error {
+		found = found || e.SeqNum == first
+		return nil
+	}); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if !found {
+		t.Fatal("journal segment of the paused write is removed")
+	}
+
+	if err := store.mt.Upsert(entry.Key, entry.Value, entry.SeqNum, entry.Meta, logNum); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	store.inflight.end(first)
+	wg.Wait()
+	closeStore(t, store)
+
+	store = openStore(t, &cfg)
+	defer closeStore(t, store)
+	if value, found, err := store.GetString("paused"); err != nil || !found || value != "value" {
+		t.Fatalf("paused write is lost after restart: %q, %v, %v", value, found, err)
+	}
+}
+
+func TestStore_CloseFlushesMemtables(t *testing.T) {
+	cfg := config.Default()
+	cfg.Persistence.RootPath = t.TempDir()
+
+	journal, err := wal.New(cfg.Persistence.RootPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	store, err := New(&cfg, journal)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	// enough writes to leave both immutable and active tables behind
+	const n = 100
+	for i := 0; i < n; i++ {
+		if err := store.PutString(fmtKey(i), fmtValue(i)); err != nil {
+			t.Fatalf("PutString failed: %v", err)
+		}
+	}
+	if err := store.Delete(fmtKey(0)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("second Close failed: %v", err)
+	}
+	if err := store.PutString("late", "value"); !errors.Is(err, ErrStoreClosed) {
+		t.Fatalf("expected ErrStoreClosed, got %v", err)
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	journal, err = wal.New(cfg.Persistence.RootPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer journal.Close()
+
+	replayed := 0
+	if err := journal.Replay(0, func(wal.Entry) error {
+		replayed++
+		return nil
+	}); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if replayed != 0 {
+		t.Fatalf("journal still holds %d entries after a clean stop", replayed)
+	}
+
+	store, err = New(&cfg, journal)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+
+	if _, found, _ := store.GetString(fmtKey(0)); found {
+		t.Fatal("deleted key is back after restart")
+	}
+	for i := 1; i < n; i++ {
+		value, found, err := store.GetString(fmtKey(i))
+		if err != nil || !found || value != fmtValue(i) {
+			t.Fatalf("key %s is lost after restart: %v", fmtKey(i), err)
+		}
+	}
+}
+
 // TestSSTableCreation tests SSTable creation and management
 func TestSSTableCreation(t *testing.T) {
 	tempDir := t.TempDir()
@@ -187,6 +389,7 @@ func TestSSTableCreation(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %v", err)
 	}
+	defer store.Close()
 
 	// Add data to potentially trigger SSTable creation
 	for i := 0; i < 20; i++ {
@@ -204,17 +407,17 @@ func TestSSTableCreation(t *testing.T) {
 		t.Fatalf("Failed to read data directory: %v", err)
 	}
 
-	// Should have at least WAL file
+	// Should have at least WAL segment
 	hasWAL := false
 	for _, file := range files {
-		if file.Name() == "wal.log" {
+		if strings.HasPrefix(file.Name(), "wal-") {
 			hasWAL = true
 			break
 		}
 	}
 
 	if !hasWAL {
-		t.Fatal("WAL file should exist")
+		t.Fatal("WAL segment should exist")
 	}
 
 	// Verify all data is accessible
@@ -251,6 +454,7 @@ func TestCompactionBehavior(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %v", err)
 	}
+	defer store.Close()
 
 	// Add data in smaller batches to avoid SSTable issues
 	batches := []int{5, 10, 15}
@@ -310,6 +514,7 @@ func TestConcurrentOperations(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %v", err)
 	}
+	defer store.Close()
 
 	// Concurrent writes (reduced to avoid SSTable issues)
 	done := make(chan bool, 5)
@@ -1,15 +1,89 @@
 package store
 
+import "time"
+
+// MD is the record metadata:
+//
+//	op(6) | pointer(1) | versioned(1) | valType(8) | expiry(48)
+//
+// expiry is the deadline in unix milliseconds, 0 means the record never expires.
+// The value of a versioned record starts with version(8) of the write.
+// The value of a pointer record is a vlog.Pointer to the value log record
+// holding the value.
 type MD uint64
 
+const (
+	opMask        MD = 1<<6 - 1
+	pointerFlag   MD = 1 << 6
+	versionedFlag MD = 1 << 7
+	versionSize      = 8
+
+	expiryShift = 16
+	maxExpiry   = 1<<(64-expiryShift) - 1
+)
+
 func newMD(op Operation, valType valType) MD {
 	return MD(uint64(valType)<<8 | uint64(op))
 }
 
 func (md MD) operation() Operation {
-	return Operation(uint64(md) & 0xff)
+	return Operation(md & opMask)
+}
+
+// withOperation returns the metadata with the operation replaced
+func (md MD) withOperation(op Operation) MD {
+	return md&^opMask | MD(op)
+}
+
+// pointer reports whether the value is kept in the value log
+func (md MD) pointer() bool {
+	return md&pointerFlag != 0
+}
+
+func (md MD) versioned() bool {
+	return md&versionedFlag != 0
 }
 
 func (md MD) valType() valType {
-	return valType(md >> 8)
+	return valType(md >> 8 & 0xff)
+}
+
+// withExpiry returns the metadata with the deadline set, the deadline
+// must be checked by validExpiry
+func (md MD) withExpiry(deadline time.Time) MD {
+	return md&(1<<expiryShift-1) | MD(deadline.UnixMilli())<<expiryShift
+}
+
+// expiresAt returns the deadline of the record if it has one
+func (md MD) expiresAt() (time.Time, bool) {
+	ms := int64(md >> expiryShift)
+	if ms == 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+// expired reports whether the record deadline has passed
+func (md MD) expired(now time.Time) bool {
+	deadline, ok := md.expiresAt()
+	return ok && !now.Before(deadline)
+}
+
+// hidden reports whether readers must treat the record as absent
+func (md MD) hidden(now time.Time) bool {
+	return md.operation() == DeleteOp || md.expired(now)
+}
+
+func validExpiry(deadline time.Time) bool {
+	ms := deadline.UnixMilli()
+	return ms > 0 && ms <= maxExpiry
+}
+
+// expireRecord turns an expired value into a tombstone, which still
+// shadows older versions of the key but does not keep the value
+func expireRecord(meta uint64, value []byte, now time.Time) (uint64, []byte) {
+	if MD(meta).operation() != InsertOp || !MD(meta).expired(now) {
+		return meta, value
+	}
+	return uint64(newMD(DeleteOp, vTypeTombstone)), nil
 }
@@ -0,0 +1,260 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"lsmdb/pkg/persistence"
+	"time"
+)
+
+// MergeOperator combines merge operands with the value they apply to.
+// It must be deterministic, reads and compactions fold the same operands
+// at different times and must get the same result.
+type MergeOperator interface {
+	// Merge returns the value of the key after applying operands, oldest first,
+	// to base, which is nil when the key has no value
+	Merge(key string, base any, operands []any) (any, error)
+}
+
+// MergeFunc is a MergeOperator applying operands one by one
+type MergeFunc func(key string, base, operand any) (any, error)
+
+// Merge folds operands into base pairwise
+func (f MergeFunc) Merge(key string, base any, operands []any) (any, error) {
+	var err error
+	for _, operand := range operands {
+		if base, err = f(key, base, operand); err != nil {
+			return nil, err
+		}
+	}
+	return base, nil
+}
+
+var (
+	// Int64Add sums integer operands, an absent value counts as zero
+	Int64Add MergeOperator = MergeFunc(addInt64)
+	// StringAppend concatenates string operands
+	StringAppend MergeOperator = MergeFunc(appendString)
+	// JSONMergePatch applies JSON operands as RFC 7386 merge patches
+	JSONMergePatch MergeOperator = MergeFunc(patchJSON)
+	// DefaultMergeOperator picks one of the operators above by the operand type
+	DefaultMergeOperator MergeOperator = MergeFunc(mergeByType)
+)
+
+func mergeByType(key string, base, operand any) (any, error) {
+	switch operand.(type) {
+	case Int32, Int64:
+		return addInt64(key, base, operand)
+	case String:
+		return appendString(key, base, operand)
+	case JSON:
+		return patchJSON(key, base, operand)
+	default:
+		return nil, fmt.Errorf("%w: merge of %T", ErrValueTypeNotSupported, operand)
+	}
+}
+
+func asInt64(v any) (int64, bool) {
+	switch typed := v.(type) {
+	case nil:
+		return 0, true
+	case Int32:
+		return int64(typed), true
+	case Int64:
+		return int64(typed), true
+	default:
+		return 0, false
+	}
+}
+
+func addInt64(_ string, base, operand any) (any, error) {
+	a, ok := asInt64(base)
+	if !ok {
+		return nil, ErrValueTypeMismatch
+	}
+	b, ok := asInt64(operand)
+	if !ok || operand == nil {
+		return nil, ErrValueTypeMismatch
+	}
+	return Int64(a + b), nil
+}
+
+func appendString(_ string, base, operand any) (any, error) {
+	var a String
+	if base != nil {
+		var ok bool
+		if a, ok = base.(String); !ok {
+			return nil, ErrValueTypeMismatch
+		}
+	}
+	b, ok := operand.(String)
+	if !ok {
+		return nil, ErrValueTypeMismatch
+	}
+	return a + b, nil
+}
+
+func patchJSON(_ string, base, operand any) (any, error) {
+	var target any
+	if base != nil {
+		doc, ok := base.(JSON)
+		if !ok {
+			return nil, ErrValueTypeMismatch
+		}
+		if err := decodeJSON(doc, &target); err != nil {
+			return nil, err
+		}
+	}
+	doc, ok := operand.(JSON)
+	if !ok {
+		return nil, ErrValueTypeMismatch
+	}
+	var patch any
+	if err := decodeJSON(doc, &patch); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode merged JSON: %w", err)
+	}
+	return JSON(data), nil
+}
+
+// decodeJSON keeps numbers as they are written, so merging does not round them
+func decodeJSON(doc JSON, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+	return nil
+}
+
+// mergePatch applies the patch to the target as defined by RFC 7386
+func mergePatch(target, patch any) any {
+	fields, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	doc, ok := target.(map[string]any)
+	if !ok {
+		doc = make(map[string]any, len(fields))
+	}
+	for name, value := range fields {
+		if value == nil {
+			delete(doc, name)
+			continue
+		}
+		doc[name] = mergePatch(doc[name], value)
+	}
+	return doc
+}
+
+// SetMergeOperator sets the operator folding values written by Merge,
+// DefaultMergeOperator is used until it is called
+func (s *Store) SetMergeOperator(op MergeOperator) {
+	s.mergeMu.Lock()
+	defer s.mergeMu.Unlock()
+	s.mergeOp = op
+}
+
+func (s *Store) mergeOperator() MergeOperator {
+	s.mergeMu.RLock()
+	defer s.mergeMu.RUnlock()
+	return s.mergeOp
+}
+
+// Merge records an operand the merge operator applies to the current value
+// of the key, the operands are folded when the key is read or compacted
+func (s *Store) Merge(key string, operand any) error {
+	val, err := toValue(operand)
+	if err != nil {
+		return err
+	}
+	return s.put(key, val, MergeOp)
+}
+
+// fullMerge applies operands, newest first, to base
+func (s *Store) fullMerge(key string, base storable, operands []storable) (storable, error) {
+	values := make([]any, len(operands))
+	for i, operand := range operands {
+		values[len(operands)-1-i] = operand
+	}
+
+	var baseValue any
+	if base != nil {
+		baseValue = base
+	}
+	merged, err := s.mergeOperator().Merge(key, baseValue, values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge %s: %w", key, err)
+	}
+	val, err := toValue(merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge %s: %w", key, err)
+	}
+	return val, nil
+}
+
+// merger folds merge operands of the store during compaction
+type merger struct {
+	store *Store
+}
+
+func (m merger) IsOperand(meta uint64) bool {
+	return MD(meta).operation() == MergeOp
+}
+
+func (m merger) Merge(key []byte, operands []persistence.SSTableItem, base *persistence.SSTableItem) (persistence.SSTableItem, error) {
+	now := m.store.now()
+
+	var baseValue storable
+	if base != nil {
+		md := MD(base.Meta)
+		// a value expiring later changes the result of reads once it expires
+		if _, ok := md.expiresAt(); ok && !md.expired(now) {
+			return persistence.SSTableItem{}, persistence.ErrMergeSkipped
+		}
+		if !md.hidden(now) {
+			md, raw, err := m.store.values.resolve(md, base.Value)
+			if err != nil {
+				return persistence.SSTableItem{}, err
+			}
+			val, _, err := decodeValue(md, raw)
+			if err != nil {
+				return persistence.SSTableItem{}, err
+			}
+			baseValue = val
+		}
+	}
+
+	values := make([]storable, len(operands))
+	var version uint64
+	for i, operand := range operands {
+		val, ver, err := decodeValue(MD(operand.Meta), operand.Value)
+		if err != nil {
+			return persistence.SSTableItem{}, err
+		}
+		if i == 0 {
+			version = ver
+		}
+		values[i] = val
+	}
+
+	merged, err := m.store.fullMerge(string(key), baseValue, values)
+	if err != nil {
+		return persistence.SSTableItem{}, err
+	}
+	entry, err := newInsert(string(key), merged, time.Time{}, version)
+	if err != nil {
+		return persistence.SSTableItem{}, err
+	}
+	return persistence.SSTableItem{
+		Key:   key,
+		Value: entry.Value,
+		ID:    operands[0].ID,
+		Meta:  entry.Meta,
+	}, nil
+}
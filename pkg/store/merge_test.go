@@ -0,0 +1,155 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStore_Merge(t *testing.T) {
+	store := newTestStore(t)
+
+	merge := func(key string, operand any) {
+		t.Helper()
+		if err := store.Merge(key, operand); err != nil {
+			t.Fatalf("Merge %s failed: %v", key, err)
+		}
+	}
+
+	// counters start from zero
+	merge("hits", 1)
+	merge("hits", Int32(2))
+	if value, found, err := store.GetInt64("hits"); err != nil || !found || value != 3 {
+		t.Fatalf("expected 3 hits, got %d, %v", value, err)
+	}
+	if err := store.Put("visits", 10); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	merge("visits", 5)
+	merge("visits", -1)
+	if value, _, err := store.GetInt64("visits"); err != nil || value != 14 {
+		t.Fatalf("expected 14 visits, got %d, %v", value, err)
+	}
+
+	if err := store.PutString("log", "a"); err != nil {
+		t.Fatalf("PutString failed: %v", err)
+	}
+	sn := store.NewSnapshot()
+	defer sn.Release()
+	merge("log", "b")
+	merge("log", "c")
+	if value, _, err := store.GetString("log"); err != nil || value != "abc" {
+		t.Fatalf("expected abc, got %q, %v", value, err)
+	}
+	if value, _ := snapshotString(t, sn, "log"); value != "a" {
+		t.Fatalf("snapshot must not see later operands, got %q", value)
+	}
+	if got := collect(t, store.Prefix("log")); got["log"] != "abc" {
+		t.Fatalf("unexpected scan result: %v", got)
+	}
+
+	// a deleted value is not merged with
+	if err := store.Delete("log"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	merge("log", "x")
+	if value, _, _ := store.GetString("log"); value != "x" {
+		t.Fatalf("expected x after delete, got %q", value)
+	}
+
+	if err := store.PutJSON("doc", map[string]any{"a": 1, "b": map[string]any{"c": 2}}); err != nil {
+		t.Fatalf("PutJSON failed: %v", err)
+	}
+	merge("doc", JSON(`{"b":{"c":null,"d":3},"e":"f"}`))
+	if doc, _, err := store.GetJSON("doc"); err != nil || string(doc) != `{"a":1,"b":{"d":3},"e":"f"}` {
+		t.Fatalf("unexpected patched document %s, %v", doc, err)
+	}
+
+	// operands of a wrong type fail reads, not writes
+	merge("log", 1)
+	if _, _, err := store.GetString("log"); !errors.Is(err, ErrValueTypeMismatch) {
+		t.Fatalf("expected ErrValueTypeMismatch, got %v", err)
+	}
+}
+
+func TestStore_SetMergeOperator(t *testing.T) {
+	store := newTestStore(t)
+	store.SetMergeOperator(MergeFunc(func(_ string, base, operand any) (any, error) {
+		if base == nil || operand.(Int64) > base.(Int64) {
+			return operand, nil
+		}
+		return base, nil
+	}))
+
+	for _, v := range []int{3, 7, 5} {
+		if err := store.Merge("max", v); err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+	}
+	if value, _, err := store.GetInt64("max"); err != nil || value != 7 {
+		t.Fatalf("expected 7, got %d, %v", value, err)
+	}
+}
+
+func TestStore_MergeSurvivesFlushAndCompaction(t *testing.T) {
+	store := newTestStore(t)
+
+	const n, rounds = 20, 50
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < n; i++ {
+			if err := store.Merge(fmt.Sprintf("counter%02d", i), i); err != nil {
+				t.Fatalf("Merge failed: %v", err)
+			}
+		}
+	}
+
+	// wait until operands reach SSTables
+	manifest := store.levelManager.Manifest()
+	deadline := time.Now().Add(5 * time.Second)
+	for manifest.PersistentID() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("memtable is not flushed in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	it := store.Prefix("counter")
+	defer func() { _ = it.Close() }()
+	count := 0
+	for ; it.Valid(); it.Next() {
+		var i int
+		if _, err := fmt.Sscanf(it.Key(), "counter%d", &i); err != nil {
+			t.Fatalf("unexpected key %s", it.Key())
+		}
+		if it.Value() != Int64(i*rounds) {
+			t.Fatalf("scan returned %s=%v", it.Key(), it.Value())
+		}
+		count++
+	}
+	if err := it.Err(); err != nil || count != n {
+		t.Fatalf("scan returned %d counters: %v", count, err)
+	}
+
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("counter%02d", i)
+		if value, _, err := store.GetInt64(key); err != nil || value != int64(i*rounds) {
+			t.Fatalf("unexpected %s: %d, %v", key, value, err)
+		}
+	}
+}
+
+func TestStore_ApplyMerge(t *testing.T) {
+	store := newTestStore(t)
+
+	for i, delta := range []int64{2, 3} {
+		if err := store.Apply(Mutation{Op: MergeOp, Key: "n", Value: delta, Version: uint64(i + 1)}); err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+	}
+	// the version of a merged value is the one of its last operand
+	value, version, found, err := store.GetWithVersion("n")
+	if err != nil || !found || value != Int64(5) || version != 2 {
+		t.Fatalf("unexpected merged value %v version %d: %v", value, version, err)
+	}
+}
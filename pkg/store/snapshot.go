@@ -0,0 +1,190 @@
+package store
+
+import (
+	"lsmdb/pkg/persistence"
+	"lsmdb/pkg/types"
+	"sync"
+	"sync/atomic"
+)
+
+// Snapshot is a read-only view of the store pinned at a sequence number.
+// Versions it can see are kept by flushes and compactions until Release.
+type Snapshot struct {
+	store    *Store
+	seqN     types.SeqN
+	released atomic.Bool
+}
+
+// NewSnapshot pins the current state of the store
+func (s *Store) NewSnapshot() *Snapshot {
+	seqN := s.snapshots.acquire(s.inflight.visible)
+	return &Snapshot{
+		store: s,
+		seqN:  seqN,
+	}
+}
+
+// SeqN returns the sequence number the snapshot is pinned at
+func (sn *Snapshot) SeqN() types.SeqN {
+	return sn.seqN
+}
+
+// Get returns the value of the key as of the snapshot
+func (sn *Snapshot) Get(key string) (storable, bool, error) {
+	return sn.store.getAt(key, sn.seqN)
+}
+
+// Scan returns an iterator over keys in range [start, end) as of the snapshot
+func (sn *Snapshot) Scan(start, end string) *Iterator {
+	return sn.store.scanAt(start, end, "", sn.seqN)
+}
+
+// Prefix returns an iterator over keys starting with prefix as of the snapshot
+func (sn *Snapshot) Prefix(prefix string) *Iterator {
+	return sn.store.scanAt(prefix, string(prefixSuccessor([]byte(prefix))), prefix, sn.seqN)
+}
+
+// Release lets compaction drop versions held for the snapshot
+func (sn *Snapshot) Release() {
+	if sn.released.CompareAndSwap(false, true) {
+		sn.store.snapshots.release(sn.seqN)
+	}
+}
+
+// pruneFloor returns the oldest sequence number a flush or compaction starting
+// now keeps versions for. Tables may hold writes not published yet, a snapshot
+// opened later is pinned at the published sequence number or above it.
+func (s *Store) pruneFloor() uint64 {
+	published := s.inflight.visible()
+	return min(published, s.snapshots.oldest())
+}
+
+// snapshotList counts open snapshots per sequence number
+type snapshotList struct {
+	mu   sync.Mutex
+	seqs map[types.SeqN]int
+}
+
+func newSnapshotList() *snapshotList {
+	return &snapshotList{seqs: make(map[types.SeqN]int)}
+}
+
+// acquire registers a snapshot at the sequence number returned by seqN,
+// both happen under the lock so compaction never misses a new snapshot
+func (l *snapshotList) acquire(seqN func() types.SeqN) types.SeqN {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seq := seqN()
+	l.seqs[seq]++
+	return seq
+}
+
+func (l *snapshotList) release(seq types.SeqN) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seqs[seq]--; l.seqs[seq] <= 0 {
+		delete(l.seqs, seq)
+	}
+}
+
+// oldest returns the smallest pinned sequence number or persistence.NoSnapshot
+func (l *snapshotList) oldest() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	oldest := persistence.NoSnapshot
+	for seq := range l.seqs {
+		oldest = min(oldest, seq)
+	}
+	return oldest
+}
+
+// inflightWrites hands out sequence numbers and tracks writes not applied yet,
+// so readers never see a part of concurrent writes or batches
+type inflightWrites struct {
+	mu      sync.Mutex
+	applied *sync.Cond
+	clock   iClock
+	// seqs maps the first sequence number of a write to the journal
+	// segment active when it began, its entries go to that segment or a later one
+	seqs map[types.SeqN]uint64
+	// segment returns the active journal segment
+	segment func() uint64
+
+	// published is the largest sequence number with every write below it applied
+	published atomic.Uint64
+}
+
+func newInflightWrites(clock iClock, segment func() uint64) *inflightWrites {
+	w := &inflightWrites{
+		clock:   clock,
+		seqs:    make(map[types.SeqN]uint64),
+		segment: segment,
+	}
+	w.applied = sync.NewCond(&w.mu)
+	w.published.Store(clock.Val())
+	return w
+}
+
+// begin allocates n consecutive sequence numbers of a new write and returns
+// the first one with the journal segment the write cannot go before
+func (w *inflightWrites) begin(n int) (types.SeqN, uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	first := w.clock.Next()
+	for i := 1; i < n; i++ {
+		w.clock.Next()
+	}
+	logNum := w.segment()
+	w.seqs[first] = logNum
+	return first, logNum
+}
+
+// oldestLog returns the oldest journal segment a write in progress may be in,
+// later writes go to the active segment or a later one
+func (w *inflightWrites) oldestLog() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	oldest := w.segment()
+	for _, logNum := range w.seqs {
+		oldest = min(oldest, logNum)
+	}
+	return oldest
+}
+
+// end marks the write started at first applied or failed
+func (w *inflightWrites) end(first types.SeqN) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.seqs, first)
+
+	published := w.clock.Val()
+	for seq := range w.seqs {
+		published = min(published, seq-1)
+	}
+	w.published.Store(published)
+	w.applied.Broadcast()
+}
+
+// wait blocks until every write up to seq is applied
+func (w *inflightWrites) wait(seq types.SeqN) {
+	if w.published.Load() >= seq {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.published.Load() < seq {
+		w.applied.Wait()
+	}
+}
+
+// visible returns the sequence number reads are pinned at
+func (w *inflightWrites) visible() types.SeqN {
+	return w.published.Load()
+}
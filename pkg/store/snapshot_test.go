@@ -0,0 +1,180 @@
+package store
+
+import (
+	"fmt"
+	"lsmdb/pkg/persistence"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func snapshotString(t *testing.T, sn *Snapshot, key string) (string, bool) {
+	t.Helper()
+
+	value, found, err := sn.Get(key)
+	if err != nil {
+		t.Fatalf("snapshot Get %s failed: %v", key, err)
+	}
+	if !found {
+		return "", false
+	}
+	return string(value.(String)), true
+}
+
+func TestSnapshot_Get(t *testing.T) {
+	store := newTestStore(t)
+
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}} {
+		if err := store.PutString(kv[0], kv[1]); err != nil {
+			t.Fatalf("PutString failed: %v", err)
+		}
+	}
+
+	sn := store.NewSnapshot()
+	defer sn.Release()
+
+	if err := store.PutString("a", "2"); err != nil {
+		t.Fatalf("PutString failed: %v", err)
+	}
+	if err := store.Delete("b"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := store.PutString("c", "2"); err != nil {
+		t.Fatalf("PutString failed: %v", err)
+	}
+
+	if value, found := snapshotString(t, sn, "a"); !found || value != "1" {
+		t.Fatalf("snapshot must see the old value of a, got %q", value)
+	}
+	if value, found := snapshotString(t, sn, "b"); !found || value != "1" {
+		t.Fatalf("snapshot must see b deleted later, got %q", value)
+	}
+	if _, found := snapshotString(t, sn, "c"); found {
+		t.Fatal("snapshot must not see keys written later")
+	}
+
+	if value, _, _ := store.GetString("a"); value != "2" {
+		t.Fatalf("store must see the new value, got %q", value)
+	}
+
+	got := collect(t, sn.Scan("", ""))
+	if len(got) != 2 || got["a"] != "1" || got["b"] != "1" {
+		t.Fatalf("unexpected snapshot scan: %v", got)
+	}
+}
+
+func TestSnapshot_SurvivesFlushAndCompaction(t *testing.T) {
+	store := newTestStore(t)
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		if err := store.PutString(fmt.Sprintf("key%02d", i), "old"); err != nil {
+			t.Fatalf("PutString failed: %v", err)
+		}
+	}
+	sn := store.NewSnapshot()
+	defer sn.Release()
+
+	// overwrite every key many times so old versions reach SSTables and compaction
+	for round := 0; round < 10; round++ {
+		for i := 0; i < n; i++ {
+			if err := store.PutString(fmt.Sprintf("key%02d", i), fmt.Sprintf("new%d", round)); err != nil {
+				t.Fatalf("PutString failed: %v", err)
+			}
+		}
+	}
+
+	// wait until overwritten versions are flushed
+	manifest := store.levelManager.Manifest()
+	deadline := time.Now().Add(5 * time.Second)
+	for manifest.PersistentID() <= n {
+		if time.Now().After(deadline) {
+			t.Fatal("memtable is not flushed in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		if value, found := snapshotString(t, sn, key); !found || value != "old" {
+			t.Fatalf("snapshot lost %s: %q", key, value)
+		}
+		if value, _, _ := store.GetString(key); value != "new9" {
+			t.Fatalf("store returned stale %s: %q", key, value)
+		}
+	}
+
+	got := collect(t, sn.Prefix("key"))
+	if len(got) != n {
+		t.Fatalf("snapshot scan returned %d keys", len(got))
+	}
+	for key, value := range got {
+		if value != "old" {
+			t.Fatalf("snapshot scan returned %s=%s", key, value)
+		}
+	}
+}
+
+func TestSnapshot_OpenedDuringFlushOfUnpublishedWrites(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.PutString("k", "v1"); err != nil {
+		t.Fatalf("PutString failed: %v", err)
+	}
+
+	// a paused write keeps later writes applied but not published
+	first, _ := store.inflight.begin(1)
+	var wg sync.WaitGroup
+	resume := sync.OnceFunc(func() {
+		store.inflight.end(first)
+		wg.Wait()
+	})
+	defer resume()
+	put := func(key, value string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.PutString(key, value); err != nil {
+				t.Errorf("PutString %s failed: %v", key, err)
+			}
+		}()
+	}
+	put("k", "v2")
+	for {
+		if item, ok := store.mt.GetAt([]byte("k"), persistence.NoSnapshot); ok && item.SeqN > first {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the table holding both versions is flushed before the snapshot is opened
+	filler := strings.Repeat("x", 100)
+	for i := 0; i < 20; i++ {
+		put(fmt.Sprintf("filler%02d", i), filler)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		item, err := store.levelManager.GetAt([]byte("k"), persistence.NoSnapshot)
+		if err != nil {
+			t.Fatalf("GetAt failed: %v", err)
+		}
+		if item != nil && store.mt.ImmCount() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("memtable is not flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	sn := store.NewSnapshot()
+	defer sn.Release()
+	if value, found := snapshotString(t, sn, "k"); !found || value != "v1" {
+		t.Fatalf("expected v1 as of the snapshot, got %q found=%v", value, found)
+	}
+
+	resume()
+	if value, _, _ := store.GetString("k"); value != "v2" {
+		t.Fatalf("expected v2 once published, got %q", value)
+	}
+}
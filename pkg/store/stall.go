@@ -0,0 +1,67 @@
+package store
+
+import (
+	"log/slog"
+	"lsmdb/pkg/config"
+	"sync"
+	"time"
+)
+
+// writeController slows writers down and then stops them while flushes
+// or L0 compactions fall behind. The memtable stops writers itself once
+// every immutable table waits for flush.
+type writeController struct {
+	cfg config.WriteStallConfig
+
+	immTables func() int
+	l0Tables  func() int
+
+	mu sync.Mutex
+	// changed is signalled after every flush and compaction
+	changed *sync.Cond
+	stopped bool
+}
+
+func newWriteController(cfg config.WriteStallConfig, immTables, l0Tables func() int) *writeController {
+	c := &writeController{
+		cfg:       cfg,
+		immTables: immTables,
+		l0Tables:  l0Tables,
+	}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+func exceeds(value, threshold int) bool {
+	return threshold > 0 && value >= threshold
+}
+
+// wait delays a write according to the flush and compaction backlog
+func (c *writeController) wait() {
+	if exceeds(c.l0Tables(), c.cfg.StopL0Tables) {
+		c.mu.Lock()
+		for exceeds(c.l0Tables(), c.cfg.StopL0Tables) {
+			if !c.stopped {
+				c.stopped = true
+				slog.Warn("writes are stopped until L0 is compacted", "l0_tables", c.l0Tables())
+			}
+			c.changed.Wait()
+		}
+		if c.stopped {
+			c.stopped = false
+			slog.Info("writes are resumed")
+		}
+		c.mu.Unlock()
+	}
+
+	if exceeds(c.immTables(), c.cfg.SlowdownImmTables) || exceeds(c.l0Tables(), c.cfg.SlowdownL0Tables) {
+		time.Sleep(c.cfg.SlowdownDelay)
+	}
+}
+
+// signal wakes up stopped writers to check the backlog again
+func (c *writeController) signal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.changed.Broadcast()
+}
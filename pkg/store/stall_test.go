@@ -0,0 +1,61 @@
+package store
+
+import (
+	"fmt"
+	"lsmdb/pkg/config"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriteController_StopsUntilCompaction(t *testing.T) {
+	var l0 atomic.Int64
+	l0.Store(12)
+	c := newWriteController(config.WriteStallConfig{
+		SlowdownL0Tables: 8,
+		StopL0Tables:     12,
+		SlowdownDelay:    time.Millisecond,
+	}, func() int { return 0 }, func() int { return int(l0.Load()) })
+
+	done := make(chan struct{})
+	go func() {
+		c.wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("writer must be stopped while L0 is over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a compaction below the stop threshold only slows writers down
+	l0.Store(9)
+	c.signal()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writer is not resumed after compaction")
+	}
+}
+
+func TestStore_ReadsDuringFlushBacklog(t *testing.T) {
+	store := newTestStore(t)
+
+	// every key must stay readable while rotated memtables wait for flush
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if err := store.PutString(key, key); err != nil {
+			t.Fatalf("PutString failed: %v", err)
+		}
+		for j := max(0, i-50); j <= i; j++ {
+			key := fmt.Sprintf("key%03d", j)
+			if value, found, err := store.GetString(key); err != nil || !found || value != key {
+				t.Fatalf("%s is lost after %d writes: %q, %v", key, i, value, err)
+			}
+		}
+	}
+	if got := collect(t, store.Prefix("key")); len(got) != 500 {
+		t.Fatalf("scan returned %d keys", len(got))
+	}
+}
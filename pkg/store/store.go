@@ -2,22 +2,38 @@ package store
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"lsmdb/pkg/clock"
 	"lsmdb/pkg/config"
 	"lsmdb/pkg/listener"
 	"lsmdb/pkg/memtable"
 	"lsmdb/pkg/persistence"
 	"lsmdb/pkg/types"
+	"lsmdb/pkg/vlog"
 	"lsmdb/pkg/wal"
+	"sync"
+	"time"
 )
 
 type iJournal interface {
 	listener.Job
 
-	Append(e wal.Entry)
-	Done() <-chan uint64
+	// Append writes the entries as a single record and returns
+	// a channel receiving the result of its commit
+	Append(entries ...wal.Entry) <-chan error
+	// Replay reads entries of journal segments numbered from start
 	Replay(start uint64, callback func(wal.Entry) error) error
+	// Rotate starts a new journal segment
+	Rotate() error
+	// Segment returns the number of the active journal segment
+	Segment() uint64
+	// Truncate drops journal segments numbered below before
+	Truncate(before uint64) error
+	// OnCommit sets a function called before every group of records is written
+	OnCommit(fn func() error)
 }
 
 type iClock interface {
@@ -32,9 +48,28 @@ type Store struct {
 	cfg  *config.Config
 
 	levelManager *persistence.LevelManager
+	manifest     *persistence.Manifest
 	mt           *memtable.Memtable
+	values       *valueLog
 
-	close func()
+	inflight  *inflightWrites
+	snapshots *snapshotList
+	stall     *writeController
+
+	// now is the clock TTL deadlines are checked against
+	now func() time.Time
+
+	// closeMu lets writes in progress finish before the store is closed
+	closeMu sync.RWMutex
+	closed  bool
+
+	// applyMu serializes mutations, so their conditions are checked atomically
+	applyMu sync.Mutex
+
+	mergeMu sync.RWMutex
+	mergeOp MergeOperator
+
+	close func() error
 }
 
 func New(cfg *config.Config, jr iJournal) (*Store, error) {
@@ -42,69 +77,213 @@ func New(cfg *config.Config, jr iJournal) (*Store, error) {
 	mt := memtable.New(cfg.Memtable)
 
 	// Create level manager
-	levelManager := persistence.NewLevelManager(cfg.Persistence)
+	levelManager, err := persistence.NewLevelManager(cfg.Persistence)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create manifest
-	manifest := persistence.NewManifest(cfg.Persistence.RootPath)
+	// Manifest is shared with the level manager, so flushes and compactions
+	// are recorded in the same place
+	manifest := levelManager.Manifest()
 
 	if err := manifest.Load(); err != nil {
 		return nil, err
 	}
 
+	values, err := openValueLog(cfg.ValueLog, cfg.Persistence.RootPath)
+	if err != nil {
+		return nil, err
+	}
+
 	store := &Store{
 		mt:           mt,
 		jr:           jr,
 		levelManager: levelManager,
+		manifest:     manifest,
+		values:       values,
 		seqN: clock.NewAtomic(
 			manifest.PersistentID(),
 		),
-		cfg: cfg,
+		cfg:       cfg,
+		snapshots: newSnapshotList(),
+		now:       time.Now,
+		mergeOp:   DefaultMergeOperator,
 	}
 
+	levelManager.SetCompactionFilter(store.compactionFilter)
+	levelManager.SetMerger(merger{store: store})
+
+	// versions visible to open snapshots and to snapshots opened later survive compaction
+	levelManager.SetSnapshotSource(store.pruneFloor)
+
 	if err := store.restoreFromJournal(); err != nil {
 		return nil, err
 	}
+	store.inflight = newInflightWrites(store.seqN, jr.Segment)
+	store.stall = newWriteController(cfg.WriteStall, mt.ImmCount, levelManager.L0Tables)
+	levelManager.OnCompaction(store.stall.signal)
+
+	// entries of a rotated memtable end up in sealed journal segments,
+	// which the flusher removes once the table is persisted
+	mt.OnRotate(func() {
+		if err := jr.Rotate(); err != nil {
+			slog.Error("failed to rotate journal", "error", err)
+		}
+	})
+	// values moved by writes of a group commit are synced with a single fsync
+	// before the journal records pointing to them
+	jr.OnCommit(values.Sync)
 
 	// start background goroutine to flush memtable in background
 	ctx := context.Background()
-	flusher := NewFlusher(mt.FlushChan(), cfg.Persistence.RootPath, levelManager, manifest)
+	flusher := NewFlusher(
+		mt.FlushChan(),
+		cfg.Persistence.RootPath,
+		levelManager,
+		manifest,
+		persistence.BloomBitsPerKey(cfg.Persistence.BloomFilter),
+		store.now,
+		func(ss memtable.SortedSet) {
+			// the flushed table is released only now, so reads never miss it
+			mt.Release(ss)
+			store.stall.signal()
+			// journal segments older than every unflushed entry are not needed for recovery
+			if err := store.trimJournal(); err != nil {
+				slog.Warn("failed to truncate journal", "error", err)
+			}
+		},
+	)
 	flusher.Start(ctx)
 
+	// start background goroutine to compact levels
+	levelManager.Start(ctx)
+
 	// start background goroutine to flush WAL async
 	store.jr.Start(ctx)
 
-	store.close = func() {
+	// start background goroutine to collect value log files
+	var gc *listener.Listener[time.Time]
+	if cfg.ValueLog.GCInterval > 0 {
+		ticker := time.NewTicker(cfg.ValueLog.GCInterval)
+		gc = listener.New(ticker.C, store.runValueLogGC, ticker.Stop)
+		gc.Start(ctx)
+	}
+
+	store.close = func() error {
+		if gc != nil {
+			gc.Stop()
+		}
 		flusher.Stop()
+		levelManager.Stop()
+
+		// the active and immutable tables go to L0, so a restart replays nothing
+		var errs []error
+		for _, ss := range mt.Close() {
+			if err := flusher.flush(ss); err != nil {
+				// later tables must not be persisted over a lost one
+				errs = append(errs, fmt.Errorf("failed to flush memtable: %w", err))
+				break
+			}
+		}
+		// sealing the active table rotated the journal, flushed segments are dropped
+		if err := store.trimJournal(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to truncate journal: %w", err))
+		}
+		if err := values.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close value log: %w", err))
+		}
+
 		store.jr.Stop()
-		store.mt.Close()
+		return errors.Join(errs...)
 	}
 
 	return store, nil
 }
 
+// compactionFilter lets compaction forget deleted and expired keys once
+// there is no older version left below to shadow, above that expired
+// values are kept as tombstones
+func (s *Store) compactionFilter(item *persistence.SSTableItem, bottommost bool) bool {
+	if !MD(item.Meta).hidden(s.now()) {
+		return false
+	}
+	if bottommost {
+		return true
+	}
+	item.Meta, item.Value = expireRecord(item.Meta, item.Value, s.now())
+	return false
+}
+
 func (s *Store) restoreFromJournal() error {
 	if s.jr == nil {
 		return ErrWALNotInitialized
 	}
 
-	// Replay from the last known persistent entry seq number
-	return s.jr.Replay(s.seqN.Val()+1, func(entry wal.Entry) error {
+	// Replay segments which may hold entries not flushed yet, entries
+	// flushed already are written again with the same sequence numbers
+	logNum := s.manifest.LogNumber()
+	return s.jr.Replay(logNum, func(entry wal.Entry) error {
 		// Actualize seqN if needed
 		if entry.SeqNum > s.seqN.Val() {
 			s.seqN.Set(entry.SeqNum)
 		}
 
-		return s.mt.Upsert(entry.Key, entry.Value, entry.SeqNum, entry.Meta)
+		return s.mt.Upsert(entry.Key, entry.Value, entry.SeqNum, entry.Meta, logNum)
 	})
 }
 
+// trimJournal records the oldest journal segment holding entries not flushed
+// yet in the manifest and removes older segments
+func (s *Store) trimJournal() error {
+	// writes in progress are checked before tables, a write applied
+	// in between is found in the memtable
+	logNum := min(s.inflight.oldestLog(), s.mt.LogNum())
+
+	s.manifest.SetLogNumber(logNum)
+	if err := s.manifest.Save(); err != nil {
+		return fmt.Errorf("failed to save manifest: %w", err)
+	}
+	return s.jr.Truncate(s.manifest.LogNumber())
+}
+
+// Put stores a value of any supported type: string, []byte, json.RawMessage,
+// int32, int64, int, float32, float64 or one of the store value types
 func (s *Store) Put(key string, value any) error {
-	switch typedVal := value.(type) {
-	case string:
-		return s.PutString(key, typedVal)
-	default:
-		return ErrValueTypeNotSupported
+	val, err := toValue(value)
+	if err != nil {
+		return err
+	}
+	return s.put(key, val, InsertOp)
+}
+
+// PutWithTTL stores a value hidden from readers once ttl passes
+func (s *Store) PutWithTTL(key string, value any, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidTTL, ttl)
+	}
+	return s.PutWithDeadline(key, value, s.now().Add(ttl))
+}
+
+// PutWithDeadline stores a value hidden from readers from the deadline on.
+// Replicas apply the same deadline, so the key expires everywhere at once.
+func (s *Store) PutWithDeadline(key string, value any, deadline time.Time) error {
+	if deadline.IsZero() {
+		return fmt.Errorf("%w: no deadline", ErrInvalidTTL)
+	}
+	entry, err := newInsert(key, value, deadline, 0)
+	if err != nil {
+		return err
+	}
+	return s.write([]wal.Entry{entry})
+}
+
+// PutJSON stores v encoded as a JSON document
+func (s *Store) PutJSON(key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON value: %w", err)
 	}
+	return s.put(key, JSON(data), InsertOp)
 }
 
 func (s *Store) PutString(key string, value string) error {
@@ -112,60 +291,154 @@ func (s *Store) PutString(key string, value string) error {
 }
 
 func (s *Store) put(key string, val value, op Operation) error {
-	entryID := s.seqN.Next()
-	md := newMD(op, val.typeOf())
-
-	s.jr.Append(wal.Entry{
-		SeqNum: entryID,
-		Key:    []byte(key),
-		Value:  val.bin(),
-		Meta:   uint64(md),
-	})
+	return s.write([]wal.Entry{newEntry(key, val, op)})
+}
+
+// write commits entries to the journal as a single record and applies them
+// to the memtable under consecutive sequence numbers. It returns once the
+// entries and every earlier write are visible to readers.
+func (s *Store) write(entries []wal.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	s.stall.wait()
+
+	return s.commit(entries)
+}
+
+// commit assigns sequence numbers to entries and applies them, it must be
+// called under closeMu
+func (s *Store) commit(entries []wal.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	// an entry the memtable rejects must not reach the journal,
+	// it would fail the replay on every restart
+	for _, entry := range entries {
+		value := entry.Value
+		if s.values.moves(entry) {
+			// the memtable keeps a pointer in place of the value
+			value = make([]byte, vlog.PointerSize)
+		}
+		if err := s.mt.CheckSize(entry.Key, value); err != nil {
+			return err
+		}
+	}
+
+	first, logNum := s.inflight.begin(len(entries))
+	for i := range entries {
+		entries[i].SeqNum = first + types.SeqN(i)
+	}
+
+	entries, err := s.values.separate(entries)
+	if err == nil {
+		err = s.apply(entries, logNum)
+	}
+	s.inflight.end(first)
+	if err != nil {
+		return err
+	}
+
+	s.inflight.wait(entries[len(entries)-1].SeqNum)
+	return nil
+}
+
+func (s *Store) apply(entries []wal.Entry, logNum uint64) error {
 	// wait for the WAL to confirm write
-	for id := <-s.jr.Done(); id != entryID; {
-		id = <-s.jr.Done()
+	if err := <-s.jr.Append(entries...); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
 	}
 
-	return s.mt.Upsert(
-		[]byte(key),
-		val.bin(),
-		entryID,
-		uint64(md),
-	)
+	for _, entry := range entries {
+		if err := s.mt.Upsert(entry.Key, entry.Value, entry.SeqNum, entry.Meta, logNum); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *Store) Get(key string) (storable, bool, error) {
+	return s.getAt(key, s.inflight.visible())
+}
+
+// getAt returns the newest version of the key not newer than seqN
+func (s *Store) getAt(key string, seqN types.SeqN) (storable, bool, error) {
+	val, _, found, err := s.lookup(key, seqN, s.now())
+	return val, found, err
+}
+
+// lookup returns the value of the key as of seqN and the version of its write,
+// values expired by now are absent, merge operands are folded into the older value they apply to
+func (s *Store) lookup(key string, seqN types.SeqN, now time.Time) (storable, uint64, bool, error) {
 	keyBytes := []byte(key)
 
-	// first check memtable
-	item, ok := s.mt.Get(keyBytes)
-	if ok {
-		md := MD(item.Meta)
-		if md.operation() == DeleteOp {
-			return nil, false, nil // deleted
+	var (
+		operands []storable
+		version  uint64
+	)
+	for {
+		meta, raw, itemSeqN, found, err := s.versionAt(keyBytes, seqN)
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		var base storable
+		md := MD(meta)
+		if found && !md.hidden(now) {
+			md, raw, err := s.values.resolve(md, raw)
+			if err != nil {
+				return nil, 0, false, err
+			}
+			val, ver, err := decodeValue(md, raw)
+			if err != nil {
+				return nil, 0, false, err
+			}
+			if len(operands) == 0 {
+				version = ver
+			}
+			if md.operation() != MergeOp {
+				base = val
+			} else {
+				// operands are collected until the complete value below them
+				operands = append(operands, val)
+				if itemSeqN > 0 {
+					seqN = itemSeqN - 1
+					continue
+				}
+			}
+		}
+
+		if len(operands) == 0 {
+			return base, version, base != nil, nil // absent, deleted or expired without operands
 		}
+		val, err := s.fullMerge(key, base, operands)
+		return val, version, err == nil, err
+	}
+}
 
-		storableItem, err := fromMemtableItem(item)
-		return storableItem, true, err
+// versionAt returns the newest record of the key not newer than seqN
+func (s *Store) versionAt(key []byte, seqN types.SeqN) (meta uint64, raw []byte, itemSeqN types.SeqN, found bool, err error) {
+	// first check memtable
+	if item, ok := s.mt.GetAt(key, seqN); ok {
+		return item.Meta, item.Value, item.SeqN, true, nil
 	}
 
 	// Search in LSM-tree levels
-	sstableItem, err := s.levelManager.Get(keyBytes)
+	sstableItem, err := s.levelManager.GetAt(key, seqN)
 	if err != nil {
-		return nil, false, fmt.Errorf("failed to Get from LSM-tree: %w", err)
+		return 0, nil, 0, false, fmt.Errorf("failed to Get from LSM-tree: %w", err)
 	}
-
 	if sstableItem == nil {
-		return nil, false, nil
-	}
-
-	md := MD(sstableItem.Meta)
-	if md.operation() == DeleteOp {
-		return nil, false, nil // deleted
+		return 0, nil, 0, false, nil
 	}
-
-	storableItem, err := fromSStableItem(*sstableItem)
-	return storableItem, true, err
+	return sstableItem.Meta, sstableItem.Value, sstableItem.ID, true, nil
 }
 
 func (s *Store) GetString(key string) (string, bool, error) {
@@ -182,10 +455,88 @@ func (s *Store) GetString(key string) (string, bool, error) {
 	return string(strItem), true, nil
 }
 
+// GetInt64 returns an integer value, int32 values are widened
+func (s *Store) GetInt64(key string) (int64, bool, error) {
+	item, has, err := s.Get(key)
+	if err != nil || !has {
+		return 0, has, err
+	}
+
+	switch typedItem := item.(type) {
+	case Int64:
+		return int64(typedItem), true, nil
+	case Int32:
+		return int64(typedItem), true, nil
+	default:
+		return 0, false, ErrValueTypeMismatch
+	}
+}
+
+// GetFloat64 returns a floating point value, float32 values are widened
+func (s *Store) GetFloat64(key string) (float64, bool, error) {
+	item, has, err := s.Get(key)
+	if err != nil || !has {
+		return 0, has, err
+	}
+
+	switch typedItem := item.(type) {
+	case Float64:
+		return float64(typedItem), true, nil
+	case Float32:
+		return float64(typedItem), true, nil
+	default:
+		return 0, false, ErrValueTypeMismatch
+	}
+}
+
+// GetJSON returns a raw JSON document
+func (s *Store) GetJSON(key string) (json.RawMessage, bool, error) {
+	item, has, err := s.Get(key)
+	if err != nil || !has {
+		return nil, has, err
+	}
+
+	jsonItem, ok := item.(JSON)
+	if !ok {
+		return nil, false, ErrValueTypeMismatch
+	}
+
+	return json.RawMessage(jsonItem), true, nil
+}
+
+func (s *Store) GetBlob(key string) ([]byte, bool, error) {
+	item, has, err := s.Get(key)
+	if err != nil || !has {
+		return nil, has, err
+	}
+
+	blobItem, ok := item.(Blob)
+	if !ok {
+		return nil, false, ErrValueTypeMismatch
+	}
+
+	return blobItem, true, nil
+}
+
 func (s *Store) Delete(key string) error {
 	return s.put(key, tombstone{}, DeleteOp)
 }
 
-func (s *Store) Close() {
-	s.close()
+// Close waits for writes in progress, flushes memtables to SSTables,
+// saves the manifest and drops the flushed journal. Later writes fail
+// with ErrStoreClosed.
+func (s *Store) Close() error {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.close()
+}
+
+// BlockCacheStats returns counters of the block cache shared by all SSTables
+func (s *Store) BlockCacheStats() persistence.CacheStats {
+	return s.levelManager.BlockCache().Stats()
 }
@@ -1,8 +1,14 @@
 package store
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"lsmdb/pkg/config"
+	"lsmdb/pkg/memtable"
 	"lsmdb/pkg/wal"
+	"strings"
 	"testing"
 )
 
@@ -18,6 +24,7 @@ func TestStore_PutString_GetString(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %v", err)
 	}
+	defer store.Close()
 
 	// Test PutString
 	err = store.PutString("key1", "value1")
@@ -50,6 +57,7 @@ func TestStore_DeleteString(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %v", err)
 	}
+	defer store.Close()
 
 	// Put a value
 	err = store.PutString("key1", "value1")
@@ -94,6 +102,7 @@ func TestStore_Overwrite(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %v", err)
 	}
+	defer store.Close()
 
 	// Put initial value
 	err = store.PutString("key1", "value1")
@@ -132,6 +141,7 @@ func TestStore_MultipleKeys(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %v", err)
 	}
+	defer store.Close()
 
 	// Put multiple keys
 	keys := []string{"key1", "key2", "key3"}
@@ -171,6 +181,7 @@ func TestStore_NonExistentKey(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %v", err)
 	}
+	defer store.Close()
 
 	// Try to Get non-existent key
 	_, found, err := store.GetString("nonexistent")
@@ -181,3 +192,127 @@ func TestStore_NonExistentKey(t *testing.T) {
 		t.Fatal("Expected key to not exist")
 	}
 }
+
+func TestStore_TypedValues(t *testing.T) {
+	store := newTestStore(t)
+
+	values := map[string]any{
+		"string":  "value",
+		"blob":    []byte{0, 1, 2},
+		"json":    json.RawMessage(`{"a":[1,2]}`),
+		"int32":   int32(-7),
+		"int64":   int64(1) << 40,
+		"int":     42,
+		"float32": float32(1.5),
+		"float64": 2.25,
+	}
+	for key, value := range values {
+		if err := store.Put(key, value); err != nil {
+			t.Fatalf("Put %s failed: %v", key, err)
+		}
+	}
+	if err := store.PutJSON("doc", map[string]int{"n": 1}); err != nil {
+		t.Fatalf("PutJSON failed: %v", err)
+	}
+
+	if v, _, err := store.GetBlob("blob"); err != nil || !bytes.Equal(v, []byte{0, 1, 2}) {
+		t.Fatalf("GetBlob returned %v, %v", v, err)
+	}
+	if v, _, err := store.GetJSON("json"); err != nil || string(v) != `{"a":[1,2]}` {
+		t.Fatalf("GetJSON returned %s, %v", v, err)
+	}
+	if v, _, err := store.GetJSON("doc"); err != nil || string(v) != `{"n":1}` {
+		t.Fatalf("GetJSON returned %s, %v", v, err)
+	}
+	for key, want := range map[string]int64{"int32": -7, "int64": 1 << 40, "int": 42} {
+		if v, found, err := store.GetInt64(key); err != nil || !found || v != want {
+			t.Fatalf("GetInt64 %s returned %d, %v", key, v, err)
+		}
+	}
+	for key, want := range map[string]float64{"float32": 1.5, "float64": 2.25} {
+		if v, found, err := store.GetFloat64(key); err != nil || !found || v != want {
+			t.Fatalf("GetFloat64 %s returned %f, %v", key, v, err)
+		}
+	}
+
+	// the type is kept in metadata
+	if _, _, err := store.GetString("int64"); !errors.Is(err, ErrValueTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+	if _, _, err := store.GetInt64("float64"); !errors.Is(err, ErrValueTypeMismatch) {
+		t.Fatalf("expected type mismatch, got %v", err)
+	}
+
+	if err := store.Put("bad", json.RawMessage(`{`)); !errors.Is(err, ErrInvalidJSON) {
+		t.Fatalf("expected invalid JSON error, got %v", err)
+	}
+	if err := store.Put("bad", struct{}{}); !errors.Is(err, ErrValueTypeNotSupported) {
+		t.Fatalf("expected unsupported type error, got %v", err)
+	}
+}
+
+func TestParseFormatValue(t *testing.T) {
+	for _, tc := range []struct{ typeName, text string }{
+		{"string", "hello"},
+		{"blob", "AAEC"},
+		{"json", `{"a":1}`},
+		{"int32", "-12"},
+		{"int64", "1099511627776"},
+		{"float32", "1.5"},
+		{"float64", "0.1"},
+	} {
+		parsed, err := ParseValue(tc.typeName, tc.text)
+		if err != nil {
+			t.Fatalf("ParseValue %s failed: %v", tc.typeName, err)
+		}
+
+		// values go through their binary form as in the store
+		v := parsed.(value)
+		typeName, text, err := FormatValue(buildMap[v.typeOf()](v.bin()))
+		if err != nil || typeName != tc.typeName || text != tc.text {
+			t.Fatalf("FormatValue returned %s %q, %v; expected %s %q", typeName, text, err, tc.typeName, tc.text)
+		}
+	}
+
+	if _, err := ParseValue("int32", "1e10"); err == nil {
+		t.Fatal("expected error for invalid int32")
+	}
+	if _, err := ParseValue("uuid", "x"); !errors.Is(err, ErrValueTypeNotSupported) {
+		t.Fatalf("expected unsupported type error, got %v", err)
+	}
+}
+
+func TestStore_TooLargeEntryIsNotJournaled(t *testing.T) {
+	cfg := config.Default()
+	cfg.Persistence.RootPath = t.TempDir()
+	store := openStore(t, &cfg)
+
+	// keys stay in the memtable whatever the value log threshold is
+	key := strings.Repeat("k", cfg.Memtable.FlushThresholdBytes)
+	if err := store.PutString(key, "1"); !errors.Is(err, memtable.ErrTooLargeEntry) {
+		t.Fatalf("expected ErrTooLargeEntry, got %v", err)
+	}
+	if err := store.PutString("key1", "1"); err != nil {
+		t.Fatalf("PutString failed: %v", err)
+	}
+	// a restart before the memtable is flushed replays the journal as is
+	err := store.jr.Replay(0, func(entry wal.Entry) error {
+		if len(entry.Key) == len(key) {
+			return fmt.Errorf("rejected entry %d is journaled", entry.SeqNum)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	closeStore(t, store)
+
+	store = openStore(t, &cfg)
+	defer closeStore(t, store)
+	if _, found, err := store.GetString(key); err != nil || found {
+		t.Fatalf("expected the rejected key to be absent, got found=%v err=%v", found, err)
+	}
+	if value, found, err := store.GetString("key1"); err != nil || !found || value != "1" {
+		t.Fatalf("expected key1=1 after reopen, got %q found=%v err=%v", value, found, err)
+	}
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"errors"
+	"lsmdb/pkg/persistence"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeNow returns a clock for store.now and a function moving it forward
+func fakeNow() (func() time.Time, func(time.Duration)) {
+	var ms atomic.Int64
+	ms.Store(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli())
+	return func() time.Time {
+			return time.UnixMilli(ms.Load())
+		}, func(d time.Duration) {
+			ms.Add(d.Milliseconds())
+		}
+}
+
+func TestStore_PutWithTTL(t *testing.T) {
+	store := newTestStore(t)
+	now, advance := fakeNow()
+	store.now = now
+
+	if err := store.PutString("session", "old"); err != nil {
+		t.Fatalf("PutString failed: %v", err)
+	}
+	if err := store.PutWithTTL("session", "token", time.Minute); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+	if err := store.PutWithTTL("counter", int64(1), time.Hour); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+	if err := store.PutWithTTL("bad", "value", 0); !errors.Is(err, ErrInvalidTTL) {
+		t.Fatalf("expected ErrInvalidTTL, got %v", err)
+	}
+
+	if value, found, _ := store.GetString("session"); !found || value != "token" {
+		t.Fatalf("expected live value, got %q", value)
+	}
+
+	advance(time.Minute)
+
+	// the expired value hides older versions as well
+	if _, found, err := store.GetString("session"); found || err != nil {
+		t.Fatalf("expired key must not be found, err %v", err)
+	}
+	if got := collect(t, store.Prefix("session")); len(got) != 0 {
+		t.Fatalf("scan returned expired keys: %v", got)
+	}
+	if value, found, _ := store.GetInt64("counter"); !found || value != 1 {
+		t.Fatalf("unexpired key is lost: %d", value)
+	}
+
+	// rewriting the key without TTL brings it back
+	if err := store.PutString("session", "new"); err != nil {
+		t.Fatalf("PutString failed: %v", err)
+	}
+	if value, found, _ := store.GetString("session"); !found || value != "new" {
+		t.Fatalf("expected rewritten value, got %q", value)
+	}
+}
+
+func TestStore_ExpiredRecordsAreCompacted(t *testing.T) {
+	store := newTestStore(t)
+	now, advance := fakeNow()
+	store.now = now
+
+	md := newMD(InsertOp, vTypeString).withExpiry(now().Add(time.Second))
+	if deadline, ok := md.expiresAt(); !ok || !deadline.Equal(now().Add(time.Second)) {
+		t.Fatalf("unexpected deadline %v", deadline)
+	}
+	if md.operation() != InsertOp || md.valType() != vTypeString {
+		t.Fatal("expiry must not change operation and type")
+	}
+
+	live := persistence.SSTableItem{Key: []byte("k"), Value: []byte("v"), Meta: uint64(md)}
+	if store.compactionFilter(&live, true) || string(live.Value) != "v" {
+		t.Fatal("live record must be kept")
+	}
+
+	advance(time.Second)
+
+	// above the last level an expired value becomes a tombstone
+	expired := live
+	if store.compactionFilter(&expired, false) {
+		t.Fatal("expired record must shadow older versions")
+	}
+	if MD(expired.Meta).operation() != DeleteOp || expired.Value != nil {
+		t.Fatalf("expired record is not turned into a tombstone: %+v", expired)
+	}
+
+	expired = live
+	if !store.compactionFilter(&expired, true) {
+		t.Fatal("expired record must be dropped at the last level")
+	}
+}
@@ -1,15 +1,28 @@
 package store
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
-	"lsmdb/pkg/memtable"
-	"lsmdb/pkg/persistence"
+	"fmt"
+	"math"
+	"strconv"
 )
 
 const (
 	InsertOp Operation = iota
 	DeleteOp
+
+	// conditional operations are checked against the current value of the key,
+	// records never hold them
+	PutIfAbsentOp
+	PutIfEqualOp
+	DeleteIfVersionOp
+
+	// MergeOp records an operand the merge operator applies to the older value
+	MergeOp
 )
 
 const (
@@ -27,9 +40,24 @@ var (
 	ErrUnknownValueType = errors.New("unknown value type")
 
 	buildMap = map[valType]func([]byte) storable{
-		vTypeBlob:   newStorable(newBlob),
-		vTypeString: newStorable(newString),
-		vTypeInt32:  newStorable(newInt32),
+		vTypeBlob:    newStorable(newBlob),
+		vTypeString:  newStorable(newString),
+		vTypeJson:    newStorable(newJSON),
+		vTypeInt32:   newStorable(newInt32),
+		vTypeInt64:   newStorable(newInt64),
+		vTypeFloat32: newStorable(newFloat32),
+		vTypeFloat64: newStorable(newFloat64),
+	}
+
+	// typeNames are the names of value types in text protocols
+	typeNames = map[valType]string{
+		vTypeBlob:    "blob",
+		vTypeString:  "string",
+		vTypeJson:    "json",
+		vTypeInt32:   "int32",
+		vTypeInt64:   "int64",
+		vTypeFloat32: "float32",
+		vTypeFloat64: "float64",
 	}
 )
 
@@ -53,22 +81,128 @@ func newStorable[T storable](f func([]byte) T) func([]byte) storable {
 	}
 }
 
-func fromMemtableItem(item memtable.Item) (storable, error) {
-	md := MD(item.Meta)
-	if build, ok := buildMap[md.valType()]; ok {
-		return build(item.Value), nil
+// toValue converts a value passed to Put into a storable one
+func toValue(v any) (value, error) {
+	switch typedVal := v.(type) {
+	case string:
+		return String(typedVal), nil
+	case []byte:
+		return Blob(typedVal), nil
+	case json.RawMessage:
+		return toValue(JSON(typedVal))
+	case int32:
+		return Int32(typedVal), nil
+	case int64:
+		return Int64(typedVal), nil
+	case int:
+		return Int64(typedVal), nil
+	case float32:
+		return Float32(typedVal), nil
+	case float64:
+		return Float64(typedVal), nil
+	case JSON:
+		if !json.Valid(typedVal) {
+			return nil, ErrInvalidJSON
+		}
+		return typedVal, nil
+	case String, Blob, Int32, Int64, Float32, Float64:
+		return typedVal.(value), nil
+	default:
+		return nil, ErrValueTypeNotSupported
+	}
+}
+
+// ParseValue converts the text form of a value of the named type
+// into a value accepted by Put. Blobs are base64 encoded.
+func ParseValue(typeName, text string) (any, error) {
+	switch typeName {
+	case "", typeNames[vTypeString]:
+		return String(text), nil
+	case typeNames[vTypeBlob]:
+		b, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blob: %w", err)
+		}
+		return Blob(b), nil
+	case typeNames[vTypeJson]:
+		if !json.Valid([]byte(text)) {
+			return nil, ErrInvalidJSON
+		}
+		return JSON(text), nil
+	case typeNames[vTypeInt32]:
+		i, err := strconv.ParseInt(text, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int32: %w", err)
+		}
+		return Int32(i), nil
+	case typeNames[vTypeInt64]:
+		i, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int64: %w", err)
+		}
+		return Int64(i), nil
+	case typeNames[vTypeFloat32]:
+		f, err := strconv.ParseFloat(text, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float32: %w", err)
+		}
+		return Float32(f), nil
+	case typeNames[vTypeFloat64]:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float64: %w", err)
+		}
+		return Float64(f), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrValueTypeNotSupported, typeName)
 	}
+}
 
-	return nil, ErrUnknownValueType
+// FormatValue returns the type name and the text form of a value
+// returned by Get, the reverse of ParseValue
+func FormatValue(v any) (typeName, text string, err error) {
+	switch typedVal := v.(type) {
+	case String:
+		text = string(typedVal)
+	case Blob:
+		text = base64.StdEncoding.EncodeToString(typedVal)
+	case JSON:
+		text = string(typedVal)
+	case Int32:
+		text = strconv.FormatInt(int64(typedVal), 10)
+	case Int64:
+		text = strconv.FormatInt(int64(typedVal), 10)
+	case Float32:
+		text = strconv.FormatFloat(float64(typedVal), 'g', -1, 32)
+	case Float64:
+		text = strconv.FormatFloat(float64(typedVal), 'g', -1, 64)
+	default:
+		return "", "", ErrUnknownValueType
+	}
+	return typeNames[v.(value).typeOf()], text, nil
 }
 
-func fromSStableItem(item persistence.SSTableItem) (storable, error) {
-	md := MD(item.Meta)
-	if build, ok := buildMap[md.valType()]; ok {
-		return build(item.Value), nil
+// decodeValue builds the value of a record and returns the version of its write
+func decodeValue(md MD, raw []byte) (storable, uint64, error) {
+	var version uint64
+	if md.versioned() {
+		if len(raw) < versionSize {
+			return nil, 0, ErrCorruptedValue
+		}
+		version = binary.LittleEndian.Uint64(raw)
+		raw = raw[versionSize:]
 	}
 
-	return nil, ErrUnknownValueType
+	build, ok := buildMap[md.valType()]
+	if !ok {
+		return nil, 0, ErrUnknownValueType
+	}
+	return build(raw), version, nil
+}
+
+// sameValue reports whether both values have the same type and encoding
+func sameValue(a, b value) bool {
+	return a.typeOf() == b.typeOf() && bytes.Equal(a.bin(), b.bin())
 }
 
 type String string
@@ -118,6 +252,72 @@ func newInt32(b []byte) Int32 {
 	return Int32(int32(binary.LittleEndian.Uint32(b)))
 }
 
+// JSON is a raw JSON document
+type JSON []byte
+
+func (j JSON) typeOf() valType {
+	return vTypeJson
+}
+
+func (j JSON) bin() []byte {
+	return j
+}
+
+func newJSON(b []byte) JSON {
+	return b
+}
+
+type Int64 int64
+
+func (i Int64) typeOf() valType {
+	return vTypeInt64
+}
+
+func (i Int64) bin() []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(i))
+}
+
+func newInt64(b []byte) Int64 {
+	if len(b) < 8 {
+		return 0
+	}
+	return Int64(int64(binary.LittleEndian.Uint64(b)))
+}
+
+type Float32 float32
+
+func (f Float32) typeOf() valType {
+	return vTypeFloat32
+}
+
+func (f Float32) bin() []byte {
+	return binary.LittleEndian.AppendUint32(nil, math.Float32bits(float32(f)))
+}
+
+func newFloat32(b []byte) Float32 {
+	if len(b) < 4 {
+		return 0
+	}
+	return Float32(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+}
+
+type Float64 float64
+
+func (f Float64) typeOf() valType {
+	return vTypeFloat64
+}
+
+func (f Float64) bin() []byte {
+	return binary.LittleEndian.AppendUint64(nil, math.Float64bits(float64(f)))
+}
+
+func newFloat64(b []byte) Float64 {
+	if len(b) < 8 {
+		return 0
+	}
+	return Float64(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+}
+
 // uses for delete op
 type tombstone struct{}
 
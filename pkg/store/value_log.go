@@ -0,0 +1,216 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"lsmdb/pkg/config"
+	"lsmdb/pkg/vlog"
+	"lsmdb/pkg/wal"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	// valueLogDir is the directory of the value log inside the data directory
+	valueLogDir = "vlog"
+	// gcBatchSize is the number of records relocated with writers paused
+	gcBatchSize = 64
+)
+
+// errGCSkipped stops collection of a file with a value still read through merge operands
+var errGCSkipped = errors.New("value log file is still referenced")
+
+// valueLog keeps large values out of the journal, the memtable and SSTables,
+// so they hold and move only small pointers. Values are separated when written.
+type valueLog struct {
+	*vlog.ValueLog
+	cfg config.ValueLogConfig
+}
+
+func openValueLog(cfg config.ValueLogConfig, dataDir string) (*valueLog, error) {
+	log, err := vlog.Open(filepath.Join(dataDir, valueLogDir), cfg.MaxSegmentSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open value log: %w", err)
+	}
+	return &valueLog{ValueLog: log, cfg: cfg}, nil
+}
+
+// moves reports whether separate moves the value of the entry to the value log
+func (vl *valueLog) moves(entry wal.Entry) bool {
+	md := MD(entry.Meta)
+	return vl.cfg.ValueThreshold > 0 && md.operation() == InsertOp && !md.pointer() &&
+		len(entry.Value) >= vl.cfg.ValueThreshold
+}
+
+// separate moves values over the threshold to the value log and returns entries
+// with pointers in place of them, values of the caller's entries are left as is.
+// The journal syncs the log once per group commit before writing the pointers.
+func (vl *valueLog) separate(entries []wal.Entry) ([]wal.Entry, error) {
+	moved := false
+	for i := range entries {
+		if !vl.moves(entries[i]) {
+			continue
+		}
+		ptr, err := vl.Append(vlog.Record{
+			Key:   entries[i].Key,
+			Value: entries[i].Value,
+			SeqN:  entries[i].SeqNum,
+			Meta:  entries[i].Meta,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !moved {
+			// a batch may be written again
+			entries = slices.Clone(entries)
+			moved = true
+		}
+		entries[i].Value = ptr.Encode()
+		entries[i].Meta = uint64(MD(entries[i].Meta) | pointerFlag)
+	}
+
+	return entries, nil
+}
+
+// resolve reads the value a pointer record refers to, other records are returned as is
+func (vl *valueLog) resolve(md MD, raw []byte) (MD, []byte, error) {
+	if !md.pointer() {
+		return md, raw, nil
+	}
+	ptr, err := vlog.DecodePointer(raw)
+	if err != nil {
+		return 0, nil, err
+	}
+	value, err := vl.Read(ptr)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read value log: %w", err)
+	}
+	return md &^ pointerFlag, value, nil
+}
+
+// RunValueLogGC reclaims the space of a value log file holding enough
+// overwritten and deleted values. Live values are written again to the
+// active file, the old file is removed by a later run
+// once no snapshot or iterator opened before the relocation is left.
+func (s *Store) RunValueLogGC() error {
+	if err := s.values.Purge(s.snapshots.oldest()); err != nil {
+		return err
+	}
+
+	for _, num := range s.values.Sealed() {
+		var total, live int64
+		err := s.values.Scan(num, func(ptr vlog.Pointer, record vlog.Record) error {
+			total += int64(ptr.Size)
+			ok, _, err := s.liveness(record)
+			if ok {
+				live += int64(ptr.Size)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if total > 0 && float64(total-live)/float64(total) < s.values.cfg.GCDiscardRatio {
+			continue
+		}
+
+		err = s.relocate(num)
+		if errors.Is(err, errGCSkipped) {
+			slog.Debug("value log file is not collected", "file", num, "reason", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		slog.Info("value log file collected", "file", num, "size", total, "live", live)
+		return nil
+	}
+	return nil
+}
+
+// relocate writes live values of the file again and drops the file
+func (s *Store) relocate(num uint64) error {
+	batch := make([]vlog.Record, 0, gcBatchSize)
+	err := s.values.Scan(num, func(_ vlog.Pointer, record vlog.Record) error {
+		batch = append(batch, record)
+		if len(batch) < gcBatchSize {
+			return nil
+		}
+		err := s.rewrite(batch)
+		batch = batch[:0]
+		return err
+	})
+	if err == nil {
+		err = s.rewrite(batch)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.values.Drop(num, s.inflight.visible())
+	return nil
+}
+
+// rewrite writes records still read by the store again. Writers are paused,
+// so no write of the same key gets between the check and the rewrite.
+func (s *Store) rewrite(records []vlog.Record) error {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	entries := make([]wal.Entry, 0, len(records))
+	for _, record := range records {
+		live, newest, err := s.liveness(record)
+		if err != nil {
+			return err
+		}
+		if !live {
+			continue
+		}
+		if !newest {
+			// a newer write would shadow merge operands applied to the value
+			return fmt.Errorf("%w: key %s", errGCSkipped, record.Key)
+		}
+		entries = append(entries, wal.Entry{
+			Key:   record.Key,
+			Value: record.Value,
+			Meta:  record.Meta,
+		})
+	}
+	return s.commit(entries)
+}
+
+// liveness reports whether reads of the key still return the value log record,
+// directly or as the base of merge operands, and whether it is the newest version
+func (s *Store) liveness(record vlog.Record) (live, newest bool, err error) {
+	seqN := s.inflight.visible()
+	for newest = true; ; newest = false {
+		meta, _, itemSeqN, found, err := s.versionAt(record.Key, seqN)
+		if err != nil {
+			return false, false, err
+		}
+		if !found || itemSeqN < record.SeqN {
+			return false, false, nil
+		}
+		if itemSeqN == record.SeqN {
+			return !MD(meta).hidden(s.now()), newest, nil
+		}
+		if MD(meta).operation() != MergeOp {
+			return false, false, nil
+		}
+		seqN = itemSeqN - 1
+	}
+}
+
+// runValueLogGC is called by the background listener
+func (s *Store) runValueLogGC(time.Time) error {
+	if err := s.RunValueLogGC(); err != nil && !errors.Is(err, ErrStoreClosed) {
+		// keep the worker alive, the next tick retries
+		slog.Error("value log garbage collection failed", "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"lsmdb/pkg/config"
+	"lsmdb/pkg/vlog"
+	"lsmdb/pkg/wal"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newValueLogConfig(t *testing.T) *config.Config {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.Persistence.RootPath = t.TempDir()
+	// every write moving values seals its value log file
+	cfg.ValueLog.MaxSegmentSize = 0
+	cfg.ValueLog.GCInterval = 0
+	return &cfg
+}
+
+// openStore opens the store over the data directory, the caller closes it with closeStore
+func openStore(t *testing.T, cfg *config.Config) *Store {
+	t.Helper()
+
+	journal, err := wal.New(cfg.Persistence.RootPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	store, err := New(cfg, journal)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	return store
+}
+
+func closeStore(t *testing.T, store *Store) {
+	t.Helper()
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := store.jr.(*wal.WAL).Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+}
+
+func largeValue(tag string) string {
+	return tag + strings.Repeat("x", 4000)
+}
+
+func valueLogFiles(t *testing.T, cfg *config.Config) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(cfg.Persistence.RootPath, valueLogDir, "vlog-*.log"))
+	if err != nil {
+		t.Fatalf("Glob failed: %v", err)
+	}
+	return files
+}
+
+func TestStore_ValueLogSeparatesLargeValues(t *testing.T) {
+	cfg := newValueLogConfig(t)
+	store := openStore(t, cfg)
+	// the value is over the memtable flush threshold, the memtable keeps a pointer
+	if err := store.PutString("large", largeValue("a")); err != nil {
+		t.Fatalf("PutString failed: %v", err)
+	}
+	if err := store.PutString("small", "value"); err != nil {
+		t.Fatalf("PutString failed: %v", err)
+	}
+	if value, found, err := store.GetString("large"); err != nil || !found || value != largeValue("a") {
+		t.Fatalf("large value is not read from the memtable: %v", err)
+	}
+	closeStore(t, store)
+
+	store = openStore(t, cfg)
+	defer closeStore(t, store)
+
+	// the table keeps a pointer in place of the large value only
+	item, err := store.levelManager.Get([]byte("large"))
+	if err != nil || item == nil || !MD(item.Meta).pointer() || len(item.Value) != vlog.PointerSize {
+		t.Fatalf("large value is not separated: %+v, %v", item, err)
+	}
+	item, err = store.levelManager.Get([]byte("small"))
+	if err != nil || item == nil || MD(item.Meta).pointer() {
+		t.Fatalf("small value must stay in the table: %+v, %v", item, err)
+	}
+
+	if value, found, err := store.GetString("large"); err != nil || !found || value != largeValue("a") {
+		t.Fatalf("large value is not read back: %v", err)
+	}
+	if got := collect(t, store.Scan("", "")); got["large"] != largeValue("a") || got["small"] != "value" {
+		t.Fatalf("scan returned unexpected values")
+	}
+}
+
+func TestStore_ValueLogGC(t *testing.T) {
+	cfg := newValueLogConfig(t)
+	keys := []string{"k0", "k1", "k2", "k3", "k4", "k5", "k6", "k7", "k8", "k9"}
+
+	// old values share one file
+	store := openStore(t, cfg)
+	batch := NewWriteBatch()
+	for _, key := range keys {
+		batch.PutString(key, largeValue("old"))
+	}
+	if err := store.Write(batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	closeStore(t, store)
+	oldFiles := valueLogFiles(t, cfg)
+
+	// every key but the last one is overwritten or deleted
+	store = openStore(t, cfg)
+	for _, key := range keys[:8] {
+		if err := store.PutString(key, largeValue("new")); err != nil {
+			t.Fatalf("PutString failed: %v", err)
+		}
+	}
+	if err := store.Delete(keys[8]); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	closeStore(t, store)
+
+	store = openStore(t, cfg)
+	it := store.Scan("k9", "")
+	if err := store.RunValueLogGC(); err != nil {
+		t.Fatalf("RunValueLogGC failed: %v", err)
+	}
+	// the open iterator keeps the collected files
+	if err := store.RunValueLogGC(); err != nil {
+		t.Fatalf("RunValueLogGC failed: %v", err)
+	}
+	if got := collect(t, it); got["k9"] != largeValue("old") {
+		t.Fatal("iterator opened before collection lost its value")
+	}
+
+	if err := store.RunValueLogGC(); err != nil {
+		t.Fatalf("RunValueLogGC failed: %v", err)
+	}
+	for _, file := range valueLogFiles(t, cfg) {
+		for _, old := range oldFiles {
+			if file == old {
+				t.Fatalf("collected file %s is not removed", file)
+			}
+		}
+	}
+	closeStore(t, store)
+
+	store = openStore(t, cfg)
+	defer closeStore(t, store)
+	for i, key := range keys {
+		value, found, err := store.GetString(key)
+		switch {
+		case err != nil:
+			t.Fatalf("GetString %s failed: %v", key, err)
+		case i < 8 && value != largeValue("new"):
+			t.Fatalf("%s lost its new value", key)
+		case i == 8 && found:
+			t.Fatalf("%s is deleted", key)
+		case i == 9 && value != largeValue("old"):
+			t.Fatalf("%s lost its relocated value", key)
+		}
+	}
+}
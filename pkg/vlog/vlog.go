@@ -0,0 +1,386 @@
+package vlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Record layout:
+//
+//	crc32c(4) | seq(8) | meta(8) | keyLen(4) | valLen(4) | key | value
+//
+// The checksum covers everything after it. Sequence number and metadata
+// of the write let garbage collection find out whether the record is live.
+const (
+	recordHeaderSize = 4 + 8 + 8 + 4 + 4
+
+	segmentPrefix = "vlog-"
+	segmentSuffix = ".log"
+
+	// PointerSize is the size of an encoded Pointer
+	PointerSize = 8 + 8 + 4
+)
+
+var (
+	// ErrCorrupted is returned when a record fails its checksum or framing checks
+	ErrCorrupted = errors.New("corrupted value log record")
+	// ErrSegmentNotFound is returned for pointers into a removed segment
+	ErrSegmentNotFound = errors.New("value log segment not found")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Pointer locates a record in the value log
+type Pointer struct {
+	Segment uint64
+	Offset  int64
+	Size    uint32
+}
+
+// Encode returns the pointer in the form stored in place of the value
+func (p Pointer) Encode() []byte {
+	buf := make([]byte, PointerSize)
+	binary.LittleEndian.PutUint64(buf, p.Segment)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(p.Offset))
+	binary.LittleEndian.PutUint32(buf[16:], p.Size)
+	return buf
+}
+
+// DecodePointer parses a pointer written by Encode
+func DecodePointer(data []byte) (Pointer, error) {
+	if len(data) != PointerSize {
+		return Pointer{}, fmt.Errorf("%w: pointer of %d bytes", ErrCorrupted, len(data))
+	}
+	return Pointer{
+		Segment: binary.LittleEndian.Uint64(data),
+		Offset:  int64(binary.LittleEndian.Uint64(data[8:])),
+		Size:    binary.LittleEndian.Uint32(data[16:]),
+	}, nil
+}
+
+// Record is a value moved out of the LSM-tree together with its key
+type Record struct {
+	Key   []byte
+	Value []byte
+	SeqN  uint64
+	Meta  uint64
+}
+
+func encodeRecord(r Record) []byte {
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(r.Key)+len(r.Value))
+	binary.LittleEndian.PutUint64(buf[4:], r.SeqN)
+	binary.LittleEndian.PutUint64(buf[12:], r.Meta)
+	binary.LittleEndian.PutUint32(buf[20:], uint32(len(r.Key)))
+	binary.LittleEndian.PutUint32(buf[24:], uint32(len(r.Value)))
+	buf = append(buf, r.Key...)
+	buf = append(buf, r.Value...)
+	binary.LittleEndian.PutUint32(buf, crc32.Checksum(buf[4:], crcTable))
+	return buf
+}
+
+func decodeRecord(data []byte) (Record, error) {
+	if len(data) < recordHeaderSize {
+		return Record{}, fmt.Errorf("%w: short record", ErrCorrupted)
+	}
+	if crc32.Checksum(data[4:], crcTable) != binary.LittleEndian.Uint32(data) {
+		return Record{}, fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+	keyLen := int(binary.LittleEndian.Uint32(data[20:]))
+	valLen := int(binary.LittleEndian.Uint32(data[24:]))
+	if recordHeaderSize+keyLen+valLen != len(data) {
+		return Record{}, fmt.Errorf("%w: length mismatch", ErrCorrupted)
+	}
+	key := data[recordHeaderSize : recordHeaderSize+keyLen]
+	return Record{
+		Key:   key,
+		Value: data[recordHeaderSize+keyLen:],
+		SeqN:  binary.LittleEndian.Uint64(data[4:]),
+		Meta:  binary.LittleEndian.Uint64(data[12:]),
+	}, nil
+}
+
+// segment is a single numbered value log file
+type segment struct {
+	num  uint64
+	file *os.File
+	// droppedAt is the sequence number of the write that relocated
+	// the last live record of the segment, 0 while the segment is in use
+	droppedAt uint64
+}
+
+// ValueLog is an append-only log of large values. Records are appended
+// to the active segment, which is sealed once it grows over maxSegmentSize.
+// Sealed segments are collected by relocating their live records and
+// dropping the file.
+type ValueLog struct {
+	mu             sync.RWMutex
+	dir            string
+	maxSegmentSize int64
+
+	segments map[uint64]*segment
+	// active is created by the first append after Open
+	active *segment
+	writer *bufio.Writer
+	size   int64
+	next   uint64
+	// dirty is set by appends not synced yet
+	dirty bool
+}
+
+// Open opens the value log in dir, segments left by earlier runs are sealed
+func Open(dir string, maxSegmentSize int64) (*ValueLog, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create value log directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read value log directory: %w", err)
+	}
+
+	vl := &ValueLog{
+		dir:            dir,
+		maxSegmentSize: maxSegmentSize,
+		segments:       make(map[uint64]*segment),
+		next:           1,
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil || num == 0 {
+			continue
+		}
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			_ = vl.Close()
+			return nil, fmt.Errorf("failed to open value log segment: %w", err)
+		}
+		vl.segments[num] = &segment{num: num, file: file}
+		vl.next = max(vl.next, num+1)
+	}
+	return vl, nil
+}
+
+func (vl *ValueLog) segmentPath(num uint64) string {
+	return filepath.Join(vl.dir, fmt.Sprintf("%s%08d%s", segmentPrefix, num, segmentSuffix))
+}
+
+// Append writes the record to the active segment and returns its pointer.
+// The record is readable and durable after Sync.
+func (vl *ValueLog) Append(r Record) (Pointer, error) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	if vl.active == nil {
+		if err := vl.startSegment(); err != nil {
+			return Pointer{}, err
+		}
+	}
+
+	data := encodeRecord(r)
+	if _, err := vl.writer.Write(data); err != nil {
+		return Pointer{}, fmt.Errorf("failed to append to value log: %w", err)
+	}
+	ptr := Pointer{Segment: vl.active.num, Offset: vl.size, Size: uint32(len(data))}
+	vl.size += int64(len(data))
+	vl.dirty = true
+	return ptr, nil
+}
+
+// startSegment creates a new active segment, it must be called under mu
+func (vl *ValueLog) startSegment() error {
+	num := vl.next
+	file, err := os.OpenFile(vl.segmentPath(num), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create value log segment: %w", err)
+	}
+	vl.next++
+	vl.active = &segment{num: num, file: file}
+	vl.segments[num] = vl.active
+	vl.writer = bufio.NewWriter(file)
+	vl.size = 0
+	return nil
+}
+
+// Sync makes appended records durable and seals the active segment
+// once it is over the size limit, it does nothing without new appends
+func (vl *ValueLog) Sync() error {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	if vl.active == nil || !vl.dirty {
+		return nil
+	}
+	if err := vl.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush value log: %w", err)
+	}
+	if err := vl.active.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync value log: %w", err)
+	}
+	vl.dirty = false
+	if vl.size >= vl.maxSegmentSize {
+		// the file stays open for reads, the next append starts a new segment
+		vl.active = nil
+		vl.writer = nil
+	}
+	return nil
+}
+
+// Read returns the value the pointer refers to
+func (vl *ValueLog) Read(ptr Pointer) ([]byte, error) {
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+
+	seg, ok := vl.segments[ptr.Segment]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrSegmentNotFound, ptr.Segment)
+	}
+	data := make([]byte, ptr.Size)
+	if _, err := seg.file.ReadAt(data, ptr.Offset); err != nil {
+		return nil, fmt.Errorf("failed to read value log: %w", err)
+	}
+	record, err := decodeRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	return record.Value, nil
+}
+
+// Sealed returns numbers of segments not written anymore and not dropped, oldest first
+func (vl *ValueLog) Sealed() []uint64 {
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+
+	nums := make([]uint64, 0, len(vl.segments))
+	for num, seg := range vl.segments {
+		if seg != vl.active && seg.droppedAt == 0 {
+			nums = append(nums, num)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums
+}
+
+// Scan calls fn for every record of a sealed segment. A torn record
+// at the end of the segment, left by a crash during flush, is skipped.
+func (vl *ValueLog) Scan(num uint64, fn func(Pointer, Record) error) error {
+	vl.mu.RLock()
+	seg, ok := vl.segments[num]
+	active := ok && seg == vl.active
+	vl.mu.RUnlock()
+	if !ok || active {
+		return fmt.Errorf("%w: %d", ErrSegmentNotFound, num)
+	}
+
+	info, err := seg.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat value log segment: %w", err)
+	}
+	reader := bufio.NewReader(io.NewSectionReader(seg.file, 0, info.Size()))
+	header := make([]byte, recordHeaderSize)
+	for offset := int64(0); offset < info.Size(); {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			slog.Warn("skipping torn value log record", "segment", num, "offset", offset)
+			return nil
+		}
+		size := recordHeaderSize + int64(binary.LittleEndian.Uint32(header[20:])) + int64(binary.LittleEndian.Uint32(header[24:]))
+		if offset+size > info.Size() {
+			slog.Warn("skipping torn value log record", "segment", num, "offset", offset)
+			return nil
+		}
+		data := make([]byte, size)
+		copy(data, header)
+		if _, err := io.ReadFull(reader, data[recordHeaderSize:]); err != nil {
+			return fmt.Errorf("failed to read value log segment: %w", err)
+		}
+		record, err := decodeRecord(data)
+		if err != nil {
+			return fmt.Errorf("segment %d offset %d: %w", num, offset, err)
+		}
+		if err := fn(Pointer{Segment: num, Offset: offset, Size: uint32(size)}, record); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
+
+// Drop marks a collected segment, its live records are relocated by the write
+// with sequence number seq. The file is removed by Purge once no reader
+// older than the relocation is left.
+func (vl *ValueLog) Drop(num, seq uint64) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	if seg, ok := vl.segments[num]; ok && seg != vl.active {
+		seg.droppedAt = max(seq, 1)
+	}
+}
+
+// Purge removes dropped segments relocated before the oldest sequence number readers are pinned at
+func (vl *ValueLog) Purge(oldest uint64) error {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	var errs []error
+	for num, seg := range vl.segments {
+		if seg.droppedAt == 0 || seg.droppedAt >= oldest {
+			continue
+		}
+		if err := seg.file.Close(); err != nil {
+			slog.Warn("failed to close value log segment", "segment", num, "error", err)
+		}
+		if err := os.Remove(vl.segmentPath(num)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to remove value log segment: %w", err))
+		}
+		delete(vl.segments, num)
+	}
+	return errors.Join(errs...)
+}
+
+// Size returns the total size of value log segments
+func (vl *ValueLog) Size() int64 {
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+
+	var total int64
+	for _, seg := range vl.segments {
+		if info, err := seg.file.Stat(); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// Close syncs the active segment and closes every file
+func (vl *ValueLog) Close() error {
+	var errs []error
+	if err := vl.Sync(); err != nil {
+		errs = append(errs, err)
+	}
+
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	for num, seg := range vl.segments {
+		if err := seg.file.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close value log segment %d: %w", num, err))
+		}
+	}
+	vl.segments = make(map[uint64]*segment)
+	vl.active = nil
+	vl.writer = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,215 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// Record layout:
+//
+//	crc32c(4) | payload length(4) | payload
+//
+// payload: seq(8) | meta(8) | keyLen(4) | key | valLen(4) | value
+//
+// A record holding several entries sets batchFlag in the length field,
+// its payload is count(4) followed by length-prefixed entry payloads:
+//
+//	count(4) | [entryLen(4) | entry payload] * count
+//
+// The checksum covers the length field and the payload, so entries of
+// a batch are replayed all together or not at all.
+const (
+	recordHeaderSize = 4 + 4
+	payloadFixedSize = 8 + 8 + 4 + 4
+
+	batchFlag     = 1 << 31
+	maxPayloadLen = batchFlag - 1
+)
+
+var (
+	// ErrCorrupted is returned when a record fails checksum or framing checks
+	ErrCorrupted = errors.New("corrupted WAL record")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// RecoveryPolicy defines how Replay treats damaged records
+type RecoveryPolicy int
+
+const (
+	// TruncateTail drops a torn last record and fails on corruption in the middle of the log
+	TruncateTail RecoveryPolicy = iota
+	// SkipCorrupted drops a torn last record and skips corrupted records in the middle of the log
+	SkipCorrupted
+	// FailOnCorruption fails on any damaged record including a torn tail
+	FailOnCorruption
+)
+
+func (p RecoveryPolicy) String() string {
+	switch p {
+	case TruncateTail:
+		return "truncate_tail"
+	case SkipCorrupted:
+		return "skip_corrupted"
+	case FailOnCorruption:
+		return "fail"
+	default:
+		return fmt.Sprintf("RecoveryPolicy(%d)", int(p))
+	}
+}
+
+// encodeRecord frames the entries with length and checksum
+func encodeRecord(entries ...Entry) ([]byte, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("empty WAL record")
+	}
+
+	payloadLen := 0
+	for _, entry := range entries {
+		if len(entry.Key) > math.MaxUint32 {
+			return nil, fmt.Errorf("key too large: %d", len(entry.Key))
+		}
+		if len(entry.Value) > math.MaxUint32 {
+			return nil, fmt.Errorf("value too large: %d", len(entry.Value))
+		}
+		payloadLen += payloadFixedSize + len(entry.Key) + len(entry.Value)
+	}
+	lenField := uint32(0)
+	if len(entries) > 1 {
+		payloadLen += 4 + 4*len(entries)
+		lenField = batchFlag
+	}
+	if payloadLen > maxPayloadLen {
+		return nil, fmt.Errorf("record too large: %d", payloadLen)
+	}
+	lenField |= uint32(payloadLen)
+
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+payloadLen)
+	binary.LittleEndian.PutUint32(buf[4:], lenField)
+	if len(entries) == 1 {
+		buf = appendPayload(buf, entries[0])
+	} else {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entries)))
+		for _, entry := range entries {
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(payloadFixedSize+len(entry.Key)+len(entry.Value)))
+			buf = appendPayload(buf, entry)
+		}
+	}
+
+	binary.LittleEndian.PutUint32(buf, crc32.Checksum(buf[4:], crcTable))
+	return buf, nil
+}
+
+func appendPayload(buf []byte, entry Entry) []byte {
+	buf = binary.LittleEndian.AppendUint64(buf, entry.SeqNum)
+	buf = binary.LittleEndian.AppendUint64(buf, entry.Meta)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entry.Key)))
+	buf = append(buf, entry.Key...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entry.Value)))
+	return append(buf, entry.Value...)
+}
+
+// readRecord reads a single record of at most remaining bytes and returns
+// its entries and the number of bytes it occupies. io.EOF means a clean end of the log,
+// io.ErrUnexpectedEOF a torn record. On ErrCorrupted the reader is positioned
+// after the damaged record.
+func readRecord(r io.Reader, remaining int64) ([]Entry, int64, error) {
+	var header [recordHeaderSize]byte
+
+	if n, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, int64(n), err
+	}
+	lenField := binary.LittleEndian.Uint32(header[4:])
+	payloadLen := lenField &^ batchFlag
+	if int64(payloadLen) > remaining-recordHeaderSize {
+		return nil, remaining, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, payloadLen)
+	n, err := io.ReadFull(r, payload)
+	size := int64(recordHeaderSize + n)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, size, err
+	}
+
+	crc := crc32.Update(crc32.Checksum(header[4:], crcTable), crcTable, payload)
+	if crc != binary.LittleEndian.Uint32(header[:4]) {
+		return nil, size, fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+
+	if lenField&batchFlag == 0 {
+		entry, err := decodePayload(payload)
+		if err != nil {
+			return nil, size, err
+		}
+		return []Entry{entry}, size, nil
+	}
+	entries, err := decodeBatch(payload)
+	return entries, size, err
+}
+
+func decodeBatch(buf []byte) ([]Entry, error) {
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("%w: batch is too short", ErrCorrupted)
+	}
+	count := binary.LittleEndian.Uint32(buf)
+	buf = buf[4:]
+	if uint64(count)*(4+payloadFixedSize) > uint64(len(buf)) {
+		return nil, fmt.Errorf("%w: batch count out of bounds", ErrCorrupted)
+	}
+
+	entries := make([]Entry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(buf) < 4 {
+			return nil, fmt.Errorf("%w: batch is too short", ErrCorrupted)
+		}
+		entryLen := uint64(binary.LittleEndian.Uint32(buf))
+		buf = buf[4:]
+		if uint64(len(buf)) < entryLen {
+			return nil, fmt.Errorf("%w: batch entry length out of bounds", ErrCorrupted)
+		}
+		entry, err := decodePayload(buf[:entryLen])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+		buf = buf[entryLen:]
+	}
+	if len(buf) != 0 {
+		return nil, fmt.Errorf("%w: trailing bytes after batch", ErrCorrupted)
+	}
+	return entries, nil
+}
+
+func decodePayload(buf []byte) (Entry, error) {
+	var entry Entry
+	if len(buf) < payloadFixedSize {
+		return entry, fmt.Errorf("%w: payload is too short", ErrCorrupted)
+	}
+
+	entry.SeqNum = binary.LittleEndian.Uint64(buf)
+	entry.Meta = binary.LittleEndian.Uint64(buf[8:])
+	keyLen := uint64(binary.LittleEndian.Uint32(buf[16:]))
+	buf = buf[20:]
+	if uint64(len(buf)) < keyLen+4 {
+		return entry, fmt.Errorf("%w: key length out of bounds", ErrCorrupted)
+	}
+	entry.Key = buf[:keyLen]
+	buf = buf[keyLen:]
+
+	valueLen := uint64(binary.LittleEndian.Uint32(buf))
+	buf = buf[4:]
+	if uint64(len(buf)) != valueLen {
+		return entry, fmt.Errorf("%w: value length mismatch", ErrCorrupted)
+	}
+	entry.Value = buf
+
+	return entry, nil
+}
@@ -0,0 +1,224 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	segmentPrefix = "wal-"
+	segmentSuffix = ".log"
+	// legacyFileName is the single log file of unframed entries written
+	// before segmentation and checksums
+	legacyFileName = "wal.log"
+)
+
+// segment is a single numbered WAL file
+type segment struct {
+	id   uint64
+	path string
+}
+
+func newSegment(dir string, id uint64) *segment {
+	return &segment{
+		id:   id,
+		path: filepath.Join(dir, fmt.Sprintf("%s%08d%s", segmentPrefix, id, segmentSuffix)),
+	}
+}
+
+// listSegments returns WAL segments of the directory ordered by id.
+// A legacy single-file log is converted into the first segment.
+func listSegments(dir string) ([]*segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL directory: %w", err)
+	}
+
+	segments := make([]*segment, 0)
+	legacy := false
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == legacyFileName {
+			legacy = true
+			continue
+		}
+		if entry.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil || id == 0 {
+			continue
+		}
+		segments = append(segments, newSegment(dir, id))
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].id < segments[j].id
+	})
+
+	if legacy {
+		// the first segment replaces the legacy log atomically, both exist
+		// only if the conversion stopped before the log was removed
+		if len(segments) > 0 && segments[0].id == 1 {
+			if err := os.Remove(filepath.Join(dir, legacyFileName)); err != nil {
+				return nil, fmt.Errorf("failed to remove converted %s: %w", legacyFileName, err)
+			}
+			return segments, nil
+		}
+		seg, err := migrateLegacy(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate %s: %w", legacyFileName, err)
+		}
+		segments = append([]*segment{seg}, segments...)
+	}
+
+	return segments, nil
+}
+
+// migrateLegacy writes entries of the legacy log as framed records of the first
+// segment and removes the log. A torn last entry was never acknowledged and is dropped.
+func migrateLegacy(dir string) (*segment, error) {
+	legacyPath := filepath.Join(dir, legacyFileName)
+	seg := newSegment(dir, 1)
+	tmpPath := seg.path + ".tmp"
+
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = convertLegacy(legacyPath, dst)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, seg.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(legacyPath); err != nil {
+		return nil, err
+	}
+	return seg, nil
+}
+
+// convertLegacy copies entries of the legacy log to dst as framed records and syncs it
+func convertLegacy(legacyPath string, dst *os.File) error {
+	src, err := os.Open(legacyPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(src)
+	writer := bufio.NewWriter(dst)
+	remaining, count := info.Size(), 0
+	for {
+		entry, n, err := readLegacyEntry(reader, remaining)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			slog.Warn("dropping torn entry at the end of the legacy WAL", "bytes", remaining)
+			break
+		}
+		if err != nil {
+			return err
+		}
+		remaining -= n
+
+		record, err := encodeRecord(entry)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(record); err != nil {
+			return err
+		}
+		count++
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	slog.Info("legacy WAL converted into the first segment", "entries", count)
+	return nil
+}
+
+// readLegacyEntry reads an unframed entry of at most remaining bytes,
+// laid out as the payload of a record, and returns the number of bytes it occupies.
+// io.EOF means a clean end of the log, io.ErrUnexpectedEOF a torn entry.
+func readLegacyEntry(r io.Reader, remaining int64) (Entry, int64, error) {
+	var (
+		entry  Entry
+		header [payloadFixedSize - 4]byte
+		lenBuf [4]byte
+	)
+
+	if n, err := io.ReadFull(r, header[:]); err != nil {
+		return entry, int64(n), err
+	}
+	entry.SeqNum = binary.LittleEndian.Uint64(header[:])
+	entry.Meta = binary.LittleEndian.Uint64(header[8:])
+	keyLen := int64(binary.LittleEndian.Uint32(header[16:]))
+	size := int64(len(header))
+	if keyLen+int64(len(lenBuf)) > remaining-size {
+		return entry, remaining, io.ErrUnexpectedEOF
+	}
+
+	entry.Key = make([]byte, keyLen)
+	if _, err := io.ReadFull(r, entry.Key); err != nil {
+		return entry, remaining, io.ErrUnexpectedEOF
+	}
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return entry, remaining, io.ErrUnexpectedEOF
+	}
+	valLen := int64(binary.LittleEndian.Uint32(lenBuf[:]))
+	size += keyLen + int64(len(lenBuf))
+	if valLen > remaining-size {
+		return entry, remaining, io.ErrUnexpectedEOF
+	}
+
+	entry.Value = make([]byte, valLen)
+	if _, err := io.ReadFull(r, entry.Value); err != nil {
+		return entry, remaining, io.ErrUnexpectedEOF
+	}
+	return entry, size + valLen, nil
+}
+
+// syncDir makes renames and removals in the directory durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func openSegment(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+	return file, nil
+}
@@ -2,21 +2,17 @@ package wal
 
 import (
 	"bufio"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"lsmdb/pkg/listener"
-	"lsmdb/pkg/types"
-	"math"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
-type seqNum = uint64
-
 // Entry represents a single entry
 type Entry struct {
 	SeqNum uint64
@@ -25,21 +21,70 @@ type Entry struct {
 	Meta   uint64
 }
 
-// WAL implements write-ahead logging
+var (
+	// ErrClosed is returned for entries appended after the WAL is stopped
+	ErrClosed = errors.New("WAL is closed")
+)
+
+// pending is an appended record waiting for its commit
+type pending struct {
+	entries []Entry
+	done    chan error
+}
+
+// WAL implements write-ahead logging over numbered segment files.
+// Writes go to the last segment, Rotate starts a new one and
+// Truncate removes sealed segments already persisted elsewhere.
 type WAL struct {
-	*listener.Listener[Entry]
+	*listener.Listener[pending]
 
 	mu       sync.Mutex
+	dir      string
+	segments []*segment
 	file     *os.File
 	writer   *bufio.Writer
-	filePath string
+	policy   RecoveryPolicy
+	// err is the first write failure, the log is not written after it
+	err error
+	// onCommit makes data the records refer to durable before they are written
+	onCommit func() error
+
+	// group commit limits
+	maxBatchSize  int
+	maxBatchDelay time.Duration
+
+	inputCh chan pending
+	// appendMu and closed let stop wait for in-flight appends
+	appendMu sync.RWMutex
+	closed   chan struct{}
+}
 
-	inputCh chan Entry
-	doneCh  chan seqNum
+// defaultMaxBatchSize bounds a group commit unless WithGroupCommit is set
+const defaultMaxBatchSize = 128
+
+// Option configures the WAL
+type Option func(*WAL)
+
+// WithRecoveryPolicy sets how Replay treats damaged records, TruncateTail by default
+func WithRecoveryPolicy(policy RecoveryPolicy) Option {
+	return func(w *WAL) {
+		w.policy = policy
+	}
+}
+
+// WithGroupCommit sets how many queued entries are written with a single fsync
+// and how long the writer waits for more entries to join a batch
+func WithGroupCommit(maxBatchSize int, maxBatchDelay time.Duration) Option {
+	return func(w *WAL) {
+		if maxBatchSize > 0 {
+			w.maxBatchSize = maxBatchSize
+		}
+		w.maxBatchDelay = maxBatchDelay
+	}
 }
 
 // New creates a new WAL instance
-func New(dir string) (*WAL, error) {
+func New(dir string, opts ...Option) (*WAL, error) {
 	// Ensure directory is a clean path and create with restrictive permissions
 	if dir == "" {
 		return nil, fmt.Errorf("empty WAL dir")
@@ -49,19 +94,35 @@ func New(dir string) (*WAL, error) {
 		return nil, fmt.Errorf("failed to create WAL directory: %w", err)
 	}
 
-	filePath := filepath.Join(dir, "wal.log")
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		segments = append(segments, newSegment(dir, 1))
+	}
+
+	// keep appending to the newest segment
+	active := segments[len(segments)-1]
+	file, err := openSegment(active.path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open WAL file: %w", err)
+		return nil, err
 	}
 
 	wal := &WAL{
-		file:     file,
-		writer:   bufio.NewWriter(file),
-		filePath: filePath,
-		inputCh:  make(chan Entry, 3),
-		doneCh:   make(chan seqNum, 3),
+		dir:          dir,
+		segments:     segments,
+		file:         file,
+		writer:       bufio.NewWriter(file),
+		policy:       TruncateTail,
+		maxBatchSize: defaultMaxBatchSize,
+	}
+	for _, opt := range opts {
+		opt(wal)
 	}
+	// a whole batch may be queued while the previous one is synced
+	wal.inputCh = make(chan pending, wal.maxBatchSize)
+	wal.closed = make(chan struct{})
 
 	// Initialize channels and listener write listener
 	wal.Listener = listener.New(wal.inputCh, wal.writeFile, wal.stop)
@@ -69,30 +130,206 @@ func New(dir string) (*WAL, error) {
 	return wal, nil
 }
 
-func (w *WAL) Append(entry Entry) {
-	w.inputCh <- entry
+// Append queues the entries as a single record and returns a channel
+// receiving the result of its commit once the entries are durable.
+// Entries appended together are replayed all together or not at all.
+func (w *WAL) Append(entries ...Entry) <-chan error {
+	done := make(chan error, 1)
+
+	w.appendMu.RLock()
+	defer w.appendMu.RUnlock()
+
+	select {
+	case <-w.closed:
+		done <- ErrClosed
+		return done
+	default:
+	}
+
+	select {
+	case w.inputCh <- pending{entries: entries, done: done}:
+	case <-w.closed:
+		done <- ErrClosed
+	}
+	return done
+}
+
+// OnCommit sets a function called once before every group of records is written,
+// it makes durable the data kept outside the log the records refer to
+func (w *WAL) OnCommit(fn func() error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onCommit = fn
 }
 
-// will be called async by WAL.listener on input in WAL.inputCh
-func (w *WAL) writeFile(entry Entry) error {
-	if err := w.writeEntry(entry); err != nil {
-		return fmt.Errorf("failed to write WAL entry: %w", err)
+// will be called async by WAL.listener on input in WAL.inputCh,
+// entries queued meanwhile are committed with the same fsync.
+// Write errors are delivered to the writers, so the listener keeps running.
+func (w *WAL) writeFile(p pending) error {
+	w.commit(w.collectBatch(p))
+	return nil
+}
+
+// commit writes the batch and acknowledges every writer in it
+func (w *WAL) commit(batch []pending) {
+	records := make([][]Entry, 0, len(batch))
+	for _, p := range batch {
+		records = append(records, p.entries)
 	}
 
+	err := w.write(records...)
+	if err != nil {
+		slog.Error("failed to commit WAL batch", "entries", len(batch), "error", err)
+	}
+
+	// Notify completion
+	for _, p := range batch {
+		p.done <- err
+	}
+}
+
+// collectBatch drains queued entries up to maxBatchSize,
+// waiting at most maxBatchDelay for new ones
+func (w *WAL) collectBatch(first pending) []pending {
+	batch := []pending{first}
+
+	var timeout <-chan time.Time
+	if w.maxBatchDelay > 0 {
+		timer := time.NewTimer(w.maxBatchDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for len(batch) < w.maxBatchSize {
+		select {
+		case e := <-w.inputCh:
+			batch = append(batch, e)
+			continue
+		default:
+		}
+
+		if timeout == nil {
+			break
+		}
+		select {
+		case e := <-w.inputCh:
+			batch = append(batch, e)
+		case <-timeout:
+			return batch
+		}
+	}
+
+	return batch
+}
+
+func (w *WAL) write(records ...[]Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+	if w.onCommit != nil {
+		if err := w.onCommit(); err != nil {
+			return fmt.Errorf("failed to sync data referred to by WAL records: %w", err)
+		}
+	}
+
+	for _, entries := range records {
+		if err := w.writeEntry(entries...); err != nil {
+			// the buffer holds a part of the batch, it must not reach the file later
+			w.err = fmt.Errorf("failed to write WAL entry: %w", err)
+			return w.err
+		}
+	}
+	if err := w.sync(); err != nil {
+		// the state of the file is unknown after a failed fsync
+		w.err = err
+		return err
+	}
+
+	return nil
+}
+
+func (w *WAL) sync() error {
 	if err := w.writer.Flush(); err != nil {
 		return fmt.Errorf("failed to flush WAL: %w", err)
 	}
 	if err := w.file.Sync(); err != nil {
 		return fmt.Errorf("failed to sync WAL: %w", err)
 	}
+	return nil
+}
 
-	// Notify completion
-	w.doneCh <- entry.SeqNum
+func (w *WAL) active() *segment {
+	return w.segments[len(w.segments)-1]
+}
+
+// Rotate seals the active segment and directs new writes to the next one
+func (w *WAL) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return ErrClosed
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.sync(); err != nil {
+		return err
+	}
+
+	next := newSegment(w.dir, w.active().id+1)
+	file, err := openSegment(next.path)
+	if err != nil {
+		return err
+	}
+
+	if err := w.file.Close(); err != nil {
+		slog.Warn("failed to close sealed WAL segment", "path", w.active().path, "error", err)
+	}
+	w.segments = append(w.segments, next)
+	w.file = file
+	w.writer = bufio.NewWriter(file)
+
+	return nil
+}
+
+// Segment returns the number of the active segment, appended
+// entries are written to it or to a later one
+func (w *WAL) Segment() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.active().id
+}
+
+// Truncate removes sealed segments numbered below before
+func (w *WAL) Truncate(before uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	removed := 0
+	defer func() {
+		w.segments = w.segments[removed:]
+	}()
+
+	// the active segment is never removed
+	for _, seg := range w.segments[:len(w.segments)-1] {
+		if seg.id >= before {
+			break
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove WAL segment: %w", err)
+		}
+		removed++
+	}
 
 	return nil
 }
 
-func (w *WAL) Replay(start types.SeqN, callback func(Entry) error) error {
+// Replay reads segments numbered from start in order and calls callback for their entries
+func (w *WAL) Replay(start uint64, callback func(Entry) error) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -101,8 +338,23 @@ func (w *WAL) Replay(start types.SeqN, callback func(Entry) error) error {
 		return fmt.Errorf("failed to flush WAL before replay: %w", err)
 	}
 
+	for i, seg := range w.segments {
+		if seg.id < start {
+			continue
+		}
+		if err := w.replaySegment(seg, i == len(w.segments)-1, callback); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaySegment reads records of the segment, only the last segment
+// may end with a torn record, sealed ones were written completely
+func (w *WAL) replaySegment(seg *segment, last bool, callback func(Entry) error) error {
 	// Open file for reading
-	file, err := os.Open(w.filePath)
+	file, err := os.Open(seg.path)
 	if err != nil {
 		return fmt.Errorf("failed to open WAL for reading: %w", err)
 	}
@@ -112,25 +364,67 @@ func (w *WAL) Replay(start types.SeqN, callback func(Entry) error) error {
 		}
 	}()
 
-	reader := bufio.NewReader(file)
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat WAL: %w", err)
+	}
+	size := info.Size()
 
+	reader := bufio.NewReader(file)
+	offset := int64(0)
 	for {
-		entry, err := w.readEntry(reader)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			return fmt.Errorf("failed to read WAL entry: %w", err)
+		entries, n, err := readRecord(reader, size-offset)
+		if errors.Is(err, io.ErrUnexpectedEOF) && !last {
+			// the rest of a sealed segment cannot be framed, n covers it
+			err = fmt.Errorf("%w: record runs past the end of sealed segment", ErrCorrupted)
 		}
-		if entry.SeqNum < start {
+		switch {
+		case err == nil:
+		case errors.Is(err, io.EOF):
+			return nil
+		case last && (errors.Is(err, io.ErrUnexpectedEOF) || offset+n >= size):
+			// the last record was not written completely
+			return w.dropTail(seg, offset, size)
+		case errors.Is(err, ErrCorrupted) && w.policy == SkipCorrupted:
+			slog.Warn("skipping corrupted WAL record", "path", seg.path, "offset", offset, "size", n, "error", err)
+			offset += n
 			continue
+		default:
+			return fmt.Errorf("failed to read WAL entry at %s:%d: %w", seg.path, offset, err)
 		}
+		offset += n
 
-		if err := callback(entry); err != nil {
-			return fmt.Errorf("WAL replay callback failed: %w", err)
+		for _, entry := range entries {
+			if err := callback(entry); err != nil {
+				return fmt.Errorf("WAL replay callback failed: %w", err)
+			}
 		}
 	}
+}
 
+// dropTail truncates a torn record at the end of the segment unless the policy forbids it
+func (w *WAL) dropTail(seg *segment, offset, size int64) error {
+	if w.policy == FailOnCorruption {
+		return fmt.Errorf("%w: torn record at %s:%d", ErrCorrupted, seg.path, offset)
+	}
+
+	slog.Warn("truncating torn WAL tail", "path", seg.path, "offset", offset, "dropped_bytes", size-offset)
+	file, err := os.OpenFile(seg.path, os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil {
+			slog.Warn("failed to close WAL segment", "error", cerr)
+		}
+	}()
+
+	if err := file.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate WAL: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
 	return nil
 }
 
@@ -138,12 +432,12 @@ func (w *WAL) Close() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	if w.writer != nil {
+	if w.writer != nil && w.err == nil {
 		if err := w.writer.Flush(); err != nil {
 			return fmt.Errorf("failed to flush WAL on close: %w", err)
 		}
-		w.writer = nil
 	}
+	w.writer = nil
 
 	if w.file != nil {
 		if err := w.file.Close(); err != nil {
@@ -155,99 +449,36 @@ func (w *WAL) Close() error {
 	return nil
 }
 
-// writeEntry writes a single entry to the WAL
-func (w *WAL) writeEntry(entry Entry) error {
+// writeEntry writes the entries as a single framed record to the WAL
+func (w *WAL) writeEntry(entries ...Entry) error {
 	if w.writer == nil {
 		return fmt.Errorf("WAL writer is nil")
 	}
 
-	// Write sequence number (8 bytes)
-	if err := binary.Write(w.writer, binary.LittleEndian, entry.SeqNum); err != nil {
-		return err
-	}
-
-	// Write metadata (8 bytes)
-	if err := binary.Write(w.writer, binary.LittleEndian, entry.Meta); err != nil {
-		return err
-	}
-
-	// Write key length (4 bytes) - ensure it fits into uint32
-	if len(entry.Key) > math.MaxUint32 {
-		return fmt.Errorf("key too large: %d", len(entry.Key))
-	}
-	keyLen := uint32(len(entry.Key))
-	if err := binary.Write(w.writer, binary.LittleEndian, keyLen); err != nil {
-		return err
-	}
-
-	// Write key
-	if _, err := w.writer.Write(entry.Key); err != nil {
-		return err
-	}
-
-	// Write value length (4 bytes) - ensure it fits into uint32
-	if len(entry.Value) > math.MaxUint32 {
-		return fmt.Errorf("value too large: %d", len(entry.Value))
-	}
-	valueLen := uint32(len(entry.Value))
-	if err := binary.Write(w.writer, binary.LittleEndian, valueLen); err != nil {
-		return err
-	}
-
-	// Write value
-	if _, err := w.writer.Write(entry.Value); err != nil {
+	record, err := encodeRecord(entries...)
+	if err != nil {
 		return err
 	}
-
-	return nil
+	_, err = w.writer.Write(record)
+	return err
 }
 
-// readEntry reads a single entry from the WAL
-func (w *WAL) readEntry(reader *bufio.Reader) (Entry, error) {
-	var entry Entry
-
-	// Read sequence number (8 bytes)
-	if err := binary.Read(reader, binary.LittleEndian, &entry.SeqNum); err != nil {
-		return entry, err
-	}
-
-	// Read metadata (8 bytes)
-	if err := binary.Read(reader, binary.LittleEndian, &entry.Meta); err != nil {
-		return entry, err
-	}
-
-	// Read key length (4 bytes)
-	var keyLen uint32
-	if err := binary.Read(reader, binary.LittleEndian, &keyLen); err != nil {
-		return entry, err
-	}
-
-	// Read key
-	entry.Key = make([]byte, keyLen)
-	if _, err := reader.Read(entry.Key); err != nil {
-		return entry, err
-	}
-
-	// Read value length (4 bytes)
-	var valueLen uint32
-	if err := binary.Read(reader, binary.LittleEndian, &valueLen); err != nil {
-		return entry, err
-	}
+// stop rejects new appends and commits the entries already queued
+func (w *WAL) stop() {
+	close(w.closed)
+	w.appendMu.Lock()
+	defer w.appendMu.Unlock()
 
-	// Read value
-	entry.Value = make([]byte, valueLen)
-	if _, err := reader.Read(entry.Value); err != nil {
-		return entry, err
+	var batch []pending
+	for {
+		select {
+		case p := <-w.inputCh:
+			batch = append(batch, p)
+		default:
+			if len(batch) > 0 {
+				w.commit(batch)
+			}
+			return
+		}
 	}
-
-	return entry, nil
-}
-
-func (w *WAL) Done() <-chan seqNum {
-	return w.doneCh
-}
-
-func (w *WAL) stop() {
-	close(w.inputCh)
-	close(w.doneCh)
 }
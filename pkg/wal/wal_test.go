@@ -0,0 +1,498 @@
+package wal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeTestEntries(t *testing.T, dir string, n int) []int64 {
+	t.Helper()
+
+	w, err := New(dir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+
+	// offsets[i] is the end of the i-th record
+	offsets := make([]int64, 0, n)
+	size := int64(0)
+	for i := 0; i < n; i++ {
+		entry := Entry{
+			SeqNum: uint64(i + 1),
+			Key:    []byte(fmt.Sprintf("key%d", i)),
+			Value:  []byte(fmt.Sprintf("value%d", i)),
+			Meta:   uint64(i % 2),
+		}
+		if err := w.writeEntry(entry); err != nil {
+			t.Fatalf("writeEntry failed: %v", err)
+		}
+		record, _ := encodeRecord(entry)
+		size += int64(len(record))
+		offsets = append(offsets, size)
+	}
+	if err := w.writer.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	return offsets
+}
+
+func replayAll(w *WAL) ([]Entry, error) {
+	var entries []Entry
+	err := w.Replay(0, func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+func openTestWAL(t *testing.T, dir string, opts ...Option) *WAL {
+	t.Helper()
+
+	w, err := New(dir, opts...)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	t.Cleanup(func() { _ = w.Close() })
+	return w
+}
+
+func TestWAL_ReplayRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	writeTestEntries(t, dir, 10)
+
+	entries, err := replayAll(openTestWAL(t, dir))
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(entries) != 10 {
+		t.Fatalf("expected 10 entries, got %d", len(entries))
+	}
+	for i, e := range entries {
+		if e.SeqNum != uint64(i+1) || string(e.Key) != fmt.Sprintf("key%d", i) ||
+			string(e.Value) != fmt.Sprintf("value%d", i) || e.Meta != uint64(i%2) {
+			t.Fatalf("unexpected entry %d: %+v", i, e)
+		}
+	}
+}
+
+func TestWAL_TornTailIsTruncated(t *testing.T) {
+	dir := t.TempDir()
+	offsets := writeTestEntries(t, dir, 3)
+	path := newSegment(dir, 1).path
+
+	// power cut in the middle of the last record
+	if err := os.Truncate(path, offsets[2]-3); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+
+	if _, err := replayAll(openTestWAL(t, dir, WithRecoveryPolicy(FailOnCorruption))); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted with fail policy, got %v", err)
+	}
+
+	w := openTestWAL(t, dir)
+	entries, err := replayAll(w)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if info, _ := os.Stat(path); info.Size() != offsets[1] {
+		t.Fatalf("torn tail is not truncated: size %d", info.Size())
+	}
+
+	// new records follow the last complete one
+	if err := w.writeEntry(Entry{SeqNum: 4, Key: []byte("key3")}); err != nil {
+		t.Fatalf("writeEntry failed: %v", err)
+	}
+	if err := w.writer.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if entries, err = replayAll(w); err != nil || len(entries) != 3 {
+		t.Fatalf("expected 3 entries after append, got %d: %v", len(entries), err)
+	}
+}
+
+func TestWAL_MidFileCorruption(t *testing.T) {
+	dir := t.TempDir()
+	offsets := writeTestEntries(t, dir, 3)
+	path := newSegment(dir, 1).path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	// flip a byte in the value of the second record
+	data[offsets[1]-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	if _, err := replayAll(openTestWAL(t, dir)); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted, got %v", err)
+	}
+
+	entries, err := replayAll(openTestWAL(t, dir, WithRecoveryPolicy(SkipCorrupted)))
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].SeqNum != 1 || entries[1].SeqNum != 3 {
+		t.Fatalf("expected records 1 and 3, got %+v", entries)
+	}
+	if info, _ := os.Stat(path); info.Size() != offsets[2] {
+		t.Fatal("skipped record must stay in the file")
+	}
+}
+
+func TestWAL_SealedSegmentLengthCorruption(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir)
+	if _, err := replayAll(w); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	// the first segment holds seqs 1-3 and is sealed, the second holds seq 4
+	var first []byte
+	for seq := uint64(1); seq <= 4; seq++ {
+		entry := Entry{SeqNum: seq, Key: []byte(fmt.Sprintf("key%d", seq))}
+		if err := w.write([]Entry{entry}); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if seq == 1 {
+			first, _ = encodeRecord(entry)
+		}
+		if seq == 3 {
+			if err := w.Rotate(); err != nil {
+				t.Fatalf("Rotate failed: %v", err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	path := newSegment(dir, 1).path
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	// the length of the second record now points past the end of the file
+	data[len(first)+6] ^= 0x7f
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	if _, err := replayAll(openTestWAL(t, dir)); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted, got %v", err)
+	}
+
+	entries, err := replayAll(openTestWAL(t, dir, WithRecoveryPolicy(SkipCorrupted)))
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].SeqNum != 1 || entries[1].SeqNum != 4 {
+		t.Fatalf("expected records 1 and 4, got %+v", entries)
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Fatal("records of a sealed segment must not be truncated")
+	}
+}
+
+func TestWAL_RotateAndTruncate(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir)
+	if _, err := replayAll(w); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	// three segments holding seqs 1-2, 3-4 and 5
+	for seq := uint64(1); seq <= 5; seq++ {
+		if err := w.write([]Entry{{SeqNum: seq, Key: []byte(fmt.Sprintf("key%d", seq))}}); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if seq%2 == 0 {
+			if err := w.Rotate(); err != nil {
+				t.Fatalf("Rotate failed: %v", err)
+			}
+		}
+	}
+	if len(w.segments) != 3 {
+		t.Fatalf("expected 3 segments, got %d", len(w.segments))
+	}
+
+	if w.Segment() != 3 {
+		t.Fatalf("expected active segment 3, got %d", w.Segment())
+	}
+
+	// segments from the second one on still hold unflushed entries
+	if err := w.Truncate(2); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if len(w.segments) != 2 || w.segments[0].id != 2 {
+		t.Fatalf("expected segments 2 and 3, got %d segments", len(w.segments))
+	}
+	if _, err := os.Stat(newSegment(dir, 1).path); !os.IsNotExist(err) {
+		t.Fatal("covered segment must be removed")
+	}
+
+	// replay starts from the given segment
+	var replayed []uint64
+	if err := w.Replay(3, func(e Entry) error {
+		replayed = append(replayed, e.SeqNum)
+		return nil
+	}); err != nil || len(replayed) != 1 || replayed[0] != 5 {
+		t.Fatalf("expected only seq 5 from segment 3, got %v: %v", replayed, err)
+	}
+
+	// the active segment is kept even if fully covered
+	if err := w.Truncate(4); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if len(w.segments) != 1 || w.segments[0].id != 3 {
+		t.Fatalf("expected only the active segment, got %d segments", len(w.segments))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	entries, err := replayAll(openTestWAL(t, dir))
+	if err != nil || len(entries) != 1 || entries[0].SeqNum != 5 {
+		t.Fatalf("unexpected entries after reopen: %+v, %v", entries, err)
+	}
+}
+
+func TestWAL_MigratesLegacyFile(t *testing.T) {
+	dir := t.TempDir()
+
+	// the legacy log holds unframed entries, the last one is torn
+	var legacy []byte
+	for i := 0; i < 3; i++ {
+		legacy = binary.LittleEndian.AppendUint64(legacy, uint64(i+1))
+		legacy = binary.LittleEndian.AppendUint64(legacy, uint64(i%2))
+		legacy = binary.LittleEndian.AppendUint32(legacy, 4)
+		legacy = append(legacy, fmt.Sprintf("key%d", i)...)
+		legacy = binary.LittleEndian.AppendUint32(legacy, 6)
+		legacy = append(legacy, fmt.Sprintf("value%d", i)...)
+	}
+	legacy = binary.LittleEndian.AppendUint64(legacy, 4)
+	if err := os.WriteFile(filepath.Join(dir, legacyFileName), legacy, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	w := openTestWAL(t, dir)
+	entries, err := replayAll(w)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("expected 3 entries from the legacy log, got %d: %v", len(entries), err)
+	}
+	for i, entry := range entries {
+		if entry.SeqNum != uint64(i+1) || entry.Meta != uint64(i%2) ||
+			string(entry.Key) != fmt.Sprintf("key%d", i) || string(entry.Value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("unexpected entry %d: %+v", i, entry)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, legacyFileName)); !os.IsNotExist(err) {
+		t.Fatal("legacy log must be removed once converted")
+	}
+
+	// new records follow the converted ones
+	w.Start(context.Background())
+	if err := <-w.Append(Entry{SeqNum: 4, Key: []byte("key3")}); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	w.Stop()
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	entries, err = replayAll(openTestWAL(t, dir))
+	if err != nil || len(entries) != 4 || entries[3].SeqNum != 4 {
+		t.Fatalf("unexpected entries after reopen: %+v, %v", entries, err)
+	}
+}
+
+func TestWAL_GroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, WithGroupCommit(4, 0))
+
+	// queued entries are drained up to the batch limit
+	for seq := uint64(2); seq <= 5; seq++ {
+		w.inputCh <- pending{entries: []Entry{Entry{SeqNum: seq}}}
+	}
+	if batch := w.collectBatch(pending{entries: []Entry{Entry{SeqNum: 1}}}); len(batch) != 4 {
+		t.Fatalf("expected a batch of 4, got %d", len(batch))
+	}
+	if batch := w.collectBatch(<-w.inputCh); len(batch) != 1 {
+		t.Fatalf("expected a batch of 1, got %d", len(batch))
+	}
+
+	// with a delay the writer waits for late entries
+	w.maxBatchDelay = time.Second
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		for seq := uint64(8); seq <= 10; seq++ {
+			w.inputCh <- pending{entries: []Entry{Entry{SeqNum: seq}}}
+		}
+	}()
+	if batch := w.collectBatch(pending{entries: []Entry{Entry{SeqNum: 7}}}); len(batch) != 4 {
+		t.Fatalf("expected a full batch after delay, got %d", len(batch))
+	}
+}
+
+func TestWAL_GroupCommitAcksEveryEntry(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, WithGroupCommit(16, time.Millisecond))
+	if _, err := replayAll(w); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	w.Start(context.Background())
+
+	const n = 100
+	var wg sync.WaitGroup
+	for seq := uint64(1); seq <= n; seq++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := <-w.Append(Entry{SeqNum: seq, Key: []byte(fmt.Sprintf("key%d", seq))}); err != nil {
+				t.Errorf("Append %d failed: %v", seq, err)
+			}
+		}()
+	}
+	wg.Wait()
+	w.Stop()
+
+	if err := <-w.Append(Entry{SeqNum: n + 1}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after stop, got %v", err)
+	}
+
+	entries, err := replayAll(w)
+	if err != nil || len(entries) != n {
+		t.Fatalf("expected %d entries, got %d: %v", n, len(entries), err)
+	}
+}
+
+func TestWAL_WriteErrorIsReturnedToWriters(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir)
+	w.Start(context.Background())
+	defer w.Stop()
+
+	if err := <-w.Append(Entry{SeqNum: 1, Key: []byte("key1")}); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	// the file is gone under the writer
+	if err := w.file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := <-w.Append(Entry{SeqNum: 2, Key: []byte("key2")}); err == nil {
+		t.Fatal("expected write error")
+	}
+
+	// the log stays failed
+	if err := <-w.Append(Entry{SeqNum: 3, Key: []byte("key3")}); err == nil {
+		t.Fatal("expected write error after a failed commit")
+	}
+}
+
+func TestWAL_BatchRecordIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir)
+	w.Start(context.Background())
+
+	if err := <-w.Append(Entry{SeqNum: 1, Key: []byte("key1")}); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	batch := []Entry{
+		{SeqNum: 2, Key: []byte("key2"), Value: []byte("value2")},
+		{SeqNum: 3, Key: []byte("key3"), Meta: 1},
+		{SeqNum: 4, Key: []byte("key4"), Value: []byte("value4")},
+	}
+	if err := <-w.Append(batch...); err != nil {
+		t.Fatalf("Append batch failed: %v", err)
+	}
+	w.Stop()
+
+	entries, err := replayAll(w)
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d: %v", len(entries), err)
+	}
+	for i, e := range entries[1:] {
+		if e.SeqNum != batch[i].SeqNum || string(e.Key) != string(batch[i].Key) ||
+			string(e.Value) != string(batch[i].Value) || e.Meta != batch[i].Meta {
+			t.Fatalf("unexpected batch entry %d: %+v", i, e)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// a torn batch is dropped as a whole
+	path := newSegment(dir, 1).path
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	entries, err = replayAll(openTestWAL(t, dir))
+	if err != nil || len(entries) != 1 || entries[0].SeqNum != 1 {
+		t.Fatalf("expected only the first entry, got %+v: %v", entries, err)
+	}
+}
+
+func TestWAL_OnCommitRunsOncePerGroup(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir)
+
+	calls := 0
+	var syncErr error
+	w.OnCommit(func() error {
+		calls++
+		return syncErr
+	})
+	group := func(seqs ...uint64) []pending {
+		batch := make([]pending, 0, len(seqs))
+		for _, seq := range seqs {
+			batch = append(batch, pending{entries: []Entry{{SeqNum: seq}}, done: make(chan error, 1)})
+		}
+		return batch
+	}
+
+	batch := group(1, 2, 3, 4)
+	w.commit(batch)
+	for _, p := range batch {
+		if err := <-p.done; err != nil {
+			t.Fatalf("commit failed: %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single call for the group, got %d", calls)
+	}
+
+	// records are not written without the data they refer to, the log stays usable
+	syncErr = errors.New("sync failed")
+	batch = group(5)
+	w.commit(batch)
+	if err := <-batch[0].done; !errors.Is(err, syncErr) {
+		t.Fatalf("expected the sync error, got %v", err)
+	}
+	syncErr = nil
+	batch = group(6)
+	w.commit(batch)
+	if err := <-batch[0].done; err != nil {
+		t.Fatalf("commit after a failed sync failed: %v", err)
+	}
+
+	entries, err := replayAll(w)
+	if err != nil || len(entries) != 5 || entries[4].SeqNum != 6 {
+		t.Fatalf("unexpected entries: %+v, %v", entries, err)
+	}
+}